@@ -0,0 +1,190 @@
+package evoimage
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// Canonical form ///////////////////////////////////////////
+
+// The canonical form of a circuit doesn't depend on how it was written
+// or built: the nodes of each module are sorted by depth (like in
+// TopologicalSort) and, at equal depth, in the order of a depth first
+// walk from the outputs, the arguments of commutative operators are
+// sorted by the subexpressions they compute,
+// and the modules other than main are renamed m1, m2, ... in the order
+// in which they are first called from main. So two circuits that differ
+// only in the order of their nodes, in the order of the arguments of
+// commutative operators or in the names of their modules have the same
+// canonical form (and the same Hash).
+
+// nodeHashes returns, for each node of M, a hash of what it computes
+// that doesn't depend on the positions of the nodes. Calls use the
+// hashes of the called modules (in modules).
+func (M Module) nodeHashes(modules map[string]uint64) []uint64 {
+	hashes := make([]uint64, len(M.Nodes))
+	for n := len(M.Nodes) - 1; n >= 0; n-- {
+		node := M.Nodes[n]
+		h := fnv.New64a()
+		switch {
+		case M.isInput(n):
+			fmt.Fprintf(h, "input %s", node.Op)
+		case M.isCall(n):
+			fmt.Fprintf(h, "call %x", modules[node.Op])
+		case node.Op == "=":
+			fmt.Fprintf(h, "= %x", math.Float64bits(node.Value))
+		default:
+			fmt.Fprintf(h, "%s", node.Op)
+		}
+		args := make([]string, len(node.Args))
+		for i, a := range node.Args {
+			args[i] = fmt.Sprintf("%x.%d", hashes[a.Node()], a.Output())
+		}
+		if !M.isCall(n) && OperatorInfo[node.Op].Commutative {
+			sort.Strings(args)
+		}
+		for _, a := range args {
+			fmt.Fprintf(h, " %s", a)
+		}
+		hashes[n] = h.Sum64()
+	}
+	return hashes
+}
+
+// canonicalize puts the nodes of M in canonical order (removing the
+// ones not used by the outputs) and returns the hash of M.
+func (M *Module) canonicalize(modules map[string]uint64) uint64 {
+	hashes := M.nodeHashes(modules)
+	h := fnv.New64a()
+	fmt.Fprintf(h, "(%s)(", M.OutputNamesAsString())
+	for _, inp := range M.Inputs {
+		fmt.Fprintf(h, "%c", inp.Name)
+	}
+	fmt.Fprintf(h, ")")
+	for _, outp := range M.Outputs {
+		fmt.Fprintf(h, " %x.%d", hashes[outp.Idx], outp.Out)
+	}
+
+	for n, node := range M.Nodes {
+		if M.isCall(n) || !OperatorInfo[node.Op].Commutative {
+			continue
+		}
+		sort.SliceStable(node.Args, func(i, j int) bool {
+			a, b := node.Args[i], node.Args[j]
+			if ha, hb := hashes[a.Node()], hashes[b.Node()]; ha != hb {
+				return ha < hb
+			}
+			return a.Output() < b.Output()
+		})
+	}
+
+	// Number the nodes in postorder from the outputs, and sort them by
+	// depth like TopologicalSort (so that Read keeps the order)
+	order := []int{}
+	depth := make([]int, len(M.Nodes))
+	visited := make([]bool, len(M.Nodes))
+	var visit func(n int)
+	visit = func(n int) {
+		if visited[n] {
+			return
+		}
+		visited[n] = true
+		for _, a := range M.Nodes[n].Args {
+			visit(a.Node())
+			if d := depth[a.Node()] + 1; d > depth[n] {
+				depth[n] = d
+			}
+		}
+		order = append(order, n)
+	}
+	for _, outp := range M.Outputs {
+		visit(outp.Idx)
+	}
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return depth[order[i]] > depth[order[j]]
+	})
+	newindex := make([]int, len(M.Nodes))
+	nodes := make([]*Node, len(order))
+	for i, n := range order {
+		newindex[n] = i
+		nodes[i] = M.Nodes[n]
+	}
+	for _, node := range nodes {
+		for j, a := range node.Args {
+			node.Args[j] = argument(newindex[a.Node()], a.Output())
+		}
+	}
+	for i := range M.Outputs {
+		M.Outputs[i].Idx = newindex[M.Outputs[i].Idx]
+	}
+	M.Nodes = nodes
+	M.reconstructInputs()
+	return h.Sum64()
+}
+
+// Canonical returns a copy of C in canonical form (see above), which
+// computes the same image. Modules not called from main are removed. It
+// gives an error if the modules can't be ordered (see ModuleOrder),
+// which doesn't happen with circuits that can be read.
+func (C Circuit) Canonical() (Circuit, error) {
+	D := C.Clone()
+	order, err := D.ModuleOrder()
+	if err != nil {
+		return Circuit{}, err
+	}
+	hashes := make(map[string]uint64)
+	for _, name := range order {
+		hashes[name] = D.Modules[name].canonicalize(hashes)
+	}
+
+	// Rename the modules, in order of first call from main
+	names := map[string]string{"": ""}
+	queue := []string{""}
+	for i := 0; i < len(queue); i++ {
+		M := D.Modules[queue[i]]
+		for n, node := range M.Nodes {
+			if _, ok := names[node.Op]; ok || !M.isCall(n) {
+				continue
+			}
+			names[node.Op] = fmt.Sprintf("m%d", len(names))
+			queue = append(queue, node.Op)
+		}
+	}
+	modules := make(map[string]*Module)
+	for _, name := range queue {
+		M := D.Modules[name]
+		for n, node := range M.Nodes {
+			if M.isCall(n) {
+				node.Op = names[node.Op]
+			}
+		}
+		M.Name = names[name]
+		modules[M.Name] = M
+	}
+	D.Modules = modules
+	return D, nil
+}
+
+// CanonicalString returns the string of the canonical form of C. Two
+// circuits with the same canonical string compute the same image. If C
+// has no canonical form, it returns the string of C as it is.
+func (C Circuit) CanonicalString() string {
+	D, err := C.Canonical()
+	if err != nil {
+		return C.String()
+	}
+	return D.String()
+}
+
+// Hash returns a hash of the canonical string of C, to find equal circuits
+// quickly (equal hashes almost surely mean equal canonical strings).
+func (C Circuit) Hash() uint64 {
+	h := fnv.New64a()
+	fmt.Fprint(h, C.CanonicalString())
+	return h.Sum64()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	eimg "go-evoimage"
+	"image/gif"
+	"image/png"
+	"os"
+	"sync"
+)
+
+var (
+	Size    int
+	Samples int
+	Frames  int
+	Delay   int
+	PNG     bool
+	Curr    int = 1
+)
+
+var wg sync.WaitGroup
+
+func save(name string, encode func(f *os.File) error) {
+	f, err := os.Create(name)
+	if err != nil {
+		fmt.Printf("Cannot open '%s': %s", name, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	if err := encode(f); err != nil {
+		fmt.Printf("Cannot encode '%s': %s", name, err)
+		os.Exit(1)
+	}
+}
+
+func animate(n int, expr string) {
+	defer wg.Done()
+	e, err := eimg.Read(expr)
+	if err != nil {
+		fmt.Println("ERROR: ", err)
+		os.Exit(1)
+	}
+	fmt.Println(e)
+	frames, err := e.RenderFrames(eimg.RenderOptions{
+		Width:   Size,
+		Height:  Size,
+		Samples: Samples,
+	}, Frames)
+	if err != nil {
+		fmt.Println("ERROR: ", err)
+		os.Exit(1)
+	}
+	if PNG {
+		for i, frame := range frames {
+			name := fmt.Sprintf("anim%04d_%03d.png", n, i)
+			save(name, func(f *os.File) error { return png.Encode(f, frame) })
+		}
+		return
+	}
+	name := fmt.Sprintf("anim%04d.gif", n)
+	save(name, func(f *os.File) error { return gif.EncodeAll(f, eimg.GIF(frames, Delay)) })
+}
+
+func main() {
+	flag.IntVar(&Size, "s", 120, "Image size")
+	flag.IntVar(&Samples, "k", 1, "Number of samples per pixel")
+	flag.IntVar(&Frames, "n", 24, "Number of frames")
+	flag.IntVar(&Delay, "d", 4, "Delay between frames (in 100ths of a second)")
+	flag.BoolVar(&PNG, "png", false, "Write a PNG per frame instead of a GIF")
+	flag.Parse()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		wg.Add(1)
+		go animate(Curr, scanner.Text())
+		Curr++
+	}
+	wg.Wait()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	eimg "go-evoimage"
+	"go-evoimage/evolve"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"math/rand"
+	"os"
+	"time"
+)
+
+var (
+	TargetFile  string
+	OutputFile  string
+	Generations int
+	Size        int
+	Mu          int
+	Lambda      int
+	Tournament  int
+	NumNodes    int
+	Samples     int
+	Strategy    string
+	Metric      string
+	Seed        int64
+	WeightsFile string
+	Sigma       float64
+	Creep       float64
+)
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "ERROR: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func main() {
+	flag.StringVar(&TargetFile, "t", "", "Target image (PNG or JPEG)")
+	flag.StringVar(&OutputFile, "o", "", "Render the best circuit at the target's size to this PNG")
+	flag.IntVar(&Generations, "g", 100, "Number of generations")
+	flag.IntVar(&Size, "s", 48, "Size of the downsampled target used for scoring")
+	flag.IntVar(&Mu, "mu", 10, "Population size")
+	flag.IntVar(&Lambda, "lambda", 20, "Offspring per generation (plus strategy)")
+	flag.IntVar(&Tournament, "tsize", 3, "Tournament size (tournament strategy)")
+	flag.IntVar(&NumNodes, "k", 8, "Number of nodes in the initial random circuits")
+	flag.IntVar(&Samples, "samples", 1, "Number of samples per pixel when scoring")
+	flag.StringVar(&Strategy, "strategy", "plus", "Selection strategy (plus or tournament)")
+	flag.StringVar(&Metric, "metric", "mse", "Distance to the target (mse or ssim)")
+	flag.Int64Var(&Seed, "seed", 0, "Seed")
+	flag.StringVar(&WeightsFile, "weights", "", "Operator weights (JSON file)")
+	flag.Float64Var(&Sigma, "sigma", eimg.DefaultSigma, "Deviation of the perturbation of constants")
+	flag.Float64Var(&Creep, "creep", eimg.DefaultCreep, "Maximum step of the creep of constants")
+	flag.Parse()
+
+	if TargetFile == "" {
+		fatalf("Missing target image (-t)")
+	}
+	strategy, ok := evolve.Strategies[Strategy]
+	if !ok {
+		fatalf("Unknown strategy '%s'", Strategy)
+	}
+	metric, ok := evolve.Metrics[Metric]
+	if !ok {
+		fatalf("Unknown metric '%s'", Metric)
+	}
+	if WeightsFile != "" {
+		W, err := eimg.LoadWeights(WeightsFile)
+		if err != nil {
+			fatalf("%s", err)
+		}
+		eimg.OperatorWeights = W
+	}
+	if Seed == 0 {
+		Seed = time.Now().UnixNano()
+	}
+	rand.Seed(Seed)
+
+	f, err := os.Open(TargetFile)
+	if err != nil {
+		fatalf("Cannot open '%s': %s", TargetFile, err)
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		fatalf("Cannot decode '%s': %s", TargetFile, err)
+	}
+
+	mutator := eimg.NewMutator(Seed)
+	mutator.Sigma, mutator.Creep = Sigma, Creep
+
+	T, err := evolve.NewTarget(img, Size)
+	if err != nil {
+		fatalf("Cannot use '%s' as target: %s", TargetFile, err)
+	}
+	E, err := evolve.New(T, evolve.Options{
+		Metric:         metric,
+		Strategy:       strategy,
+		Mu:             Mu,
+		Lambda:         Lambda,
+		TournamentSize: Tournament,
+		NumNodes:       NumNodes,
+		Initial:        flag.Args(),
+		Samples:        Samples,
+		Seed:           Seed,
+		Mutator:        mutator,
+	})
+	if err != nil {
+		fatalf("%s", err)
+	}
+	for g := 0; g < Generations; g++ {
+		best := E.Step()
+		fmt.Printf("%d %.6f %s\n", E.Generation, best.Distance, best.Circuit)
+	}
+
+	if OutputFile != "" {
+		b := img.Bounds()
+		out, err := E.Best().Circuit.RenderWith(eimg.RenderOptions{
+			Width:   b.Dx(),
+			Height:  b.Dy(),
+			Samples: 4,
+		})
+		if err != nil {
+			fatalf("Cannot render the best circuit: %s", err)
+		}
+		f, err := os.Create(OutputFile)
+		if err != nil {
+			fatalf("Cannot create '%s': %s", OutputFile, err)
+		}
+		defer f.Close()
+		if err := png.Encode(f, out); err != nil {
+			fatalf("Cannot encode '%s': %s", OutputFile, err)
+		}
+	}
+}
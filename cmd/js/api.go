@@ -12,10 +12,21 @@ func printCircuit(C eimg.Circuit) string {
 	return C.String()
 }
 
+// glsl returns the fragment shader of C, to render it with WebGL (errors
+// are thrown as JavaScript errors).
+func glsl(C eimg.Circuit) string {
+	src, err := C.GLSL()
+	if err != nil {
+		panic(js.Global.Get("Error").New(err.Error()))
+	}
+	return src
+}
+
 func main() {
 	js.Global.Set("evoimage", map[string]interface{}{
 		"Read":          eimg.Read,
 		"RandomCircuit": eimg.RandomCircuit,
+		"GLSL":          glsl,
 	})
 	rand.Seed(time.Now().UnixNano())
 }
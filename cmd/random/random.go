@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	eimg "go-evoimage"
 	"math/rand"
+	"os"
 	"time"
 )
 
@@ -12,20 +14,48 @@ var (
 	Seed        int64
 	NumCircuits int
 	NumNodes    int
+	Time        bool
+	WeightsFile string
+	JSON        bool
 )
 
 func main() {
 	flag.Int64Var(&Seed, "s", 0, "Seed")
 	flag.IntVar(&NumCircuits, "n", 1, "Number of circuits to generate")
 	flag.IntVar(&NumNodes, "k", 5, "Number of nodes in random module")
+	flag.BoolVar(&Time, "T", false, "Add a time input (for animations)")
+	flag.StringVar(&WeightsFile, "weights", "", "Operator weights (JSON file)")
+	flag.BoolVar(&JSON, "json", false, "Write circuits in JSON (one per line)")
 	flag.Parse()
 
+	if WeightsFile != "" {
+		W, err := eimg.LoadWeights(WeightsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		eimg.OperatorWeights = W
+	}
+
 	if Seed == 0 {
 		Seed = time.Now().UnixNano()
 	}
 	rand.Seed(Seed)
+	inputs := "xyrt"
+	if Time {
+		inputs += "T"
+	}
 	for i := 0; i < NumCircuits; i++ {
-		e := eimg.RandomCircuit(NumNodes)
+		e := eimg.RandomCircuitWithInputs(inputs, NumNodes)
+		if JSON {
+			data, err := json.Marshal(e)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Println(string(data))
+			continue
+		}
 		fmt.Println(e)
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	eimg "go-evoimage"
 	"image/png"
+	"io/ioutil"
 	"os"
 	"runtime"
 	"sync"
@@ -13,20 +14,40 @@ import (
 
 var (
 	Size    int
+	Width   int
+	Height  int
 	Samples int
+	Workers int
+	Zoom    float64
+	PanX    float64
+	PanY    float64
+	Aspect  string
+	Seed    int64
+	Noise   int64
+	Expr    string
 	Curr    int = 1
 )
 
+var aspects = map[string]eimg.Aspect{
+	"fit":     eimg.AspectFit,
+	"fill":    eimg.AspectFill,
+	"stretch": eimg.AspectStretch,
+}
+
+var opts eimg.RenderOptions
+
 var wg sync.WaitGroup
 
-func render(n int, expr string) {
-	e, err := eimg.Read(expr)
+func render(n int, e eimg.Circuit) {
+	if Noise != 0 {
+		e.Seed = Noise
+	}
+	fmt.Println(e)
+	img, err := e.RenderWith(opts)
 	if err != nil {
-		fmt.Println("ERROR: ", err)
+		fmt.Printf("Cannot render '%s': %s", e, err)
 		os.Exit(1)
 	}
-	fmt.Println(e)
-	img := e.Render(Size, Samples)
 	imgname := fmt.Sprintf("img%04d.png", n)
 	f, err := os.Create(imgname)
 	if err != nil {
@@ -38,19 +59,74 @@ func render(n int, expr string) {
 		fmt.Printf("Cannot encode '%s': %s", imgname, err)
 		os.Exit(1)
 	}
-	wg.Done()
 }
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	flag.IntVar(&Size, "s", 120, "Image size")
+	flag.IntVar(&Width, "W", 0, "Image width (overrides -s)")
+	flag.IntVar(&Height, "H", 0, "Image height (overrides -s)")
 	flag.IntVar(&Samples, "k", 1, "Number of samples per pixel")
+	flag.IntVar(&Workers, "w", 0, "Number of render workers (0 = all CPUs)")
+	flag.Float64Var(&Zoom, "zoom", 1, "Zoom factor")
+	flag.Float64Var(&PanX, "px", 0, "Horizontal displacement of the center")
+	flag.Float64Var(&PanY, "py", 0, "Vertical displacement of the center")
+	flag.StringVar(&Aspect, "aspect", "fit", "Aspect handling (fit, fill or stretch)")
+	flag.Int64Var(&Seed, "seed", 0, "Seed of the sample jitter")
+	flag.Int64Var(&Noise, "noise", 0, "Seed of the noise (overrides the circuit's)")
+	flag.StringVar(&Expr, "expr", "", "Render a program in the expression language (file)")
 	flag.Parse()
 
+	aspect, ok := aspects[Aspect]
+	if !ok {
+		fmt.Printf("ERROR: Unknown aspect '%s'\n", Aspect)
+		os.Exit(1)
+	}
+	opts = eimg.RenderOptions{
+		Width:   Size,
+		Height:  Size,
+		Samples: Samples,
+		Workers: Workers,
+		Zoom:    Zoom,
+		PanX:    PanX,
+		PanY:    PanY,
+		Aspect:  aspect,
+		Seed:    Seed,
+	}
+	if Width > 0 {
+		opts.Width = Width
+	}
+	if Height > 0 {
+		opts.Height = Height
+	}
+
+	if Expr != "" {
+		src, err := ioutil.ReadFile(Expr)
+		if err != nil {
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
+		}
+		e, err := eimg.ReadExpr(string(src))
+		if err != nil {
+			fmt.Printf("ERROR: %s:%s\n", Expr, err)
+			os.Exit(1)
+		}
+		render(Curr, e)
+		return
+	}
+
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
+		e, err := eimg.Read(scanner.Text())
+		if err != nil {
+			fmt.Println("ERROR: ", err)
+			os.Exit(1)
+		}
 		wg.Add(1)
-		go render(Curr, scanner.Text())
+		go func(n int, e eimg.Circuit) {
+			render(n, e)
+			wg.Done()
+		}(Curr, e)
 		Curr++
 	}
 	wg.Wait()
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"flag"
+	"fmt"
+	eimg "go-evoimage"
+	"go-evoimage/evolve"
+	"html/template"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	Addr     string
+	Store    string
+	PopSize  int
+	NumNodes int
+	Size     int
+	Samples  int
+	Seed     int64
+	Weights  string
+	Cached   int
+)
+
+// A Generation is a set of circuits together with the generation they
+// were bred from and the indices of the circuits chosen as parents.
+type Generation struct {
+	Circuits []string
+	From     int
+	Parents  []int
+}
+
+var (
+	mutex   sync.Mutex
+	history []Generation
+	cache   = newImageCache() // rendered PNGs by circuit hash
+)
+
+// saving serializes writes to the store, which are done without holding
+// mutex so that requests don't wait for the disk.
+var saving sync.Mutex
+
+// An imageCache keeps the last Cached images used (it is protected by
+// mutex).
+type imageCache struct {
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[uint64]*list.Element
+}
+
+type cacheEntry struct {
+	hash uint64
+	data []byte
+}
+
+func newImageCache() *imageCache {
+	return &imageCache{order: list.New(), entries: make(map[uint64]*list.Element)}
+}
+
+func (c *imageCache) get(h uint64) ([]byte, bool) {
+	e, ok := c.entries[h]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+func (c *imageCache) put(h uint64, data []byte) {
+	if e, ok := c.entries[h]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[h] = c.order.PushFront(&cacheEntry{h, data})
+	for c.order.Len() > Cached {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*cacheEntry).hash)
+	}
+}
+
+func load() {
+	data, err := ioutil.ReadFile(Store)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Cannot read '%s': %s", Store, err)
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		log.Fatalf("Cannot decode '%s': %s", Store, err)
+	}
+}
+
+// save writes the history to the store.
+func save() {
+	if Store == "" {
+		return
+	}
+	saving.Lock()
+	defer saving.Unlock()
+	mutex.Lock()
+	snapshot := history[:len(history):len(history)] // generations don't change
+	mutex.Unlock()
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		log.Printf("Cannot encode history: %s", err)
+		return
+	}
+	if err := ioutil.WriteFile(Store, data, 0644); err != nil {
+		log.Printf("Cannot write '%s': %s", Store, err)
+	}
+}
+
+func randomGeneration() Generation {
+	var G Generation
+	for i := 0; i < PopSize; i++ {
+		G.Circuits = append(G.Circuits, eimg.RandomCircuit(NumNodes).String())
+	}
+	return G
+}
+
+// maxTrials limits the offspring tried (per circuit) to avoid duplicates.
+const maxTrials = 10
+
+// breed produces the next generation from the chosen parents of G: the
+// parents are kept and the rest of the population are their mutants
+// and, if there are several parents, crossovers between them (all of
+// them different, if possible).
+func breed(gen int, G Generation, parents []int) Generation {
+	if len(parents) == 0 {
+		return randomGeneration()
+	}
+	next := Generation{From: gen, Parents: parents}
+	var circuits []eimg.Circuit
+	seen := make(map[uint64]bool)
+	for _, p := range parents {
+		C, err := eimg.Read(G.Circuits[p])
+		if err != nil {
+			log.Printf("Cannot read '%s': %s", G.Circuits[p], err)
+			continue
+		}
+		circuits = append(circuits, C)
+		next.Circuits = append(next.Circuits, G.Circuits[p])
+		seen[C.Hash()] = true
+	}
+	if len(circuits) == 0 {
+		return randomGeneration()
+	}
+	for i := 0; len(next.Circuits) < PopSize; i++ {
+		var M eimg.Circuit
+		if n := len(circuits); n > 1 && i%2 == 1 {
+			// Combine two different parents
+			a := rand.Intn(n)
+			b := (a + 1 + rand.Intn(n-1)) % n
+			M = circuits[a].Crossover(&circuits[b])
+		} else {
+			M = evolve.Mutant(circuits[i%len(circuits)])
+		}
+		// Avoid offspring equal to other circuits, if possible
+		h := M.Hash()
+		if seen[h] && i < maxTrials*PopSize {
+			continue
+		}
+		seen[h] = true
+		next.Circuits = append(next.Circuits, M.String())
+	}
+	return next
+}
+
+func render(s string) ([]byte, error) {
+	C, err := eimg.Read(s)
+	if err != nil {
+		return nil, err
+	}
+	h := C.Hash()
+	mutex.Lock()
+	data, ok := cache.get(h)
+	mutex.Unlock()
+	if ok {
+		return data, nil
+	}
+	img, err := C.RenderWith(eimg.RenderOptions{
+		Width:   Size,
+		Height:  Size,
+		Samples: Samples,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	mutex.Lock()
+	cache.put(h, buf.Bytes())
+	mutex.Unlock()
+	return buf.Bytes(), nil
+}
+
+var page = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>evoimage: generation {{.Gen}}</title>
+<style>
+body { font-family: sans-serif; }
+.grid { display: flex; flex-wrap: wrap; }
+.grid label { margin: 4px; }
+.grid input { display: none; }
+.grid img { border: 4px solid white; }
+.grid input:checked + img { border-color: #36c; }
+.circuit { font-family: monospace; font-size: 8pt; }
+</style>
+</head>
+<body>
+<h1>Generation {{.Gen}} of {{.Last}}</h1>
+<p>
+{{if gt .Gen 0}}<a href="/?gen={{.Prev}}">previous</a>{{end}}
+{{if lt .Gen .Last}}<a href="/?gen={{.Next}}">next</a>{{end}}
+</p>
+<form method="POST" action="/breed">
+<input type="hidden" name="gen" value="{{.Gen}}">
+<div class="grid">
+{{range $i, $c := .Circuits}}
+<label title="{{$c}}">
+<input type="checkbox" name="p" value="{{$i}}">
+<img src="/img?gen={{$.Gen}}&i={{$i}}" width="{{$.Size}}" height="{{$.Size}}">
+</label>
+{{end}}
+</div>
+<p><input type="submit" value="Breed selected (none = start over)"></p>
+</form>
+{{range .Circuits}}<div class="circuit">{{.}}</div>{{end}}
+</body>
+</html>
+`))
+
+// generation returns the generation in the `gen` parameter of the
+// request (the last one if missing).
+func generation(r *http.Request) (int, error) {
+	mutex.Lock()
+	last := len(history) - 1
+	mutex.Unlock()
+	sgen := r.FormValue("gen")
+	if sgen == "" {
+		return last, nil
+	}
+	gen, err := strconv.Atoi(sgen)
+	if err != nil || gen < 0 || gen > last {
+		return 0, fmt.Errorf("Wrong generation '%s'", sgen)
+	}
+	return gen, nil
+}
+
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	gen, err := generation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mutex.Lock()
+	G, last := history[gen], len(history)-1
+	mutex.Unlock()
+	err = page.Execute(w, map[string]interface{}{
+		"Gen":      gen,
+		"Prev":     gen - 1,
+		"Next":     gen + 1,
+		"Last":     last,
+		"Size":     Size,
+		"Circuits": G.Circuits,
+	})
+	if err != nil {
+		log.Printf("Cannot execute template: %s", err)
+	}
+}
+
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	gen, err := generation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mutex.Lock()
+	G := history[gen]
+	mutex.Unlock()
+	i, err := strconv.Atoi(r.FormValue("i"))
+	if err != nil || i < 0 || i >= len(G.Circuits) {
+		http.Error(w, "Wrong circuit index", http.StatusBadRequest)
+		return
+	}
+	data, err := render(G.Circuits[i])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
+
+func breedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	gen, err := generation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mutex.Lock()
+	G := history[gen]
+	mutex.Unlock()
+	parents := []int{}
+	for _, sp := range r.Form["p"] {
+		p, err := strconv.Atoi(sp)
+		if err != nil || p < 0 || p >= len(G.Circuits) {
+			http.Error(w, "Wrong parent index", http.StatusBadRequest)
+			return
+		}
+		parents = append(parents, p)
+	}
+	next := breed(gen, G, parents)
+	mutex.Lock()
+	history = append(history, next)
+	mutex.Unlock()
+	save()
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func main() {
+	flag.StringVar(&Addr, "addr", "localhost:8080", "Address to listen on")
+	flag.StringVar(&Store, "f", "", "File to keep the history in (none = memory only)")
+	flag.IntVar(&PopSize, "n", 12, "Number of circuits per generation")
+	flag.IntVar(&NumNodes, "k", 5, "Number of nodes in random modules")
+	flag.IntVar(&Size, "s", 160, "Image size")
+	flag.IntVar(&Samples, "samples", 2, "Number of samples per pixel")
+	flag.Int64Var(&Seed, "seed", 0, "Seed")
+	flag.StringVar(&Weights, "weights", "", "Operator weights (JSON file)")
+	flag.IntVar(&Cached, "cache", 256, "Number of rendered images to keep in memory")
+	flag.Parse()
+
+	if Weights != "" {
+		W, err := eimg.LoadWeights(Weights)
+		if err != nil {
+			log.Fatalf("Cannot load weights: %s", err)
+		}
+		eimg.OperatorWeights = W
+	}
+
+	if Seed == 0 {
+		Seed = time.Now().UnixNano()
+	}
+	rand.Seed(Seed)
+
+	if Store != "" {
+		load()
+	}
+	if len(history) == 0 {
+		history = append(history, randomGeneration())
+		save()
+	}
+
+	http.HandleFunc("/", indexHandler)
+	http.HandleFunc("/img", imageHandler)
+	http.HandleFunc("/breed", breedHandler)
+	log.Printf("Listening on http://%s/", Addr)
+	log.Fatal(http.ListenAndServe(Addr, nil))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setup starts the server state with a single random generation.
+func setup() {
+	PopSize, NumNodes, Size, Samples, Cached = 4, 3, 8, 1, 2
+	Store = ""
+	history = []Generation{randomGeneration()}
+	cache = newImageCache()
+}
+
+func serve(handler http.HandlerFunc, method, target string, form url.Values) *httptest.ResponseRecorder {
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestHandlers(t *testing.T) {
+	setup()
+	cases := []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+		form    url.Values
+		status  int
+	}{
+		{indexHandler, "GET", "/", nil, http.StatusOK},
+		{indexHandler, "GET", "/?gen=0", nil, http.StatusOK},
+		{indexHandler, "GET", "/?gen=1", nil, http.StatusBadRequest},
+		{indexHandler, "GET", "/?gen=x", nil, http.StatusBadRequest},
+		{indexHandler, "GET", "/other", nil, http.StatusNotFound},
+		{imageHandler, "GET", "/img?gen=0&i=0", nil, http.StatusOK},
+		{imageHandler, "GET", "/img?i=3", nil, http.StatusOK},
+		{imageHandler, "GET", "/img?gen=0&i=4", nil, http.StatusBadRequest},
+		{imageHandler, "GET", "/img?gen=0&i=-1", nil, http.StatusBadRequest},
+		{imageHandler, "GET", "/img?gen=0", nil, http.StatusBadRequest},
+		{breedHandler, "GET", "/breed", nil, http.StatusMethodNotAllowed},
+		{breedHandler, "POST", "/breed", url.Values{"gen": {"0"}, "p": {"4"}}, http.StatusBadRequest},
+		{breedHandler, "POST", "/breed", url.Values{"gen": {"0"}, "p": {"-1"}}, http.StatusBadRequest},
+		{breedHandler, "POST", "/breed", url.Values{"gen": {"0"}, "p": {"x"}}, http.StatusBadRequest},
+		{breedHandler, "POST", "/breed", url.Values{"gen": {"1"}, "p": {"0"}}, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		if w := serve(c.handler, c.method, c.target, c.form); w.Code != c.status {
+			t.Errorf("%s %s %v should give status %d (gives %d)",
+				c.method, c.target, c.form, c.status, w.Code)
+		}
+	}
+	if len(history) != 1 {
+		t.Errorf("Wrong requests should not breed (there are %d generations)", len(history))
+	}
+}
+
+func TestImage(t *testing.T) {
+	setup()
+	w := serve(imageHandler, "GET", "/img?gen=0&i=1", nil)
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Images should have type image/png (have '%s')", ct)
+	}
+	img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("Cannot decode image: %s", err)
+	}
+	if b := img.Bounds(); b.Dx() != Size || b.Dy() != Size {
+		t.Errorf("Image should be %dx%d (is %dx%d)", Size, Size, b.Dx(), b.Dy())
+	}
+	for i := 0; i < PopSize; i++ {
+		serve(imageHandler, "GET", "/img?gen=0&i="+strconv.Itoa(i), nil)
+	}
+	if n := cache.order.Len(); n > Cached {
+		t.Errorf("The cache should keep at most %d images (keeps %d)", Cached, n)
+	}
+}
+
+func TestBreed(t *testing.T) {
+	setup()
+	w := serve(breedHandler, "POST", "/breed", url.Values{"gen": {"0"}, "p": {"1", "2"}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("Breeding should redirect to / (gives %d to '%s')",
+			w.Code, w.Header().Get("Location"))
+	}
+	if len(history) != 2 {
+		t.Fatalf("Breeding should add a generation (there are %d)", len(history))
+	}
+	G, next := history[0], history[1]
+	if next.From != 0 || len(next.Parents) != 2 || len(next.Circuits) != PopSize {
+		t.Errorf("Wrong generation %+v", next)
+	}
+	if next.Circuits[0] != G.Circuits[1] || next.Circuits[1] != G.Circuits[2] {
+		t.Errorf("The parents should be kept in the next generation")
+	}
+	// No parents starts over
+	serve(breedHandler, "POST", "/breed", url.Values{"gen": {"1"}})
+	if len(history) != 3 || len(history[2].Parents) != 0 {
+		t.Errorf("Breeding without parents should add a random generation")
+	}
+}
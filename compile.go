@@ -0,0 +1,219 @@
+package evoimage
+
+import (
+	"fmt"
+	"go-evoimage/perlin"
+)
+
+// Program ////////////////////////////////////////////////
+
+// A Program is a Circuit compiled to a flat list of instructions.
+// Every node output lives in a register, module calls are inlined
+// and constants are preloaded in the register file, so evaluating
+// a Program is a single linear loop with no lookups. The functions of
+// Unary and Binary operators are called directly, and other operators
+// through their Operator.
+
+type opcode int
+
+const (
+	opUnary opcode = iota
+	opBinary
+	opExt
+)
+
+type instr struct {
+	op   opcode
+	dst  int
+	a, b int
+	f1   func(a float64) float64    // for opUnary
+	f2   func(a, b float64) float64 // for opBinary
+	ext  Operator                   // for opExt
+	args []int                      // for opExt
+}
+
+type Program struct {
+	code    []instr
+	init    []float64 // initial register file (holds the constants)
+	inputs  []int     // register of each main input (-1 if unused)
+	outputs []int     // register of each main output
+	ports   []Port    // main inputs (to bind them by name)
+	noise   *perlin.PerlinNoise
+}
+
+type compiler struct {
+	C     *Circuit
+	P     *Program
+	stack []string // modules being inlined
+}
+
+func (c *compiler) register(val float64) int {
+	c.P.init = append(c.P.init, val)
+	return len(c.P.init) - 1
+}
+
+// module emits the code for M, with its inputs bound to the registers
+// in inputs, and returns the registers holding its outputs.
+func (c *compiler) module(M *Module, inputs []int) (outputs []int, err error) {
+	for _, name := range c.stack {
+		if name == M.Name {
+			return nil, fmt.Errorf("Recursive call to module `%s`", M.Name)
+		}
+	}
+	c.stack = append(c.stack, M.Name)
+	defer func() { c.stack = c.stack[:len(c.stack)-1] }()
+
+	// registers holding the outputs of each node (nil until visited)
+	regs := make([][]int, len(M.Nodes))
+	for i, inp := range M.Inputs {
+		if inp.Idx != -1 {
+			regs[inp.Idx] = []int{inputs[i]}
+		}
+	}
+	visiting := make([]bool, len(M.Nodes))
+
+	var visit func(n int) error
+	visit = func(n int) error {
+		if regs[n] != nil {
+			return nil
+		}
+		if visiting[n] {
+			return fmt.Errorf("Loop in module `%s` at node %d", M.Name, n)
+		}
+		visiting[n] = true
+		node := M.Nodes[n]
+		args := make([]int, len(node.Args))
+		for j, arg := range node.Args {
+			if arg.Node() < 0 || arg.Node() >= len(M.Nodes) {
+				return fmt.Errorf("Nonexistent node %d in module `%s`", arg.Node(), M.Name)
+			}
+			if err := visit(arg.Node()); err != nil {
+				return err
+			}
+			if outs := regs[arg.Node()]; arg.Output() < len(outs) {
+				args[j] = outs[arg.Output()]
+			} else {
+				return fmt.Errorf("Error in node %d of module `%s`: node %d has %d outputs",
+					n, M.Name, arg.Node(), len(outs))
+			}
+		}
+		if node.Op == "=" {
+			regs[n] = []int{c.register(node.Value)}
+			return nil
+		}
+		if op, ok := registry[node.Op]; ok {
+			if nargs := op.Info().Nargs; nargs != len(args) {
+				return fmt.Errorf("Error in node %d: `%s` has %d args, not %d.",
+					n, node.Op, nargs, len(args))
+			}
+			in := instr{op: opExt, dst: c.register(0), ext: op, args: args}
+			switch op := op.(type) {
+			case Unary:
+				in = instr{op: opUnary, dst: in.dst, a: args[0], f1: op.F}
+			case Binary:
+				in = instr{op: opBinary, dst: in.dst, a: args[0], b: args[1], f2: op.F}
+			}
+			c.P.code = append(c.P.code, in)
+			regs[n] = []int{in.dst}
+			return nil
+		}
+		sub, ok := c.C.Modules[node.Op]
+		if !ok {
+			return fmt.Errorf("Missing module `%s`", node.Op)
+		}
+		if len(sub.Inputs) != len(args) {
+			return fmt.Errorf("Module `%s` has %d inputs, not %d.",
+				node.Op, len(sub.Inputs), len(args))
+		}
+		outs, err := c.module(sub, args)
+		if err != nil {
+			return err
+		}
+		regs[n] = outs
+		return nil
+	}
+
+	for _, outp := range M.Outputs {
+		if err = visit(outp.Idx); err != nil {
+			return
+		}
+		outs := regs[outp.Idx]
+		if outp.Out >= len(outs) {
+			return nil, fmt.Errorf("Output `%c` of module `%s`: node %d has %d outputs",
+				outp.Name, M.Name, outp.Idx, len(outs))
+		}
+		outputs = append(outputs, outs[outp.Out])
+	}
+	return
+}
+
+// Compile translates the circuit into a Program. Sub-module calls are
+// inlined, so the result does not depend on C anymore. The main module
+// must have three outputs (the red, green and blue of a pixel).
+func (C Circuit) Compile() (P *Program, err error) {
+	main, ok := C.Modules[""]
+	if !ok {
+		return nil, fmt.Errorf("There is no main module (with empty name)")
+	}
+	if len(main.Outputs) != 3 {
+		return nil, fmt.Errorf("The main module has %d outputs, not 3", len(main.Outputs))
+	}
+	P = &Program{
+		noise: noiseFor(C.Seed),
+		ports: append([]Port(nil), main.Inputs...),
+	}
+	c := &compiler{C: &C, P: P}
+	P.inputs = make([]int, len(main.Inputs))
+	for i, inp := range main.Inputs {
+		P.inputs[i] = -1
+		if inp.Idx != -1 {
+			P.inputs[i] = c.register(0)
+		}
+	}
+	P.outputs, err = c.module(main, P.inputs)
+	if err != nil {
+		return nil, err
+	}
+	return P, nil
+}
+
+// Registers returns a fresh register file to be used with Eval.
+func (P *Program) Registers() []float64 {
+	regs := make([]float64, len(P.init))
+	copy(regs, P.init)
+	return regs
+}
+
+func (P *Program) run(regs []float64, inputs []float64) {
+	for i, k := range P.inputs {
+		if k != -1 {
+			regs[k] = inputs[i]
+		}
+	}
+	var args [MAX_ARGS]float64
+	for i := range P.code {
+		in := &P.code[i]
+		switch in.op {
+		case opUnary:
+			regs[in.dst] = in.f1(regs[in.a])
+		case opBinary:
+			regs[in.dst] = in.f2(regs[in.a], regs[in.b])
+		case opExt:
+			for j, k := range in.args {
+				args[j] = regs[k]
+			}
+			regs[in.dst] = in.ext.Eval(args[:len(in.args)], P.noise)
+		}
+	}
+}
+
+// Eval runs the program on inputs, using regs (obtained from
+// Registers) as scratch space.
+func (P *Program) Eval(regs []float64, inputs []float64) (outputs []float64) {
+	P.run(regs, inputs)
+	outputs = make([]float64, len(P.outputs))
+	for i, k := range P.outputs {
+		outputs[i] = regs[k]
+	}
+	return
+}
@@ -0,0 +1,171 @@
+package evoimage
+
+// Crossover ///////////////////////////////////////////////
+
+// importModule copies module name (and the modules it calls) from D
+// into C, and returns its name in C: the same unless C already has a
+// different module with that name, in which case the copy gets a new
+// name (see newModuleName) and the calls to it are renamed. names maps
+// the modules of D imported so far to their names in C. It fails if D
+// lacks some module, leaving in C the modules imported so far.
+func (C *Circuit) importModule(D *Circuit, name string, names map[string]string) (string, bool) {
+	if newname, ok := names[name]; ok {
+		return newname, true
+	}
+	src, ok := D.Modules[name]
+	if !ok {
+		return "", false
+	}
+	mod := src.Clone()
+	for i, node := range mod.Nodes {
+		if !mod.isCall(i) {
+			continue
+		}
+		callee, ok := C.importModule(D, node.Op, names)
+		if !ok {
+			return "", false
+		}
+		node.Op = callee
+	}
+	newname := name
+	if old, ok := C.Modules[name]; ok {
+		if old.String() == mod.String() {
+			names[name] = name
+			return name, true
+		}
+		newname = C.newModuleName()
+		mod.Name = newname
+	}
+	C.Modules[newname] = mod
+	names[name] = newname
+	return newname, true
+}
+
+// transplant replaces node a of the main module of C (and everything
+// only it uses) with a copy of the subtree rooted at node b of the main
+// module of D. The subtree only depends on itself and on inputs, so
+// no loops can appear. Modules that only a used are removed, and the
+// ones the subtree calls are imported (see importModule). It fails
+// (leaving C as it was) if the subtree uses inputs that C does not have.
+func (C *Circuit) transplant(a int, D *Circuit, b int) bool {
+	A, B := C.Modules[""], D.Modules[""]
+	if C.numOutputs(A, a) != D.numOutputs(B, b) {
+		return false
+	}
+	subtree := B.MarkPredecessorsOf(b)
+
+	// Check inputs, then import modules
+	for i := range B.Nodes {
+		if subtree[i] && B.isInput(i) && A.inputIndex(rune(B.Nodes[i].Op[0])) == -1 {
+			return false
+		}
+	}
+	staged := Circuit{Modules: make(map[string]*Module, len(C.Modules))}
+	for name, mod := range C.Modules {
+		staged.Modules[name] = mod
+	}
+	names := make(map[string]string)
+	for i := range B.Nodes {
+		if !subtree[i] || !B.isCall(i) {
+			continue
+		}
+		if _, ok := staged.importModule(D, B.Nodes[i].Op, names); !ok {
+			return false
+		}
+	}
+	C.Modules = staged.Modules
+
+	// Assign new indices (adding the input nodes that A lacks first)
+	newindex := make([]int, len(B.Nodes))
+	for i := range B.Nodes {
+		if !subtree[i] || !B.isInput(i) {
+			continue
+		}
+		k := A.inputIndex(rune(B.Nodes[i].Op[0]))
+		if A.Inputs[k].Idx == -1 {
+			A.Nodes = append(A.Nodes, &Node{Op: B.Nodes[i].Op})
+			A.Inputs[k].Idx = len(A.Nodes) - 1
+		}
+		newindex[i] = A.Inputs[k].Idx
+	}
+	next := len(A.Nodes)
+	for i := range B.Nodes {
+		if subtree[i] && !B.isInput(i) {
+			newindex[i] = next
+			next++
+		}
+	}
+
+	// Copy the subtree
+	size := len(A.Nodes)
+	for i := range B.Nodes {
+		if !subtree[i] || B.isInput(i) {
+			continue
+		}
+		node := B.Nodes[i].Clone()
+		if B.isCall(i) {
+			node.Op = names[node.Op]
+		}
+		for j, arg := range node.Args {
+			node.Args[j] = argument(newindex[arg.Node()], arg.Output())
+		}
+		A.Nodes = append(A.Nodes, node)
+	}
+
+	// Redirect the users of a to the new subtree
+	root := newindex[b]
+	for i := 0; i < size; i++ {
+		for j, arg := range A.Nodes[i].Args {
+			if arg.Node() == a {
+				A.Nodes[i].Args[j] = argument(root, arg.Output())
+			}
+		}
+	}
+	for i := range A.Outputs {
+		if A.Outputs[i].Idx == a {
+			A.Outputs[i].Idx = root
+		}
+	}
+	A.TopologicalSort()
+	A.TreeShake()
+	C.removeUnusedModules()
+	return true
+}
+
+// Crossover returns a child of C and D: a copy of C in which a random
+// subtree of the main module is replaced by a random subtree of the
+// main module of D. If no compatible subtrees are found, the child is
+// a copy of C. It uses the global random generator (see
+// Mutator.Crossover).
+func (C *Circuit) Crossover(D *Circuit) (child Circuit) {
+	return defaultMutator().Crossover(C, D)
+}
+
+// Crossover is like Circuit.Crossover, but chooses the subtrees with the
+// random generator of m.
+func (m *Mutator) Crossover(C, D *Circuit) (child Circuit) {
+	child = C.Clone()
+	A, B := child.Modules[""], D.Modules[""]
+	candA, candB := []int{}, []int{}
+	for i := range A.Nodes {
+		if !A.isInput(i) {
+			candA = append(candA, i)
+		}
+	}
+	for i := range B.Nodes {
+		if !B.isInput(i) {
+			candB = append(candB, i)
+		}
+	}
+	if len(candA) == 0 || len(candB) == 0 {
+		return
+	}
+	for tries := 5; tries > 0; tries-- {
+		a := candA[m.Rand.Intn(len(candA))]
+		b := candB[m.Rand.Intn(len(candB))]
+		if child.transplant(a, D, b) {
+			return
+		}
+	}
+	return
+}
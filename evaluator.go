@@ -0,0 +1,150 @@
+package evoimage
+
+import (
+	"fmt"
+	"go-evoimage/perlin"
+)
+
+// Evaluator //////////////////////////////////////////////
+
+// An Evaluator evaluates a Circuit without touching it: the circuit is
+// only read, and the values of the nodes live in the scratch buffers of
+// the Evaluator. So a Circuit can be evaluated by several goroutines at
+// once, as long as each one has its own Evaluator (like the registers of
+// a Program). The buffers of all modules are built by NewEvaluator, so
+// an Evaluator evaluates the circuit as it was then: make a new one
+// after mutating it.
+type Evaluator struct {
+	C      *Circuit
+	noise  *perlin.PerlinNoise
+	frames map[string]*frame
+	inputs []float64 // of the main module, for RenderPixel
+}
+
+// frame holds the scratch buffers of a module. Modules can't be
+// recursive, so each one needs a single frame.
+type frame struct {
+	M       *Module
+	order   []int       // nodes to compute, arguments first
+	ops     []Operator  // operator of each node in order (nil for calls)
+	values  [][]float64 // outputs of each node
+	args    []float64
+	outputs []float64
+}
+
+// NewEvaluator returns an Evaluator for C (which can be nil to evaluate
+// modules that make no calls, using the noise of seed 0).
+func NewEvaluator(C *Circuit) *Evaluator {
+	E := &Evaluator{C: C, frames: make(map[string]*frame)}
+	if C != nil {
+		E.noise = noiseFor(C.Seed)
+		for name, M := range C.Modules {
+			E.frames[name] = newFrame(C, M)
+		}
+	} else {
+		E.noise = noiseFor(0)
+	}
+	return E
+}
+
+// newFrame returns the frame of M, which calls modules of C.
+func newFrame(C *Circuit, M *Module) *frame {
+	f := &frame{
+		M:       M,
+		values:  make([][]float64, len(M.Nodes)),
+		args:    make([]float64, MAX_ARGS),
+		outputs: make([]float64, len(M.Outputs)),
+	}
+	for i, node := range M.Nodes {
+		n := 1
+		if C != nil {
+			n = C.numOutputs(M, i)
+		}
+		f.values[i] = make([]float64, n)
+		if node.Op == "=" { // constants already have their value
+			f.values[i][0] = node.Value
+		}
+	}
+
+	// Select the nodes reachable from the outputs (but not inputs
+	// and constants)
+	selected := make([]bool, len(M.Nodes))
+	for _, outp := range M.Outputs {
+		selected[outp.Idx] = true
+	}
+	for i := range M.Nodes {
+		if selected[i] {
+			for _, arg := range M.Nodes[i].Args {
+				selected[arg.Node()] = true
+			}
+		}
+	}
+	for _, inp := range M.Inputs {
+		if inp.Idx != -1 {
+			selected[inp.Idx] = false
+		}
+	}
+	// Nodes are topologically sorted (arguments have higher indices),
+	// so evaluate them from the highest index to the lowest.
+	for i := len(M.Nodes) - 1; i >= 0; i-- {
+		node := M.Nodes[i]
+		if !selected[i] || node.Op == "=" {
+			continue
+		}
+		var op Operator
+		if !M.isCall(i) {
+			var ok bool
+			if op, ok = registry[node.Op]; !ok {
+				panic(fmt.Sprintf("Op '%s' not implemented!", node.Op))
+			}
+		}
+		f.order = append(f.order, i)
+		f.ops = append(f.ops, op)
+	}
+	return f
+}
+
+// eval evaluates the module of f and returns its outputs, which are
+// only valid until it is evaluated again.
+func (E *Evaluator) eval(f *frame, inputs []float64) []float64 {
+	M := f.M
+	for i, inp := range M.Inputs {
+		if inp.Idx != -1 {
+			f.values[inp.Idx][0] = inputs[i]
+		}
+	}
+	for k, n := range f.order {
+		node := M.Nodes[n]
+		args := f.args[:len(node.Args)]
+		for i, a := range node.Args {
+			args[i] = f.values[a.Node()][a.Output()]
+		}
+		if op := f.ops[k]; op != nil {
+			f.values[n][0] = op.Eval(args, E.noise)
+		} else {
+			copy(f.values[n], E.eval(E.frame(node.Op), args))
+		}
+	}
+	for i, outp := range M.Outputs {
+		f.outputs[i] = f.values[outp.Idx][outp.Out]
+	}
+	return f.outputs
+}
+
+func (E *Evaluator) frame(name string) *frame {
+	if f, ok := E.frames[name]; ok {
+		return f
+	}
+	panic(fmt.Sprintf("Module '%s' missing", name))
+}
+
+// EvalModule evaluates the module called name with the given inputs
+// (one per input of the module, in order).
+func (E *Evaluator) EvalModule(name string, inputs []float64) (outputs []float64) {
+	return append(outputs, E.eval(E.frame(name), inputs)...)
+}
+
+// Eval evaluates the main module.
+func (E *Evaluator) Eval(inputs []float64) (outputs []float64) {
+	return E.EvalModule("", inputs)
+}
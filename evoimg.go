@@ -4,19 +4,30 @@ import (
 	"bytes"
 	"fmt"
 	"go-evoimage/perlin"
-	"image"
-	"image/color"
+	"html"
 	"io"
-	"math"
-	"math/rand"
-	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"text/template"
-	"time"
 )
 
-var pnoise = perlin.NewPerlinNoise(time.Now().UnixNano())
+// Perlin noise generators, one per seed, shared by all evaluations.
+var noises = struct {
+	sync.Mutex
+	gen map[int64]*perlin.PerlinNoise
+}{gen: make(map[int64]*perlin.PerlinNoise)}
+
+func noiseFor(seed int64) *perlin.PerlinNoise {
+	noises.Lock()
+	defer noises.Unlock()
+	gen, ok := noises.gen[seed]
+	if !ok {
+		gen = perlin.NewPerlinNoise(seed)
+		noises.gen[seed] = gen
+	}
+	return gen
+}
 
 func find(v int, seq []int) int {
 	for i, x := range seq {
@@ -38,41 +49,19 @@ func uniq(seq []int) (res []int) {
 
 const MAX_ARGS = 10
 
-type OpInfo struct {
-	Nargs int
-}
-
-var NumArguments = map[int][]string{
-	0: {"="},
-	1: {"x2", "x3", "cos", "sin", "tri", "inv", "band", "bw"},
-	2: {"+", "*", "/", "-", "min", "max", "and", "or", "xor", "noise"},
-	3: {"lerp", "if"},
-}
-
-var Operators = []string{}
-var OperatorInfo = make(map[string]OpInfo)
-
-func init() {
-	for nargs, ops := range NumArguments {
-		for _, op := range ops {
-			Operators = append(Operators, op)
-			OperatorInfo[op] = OpInfo{
-				Nargs: nargs,
-			}
-		}
-	}
-}
-
 type Color struct {
 	R, G, B float64
 }
 type Argument int
+
+// A Node is read-only while the circuit is evaluated (see Evaluator).
+// Value holds the value of constants. A node calls a module if its Op
+// is not an operator (see Module.isCall), and has one output per output
+// of the module.
 type Node struct {
 	Op    string
 	Args  []Argument
-	Value []float64
-	Ready bool
-	Call  bool
+	Value float64
 }
 type _Node struct {
 	Node
@@ -81,7 +70,8 @@ type _Node struct {
 }
 type Port struct {
 	Name rune
-	Idx  int
+	Idx  int // node
+	Out  int // output of the node
 }
 type Module struct {
 	Name    string
@@ -91,6 +81,8 @@ type Module struct {
 }
 type Circuit struct {
 	Modules map[string]*Module
+	Seed    int64 // seed of the Perlin noise
+	Meta    Metadata
 }
 
 func argument(node, output int) Argument {
@@ -115,195 +107,13 @@ func (c *Color) Divide(x float64) Color {
 func (N *Node) Clone() (node *Node) {
 	node = &Node{
 		Op:    N.Op,
-		Value: make([]float64, len(N.Value)),
+		Value: N.Value,
 		Args:  make([]Argument, len(N.Args)),
 	}
-	copy(node.Value, N.Value)
 	copy(node.Args, N.Args)
 	return
 }
 
-func (node *Node) eval(M Module) {
-	if node.Ready {
-		return
-	}
-	switch node.Op {
-	case "=":
-		// Value is already there
-
-	case "x2":
-		i0 := node.Args[0]
-		f := M.Nodes[i0.Node()].Value[i0.Output()]
-		if f < .5 {
-			node.Value[0] = 2.0 * f
-		} else {
-			node.Value[0] = 2.0*f - 1
-		}
-
-	case "x3":
-		i0 := node.Args[0]
-		f := M.Nodes[i0.Node()].Value[i0.Output()]
-		if f < .3333 {
-			node.Value[0] = 3.0 * f
-		} else if f < .6666 {
-			node.Value[0] = 3.0*f - 1
-		} else {
-			node.Value[0] = 3.0*f - 2
-		}
-
-	case "band":
-		i0 := node.Args[0]
-		a := M.Nodes[i0.Node()].Value[i0.Output()]
-		if a > .33 && a < .66 {
-			node.Value[0] = 1.0
-		} else {
-			node.Value[0] = 0.0
-		}
-
-	case "bw":
-		i0 := node.Args[0]
-		a := M.Nodes[i0.Node()].Value[i0.Output()]
-		if a > .5 {
-			node.Value[0] = 1.0
-		} else {
-			node.Value[0] = 0.0
-		}
-
-	case "inv":
-		i0 := node.Args[0]
-		a := M.Nodes[i0.Node()].Value[i0.Output()]
-		node.Value[0] = (1 - a)
-
-	case "cos":
-		i0 := node.Args[0]
-		f := M.Nodes[i0.Node()].Value[i0.Output()]
-		node.Value[0] = (1 + math.Cos(2*math.Pi*f)) / 2
-
-	case "sin":
-		i0 := node.Args[0]
-		f := M.Nodes[i0.Node()].Value[i0.Output()]
-		node.Value[0] = (1 + math.Sin(2*math.Pi*f)) / 2
-
-	case "tri":
-		i0 := node.Args[0]
-		f := M.Nodes[i0.Node()].Value[i0.Output()]
-		if f < .5 {
-			node.Value[0] = 2.0 * f
-		} else {
-			node.Value[0] = 2.0 * (1 - f)
-		}
-
-	case "+":
-		i0 := node.Args[0]
-		i1 := node.Args[1]
-		o0 := M.Nodes[i0.Node()].Value[i0.Output()]
-		o1 := M.Nodes[i1.Node()].Value[i1.Output()]
-		node.Value[0] = (o0 + o1) / 2.0
-
-	case "-":
-		i0, i1 := node.Args[0], node.Args[1]
-		a := M.Nodes[i0.Node()].Value[i0.Output()]
-		b := M.Nodes[i1.Node()].Value[i1.Output()]
-		node.Value[0] = a - b
-
-	case "*":
-		i0, i1 := node.Args[0], node.Args[1]
-		a := M.Nodes[i0.Node()].Value[i0.Output()]
-		b := M.Nodes[i1.Node()].Value[i1.Output()]
-		node.Value[0] = a * b
-
-	case "/":
-		i0, i1 := node.Args[0], node.Args[1]
-		a := M.Nodes[i0.Node()].Value[i0.Output()]
-		b := M.Nodes[i1.Node()].Value[i1.Output()]
-		node.Value[0] = a / b
-
-	case "max":
-		i0 := node.Args[0]
-		i1 := node.Args[1]
-		p := M.Nodes[i0.Node()].Value[i0.Output()]
-		q := M.Nodes[i1.Node()].Value[i1.Output()]
-		if p > q {
-			node.Value[0] = p
-		} else {
-			node.Value[0] = q
-		}
-
-	case "min":
-		i0 := node.Args[0]
-		i1 := node.Args[1]
-		p := M.Nodes[i0.Node()].Value[i0.Output()]
-		q := M.Nodes[i1.Node()].Value[i1.Output()]
-		if p < q {
-			node.Value[0] = p
-		} else {
-			node.Value[0] = q
-		}
-
-	case "and":
-		i0 := node.Args[0]
-		i1 := node.Args[1]
-		p := M.Nodes[i0.Node()].Value[i0.Output()]
-		q := M.Nodes[i1.Node()].Value[i1.Output()]
-		if p > .5 && q > .5 {
-			node.Value[0] = 1.0
-		} else {
-			node.Value[0] = 0.0
-		}
-
-	case "or":
-		i0 := node.Args[0]
-		i1 := node.Args[1]
-		p := M.Nodes[i0.Node()].Value[i0.Output()]
-		q := M.Nodes[i1.Node()].Value[i1.Output()]
-		if p > .5 || q > .5 {
-			node.Value[0] = 1.0
-		} else {
-			node.Value[0] = 0.0
-		}
-
-	case "xor":
-		i0 := node.Args[0]
-		i1 := node.Args[1]
-		p := M.Nodes[i0.Node()].Value[i0.Output()]
-		q := M.Nodes[i1.Node()].Value[i1.Output()]
-		if p > .5 && q > .5 || p < .5 && q < .5 {
-			node.Value[0] = 1.0
-		} else {
-			node.Value[0] = 0.0
-		}
-
-	case "noise":
-		i0, i1 := node.Args[0], node.Args[1]
-		p := M.Nodes[i0.Node()].Value[i0.Output()]
-		q := M.Nodes[i1.Node()].Value[i1.Output()]
-		node.Value[0] = .5 + pnoise.At2d(10*p, 10*q)
-
-	case "lerp":
-		i0, i1, i2 := node.Args[0], node.Args[1], node.Args[2]
-		t := M.Nodes[i0.Node()].Value[i0.Output()]
-		A := M.Nodes[i1.Node()].Value[i1.Output()]
-		B := M.Nodes[i2.Node()].Value[i2.Output()]
-		node.Value[0] = t*A + (1-t)*B
-
-	case "if":
-		i0, i1, i2 := node.Args[0], node.Args[1], node.Args[2]
-		_cond := M.Nodes[i0.Node()].Value[i0.Output()]
-		_then := M.Nodes[i1.Node()].Value[i1.Output()]
-		_else := M.Nodes[i2.Node()].Value[i2.Output()]
-		if _cond > .5 {
-			node.Value[0] = _then
-		} else {
-			node.Value[0] = _else
-		}
-
-	default:
-		msg := fmt.Sprintf("Op '%s' not implemented!", node.Op)
-		panic(msg)
-	}
-	node.Ready = true
-}
-
 // Module //////////////////////////////////////////////////
 
 func (M Module) Size() int {
@@ -346,13 +156,16 @@ func (M Module) String() string {
 		for j := range M.Outputs {
 			if i == M.Outputs[j].Idx {
 				s += fmt.Sprintf("%c", M.Outputs[j].Name)
+				if M.Outputs[j].Out != 0 {
+					s += fmt.Sprintf("%d", M.Outputs[j].Out)
+				}
 				colon = ":"
 			}
 		}
 		s += colon
 		s += node.Op
 		if node.Op == "=" {
-			s += fmt.Sprintf(" %g", node.Value[0])
+			s += fmt.Sprintf(" %g", node.Value)
 		} else {
 			for _, arg := range node.Args {
 				s += fmt.Sprintf(" %d", arg)
@@ -372,6 +185,43 @@ func (M Module) isInput(n int) bool {
 	return false
 }
 
+// isCall tells whether node n of M is a call to another module.
+func (M Module) isCall(n int) bool {
+	_, isOperator := OperatorInfo[M.Nodes[n].Op]
+	return !isOperator && !M.isInput(n)
+}
+
+// usedOutputs returns how many outputs of node n are used (by other
+// nodes or by the outputs of M): one more than the highest used.
+func (M Module) usedOutputs(n int) (used int) {
+	for i := range M.Nodes {
+		for _, a := range M.Nodes[i].Args {
+			if a.Node() == n && a.Output() >= used {
+				used = a.Output() + 1
+			}
+		}
+	}
+	for _, outp := range M.Outputs {
+		if outp.Idx == n && outp.Out >= used {
+			used = outp.Out + 1
+		}
+	}
+	return
+}
+
+// numOutputs returns the number of outputs of node n of M: the number
+// of outputs of the called module for calls (0 if it's not in C), and
+// one for the other nodes.
+func (C Circuit) numOutputs(M *Module, n int) int {
+	if !M.isCall(n) {
+		return 1
+	}
+	if mod, ok := C.Modules[M.Nodes[n].Op]; ok {
+		return len(mod.Outputs)
+	}
+	return 0
+}
+
 func (M Module) OutputNamesAsString() (s string) {
 	for _, outp := range M.Outputs {
 		s += fmt.Sprintf("%c", outp.Name)
@@ -451,7 +301,7 @@ func (M *Module) TopologicalSort() {
 	for i := range _Nodes {
 		sorted_Nodes[i] = _Nodes[i]
 	}
-	sort.Sort(Topological(sorted_Nodes))
+	sort.Stable(Topological(sorted_Nodes))
 	for i := range sorted_Nodes {
 		sorted_Nodes[i].NewPos = i
 	}
@@ -539,7 +389,7 @@ func (M *Module) TreeShake() {
 			continue
 		}
 		for i := range node.Args {
-			node.Args[i] = argument(newindex[node.Args[i].Node()], 0)
+			node.Args[i] = argument(newindex[node.Args[i].Node()], node.Args[i].Output())
 		}
 		keepnodes = append(keepnodes, node)
 	}
@@ -547,26 +397,6 @@ func (M *Module) TreeShake() {
 	return
 }
 
-func (M Module) SetInputs(inputs []float64) {
-	for i := range M.Nodes {
-		M.Nodes[i].Ready = false
-	}
-	for i := range M.Inputs {
-		k := M.Inputs[i].Idx
-		if k != -1 {
-			M.Nodes[k].Value = []float64{inputs[i]}
-			M.Nodes[k].Ready = true
-		}
-	}
-}
-
-func (M Module) GetOutputs() (outputs []float64) {
-	for _, outp := range M.Outputs {
-		outputs = append(outputs, M.Nodes[outp.Idx].Value[0])
-	}
-	return
-}
-
 func (M Module) inputIndex(name rune) (index int) {
 	for i := range M.Inputs {
 		if M.Inputs[i].Name == name {
@@ -585,241 +415,57 @@ func (M Module) outputIndex(name rune) (index int) {
 	return -1
 }
 
-func (M Module) EvalNodes(C *Circuit, roots ...int) {
-	// Select nodes that we will compute
-	selected := make([]int, M.Size())
-	top := 0
-
-	_add := func(i int) {
-		if find(i, selected[:top]) == -1 {
-			selected[top] = i
-			top++
-		}
-	}
-
-	for _, root := range roots {
-		_add(root)
-	}
-	for i := 0; i < top; i++ {
-		for _, arg := range M.Nodes[selected[i]].Args {
-			_add(arg.Node())
-		}
-	}
-	for i := top - 1; i >= 0; i-- {
-		if M.Nodes[selected[i]].Call {
-			node := &M.Nodes[selected[i]]
-			inputs := []float64{}
-			for _, arg := range (*node).Args {
-				inputs = append(inputs, M.Nodes[arg.Node()].Value[arg.Output()])
-			}
-			outputs := C.EvalModule((*node).Op, inputs)
-			(*node).Value[0] = outputs[0]
-		} else {
-			M.Nodes[selected[i]].eval(M)
-		}
-	}
-}
-
+// Eval evaluates mod, which can only call modules of C (C can be nil).
 func (mod Module) Eval(C *Circuit, inputs []float64) (outputs []float64) {
-	mod.SetInputs(inputs)
-	mod.EvalNodes(C, mod.OutputIndices()...)
-	outputs = mod.GetOutputs()
-	return
-}
-
-var rmodule = regexp.MustCompile(`\((.*)\)(.*)\((.*)\)\[(.*)\]`)
-
-func parseModule(s string) (mod *Module, err error) {
-	if len(s) == 0 {
-		err = fmt.Errorf("Module is empty")
-		return
-	}
-	match := rmodule.FindStringSubmatch(s)
-	if len(match) != 5 {
-		err = fmt.Errorf("Modules must have format `(abc)name(xyz)[...]`")
-		return
-	}
-	outputs := match[1]
-	name := match[2]
-	inputs := match[3]
-	body := match[4]
-
-	if _, ok := OperatorInfo[name]; ok {
-		return mod, fmt.Errorf("Module name '%s' is reserved", name)
-	}
-	mod = &Module{Name: name}
-
-	for _, c := range inputs {
-		mod.Inputs = append(mod.Inputs, Port{Name: c, Idx: -1})
-	}
-	for _, c := range outputs {
-		mod.Outputs = append(mod.Outputs, Port{Name: c, Idx: -1})
-	}
-
-	for i, snod := range strings.Split(body, "|") {
-		parts := strings.Split(snod, ":")
-		switch len(parts) {
-		case 1:
-			snod = parts[0]
-		case 2:
-			for _, c := range strings.TrimSpace(parts[0]) {
-				k := mod.outputIndex(c)
-				if k == -1 {
-					err = fmt.Errorf("There is no output '%c'", c)
-					return
-				}
-				mod.Outputs[k].Idx = i
-			}
-			snod = parts[1]
-		default:
-			err = fmt.Errorf("Error in node %d: wrong number of ':'", i)
-			return
-		}
-
-		if snod == "" {
-			err = fmt.Errorf("Empty node")
-			return
-		}
-
-		var op string
-		rnod := strings.NewReader(snod)
-		n, err2 := fmt.Fscanf(rnod, "%s", &op)
-		if n != 1 || err2 != nil {
-			err = fmt.Errorf("Error in node %d: '%s'", i, snod)
-			return
-		}
-
-		var node *Node
-
-		if info, ok := OperatorInfo[op]; !ok {
-			// An input or a call
-			node = &Node{
-				Op:    op,
-				Value: []float64{0.0},
-			}
-			k := mod.inputIndex(rune(op[0]))
-			if k != -1 { // An input
-				if mod.Inputs[k].Idx != -1 {
-					err = fmt.Errorf("Duplicated input '%c'", mod.Inputs[k].Name)
-					return
-				}
-				mod.Inputs[k].Idx = i
-			} else {
-				for {
-					var arg int
-					n, err := fmt.Fscanf(rnod, "%d", &arg)
-					if n != 1 || err != nil {
-						break
-					}
-					node.Args = append(node.Args, argument(arg/10, arg%10))
-				}
-			}
-		} else {
-			if op == "=" {
-				// A constant
-				var val float64
-				n, _ := fmt.Fscanf(rnod, "%f", &val)
-				if n != 1 {
-					err = fmt.Errorf("Error in node %d: cannot read constant", i)
-					return
-				}
-				node = &Node{
-					Op:    "=",
-					Value: []float64{val},
-				}
-			} else {
-				// An operator
-				node = &Node{
-					Op:    op,
-					Value: []float64{0.0},
-				}
-				for {
-					var arg int
-					n, err := fmt.Fscanf(rnod, "%d", &arg)
-					if n != 1 || err != nil {
-						break
-					}
-					node.Args = append(node.Args, argument(arg/10, arg%10))
-				}
-				if info.Nargs != len(node.Args) {
-					err = fmt.Errorf("Error in node %d: `%s` has %d args, not %d.",
-						i, op, info.Nargs, len(node.Args))
-					return
-				}
-			}
-		}
-		mod.Nodes = append(mod.Nodes, node)
-	}
-	if len(mod.Outputs) == 0 {
-		err = fmt.Errorf("Error in module: there are no outputs")
-		return
-	}
-
-	// check missing outputs
-	for i := range mod.Outputs {
-		if mod.Outputs[i].Idx == -1 {
-			err = fmt.Errorf("Missing output `%c`", mod.Outputs[i].Name)
-			return
-		}
-	}
-
-	// check missing nodes
-	for i, node := range mod.Nodes {
-		for j, arg := range node.Args {
-			if arg == Unset {
-				err = fmt.Errorf("Argument %d missing in node '%d'", j, i)
-				return
-			}
-			if arg.Node() >= len(mod.Nodes) {
-				err = fmt.Errorf("Nonexistent node %d", arg.Node())
-				return
-			}
-		}
-	}
-	return
-}
-
-func readModule(s string) (mod *Module, err error) {
-	mod, err = parseModule(s)
-	if err != nil {
-		return
-	}
-	mod.TopologicalSort()
-	mod.TreeShake()
-	return
+	return append(outputs, NewEvaluator(C).eval(newFrame(C, &mod), inputs)...)
 }
 
+// RandomOperator chooses an operator at random, according to
+// OperatorWeights.
 func RandomOperator() (op string, info OpInfo) {
-	iop := rand.Intn(len(Operators))
-	op = Operators[iop]
+	op = OperatorWeights.Choose(Operators)
 	info = OperatorInfo[op]
 	return
 }
 
+// RandomNode returns a node with a random operator (a constant only if
+// wConst) and unset arguments.
 func RandomNode(wConst bool) (node *Node, info OpInfo) {
-	var op string
-	for {
-		op, info = RandomOperator()
-		if op != "=" {
-			break
-		}
-		if wConst {
-			break
+	return defaultMutator().randomNode(wConst)
+}
+
+func (m *Mutator) randomNode(wConst bool) (node *Node, info OpInfo) {
+	ops := Operators
+	if !wConst {
+		ops = []string{}
+		for _, op := range Operators {
+			if op != "=" {
+				ops = append(ops, op)
+			}
 		}
 	}
+	op := m.choose(ops)
+	info = OperatorInfo[op]
 	args := make([]Argument, info.Nargs)
 	for i := range args {
 		args[i] = Unset
 	}
 	node = &Node{
-		Op:    op,
-		Args:  args,
-		Value: []float64{0.0},
+		Op:   op,
+		Args: args,
 	}
 	return
 }
 
+// RandomModule returns a random module with the given inputs and
+// outputs, using the global random generator and OperatorWeights.
 func RandomModule(inputs, outputs string, numnodes int) (M *Module) {
+	return defaultMutator().RandomModule(inputs, outputs, numnodes)
+}
+
+// RandomModule returns a random module with the given inputs and
+// outputs, using the random generator and weights of m.
+func (m *Mutator) RandomModule(inputs, outputs string, numnodes int) (M *Module) {
 	M = &Module{}
 	for _, c := range inputs {
 		M.Inputs = append(M.Inputs, Port{Name: c, Idx: -1})
@@ -830,13 +476,12 @@ func RandomModule(inputs, outputs string, numnodes int) (M *Module) {
 
 	// 1) Generate nodes without connections
 	for i := 0; i < numnodes; i++ {
-		iop := rand.Intn(len(Operators))
-		op := Operators[iop]
+		op := m.choose(Operators)
 		info := OperatorInfo[op]
 		args := []Argument{}
 		val := 0.0
 		if op == "=" {
-			val = rand.Float64()
+			val = m.Rand.Float64()
 		} else {
 			for i := 0; i < info.Nargs; i++ {
 				args = append(args, -1)
@@ -845,14 +490,13 @@ func RandomModule(inputs, outputs string, numnodes int) (M *Module) {
 		M.Nodes = append(M.Nodes, &Node{
 			Op:    op,
 			Args:  args,
-			Value: []float64{val},
+			Value: val,
 		})
 	}
 	for i := range M.Inputs { // + add Input nodes at the end
 		k := len(M.Nodes)
 		M.Nodes = append(M.Nodes, &Node{
-			Op:    fmt.Sprintf("%c", M.Inputs[i].Name),
-			Value: []float64{0.0},
+			Op: fmt.Sprintf("%c", M.Inputs[i].Name),
 		})
 		M.Inputs[i].Idx = k
 	}
@@ -879,7 +523,7 @@ func RandomModule(inputs, outputs string, numnodes int) (M *Module) {
 			continue
 		}
 
-		r := rand.Intn(ninputs + noutputs)
+		r := m.Rand.Intn(ninputs + noutputs)
 
 		if r >= ninputs {
 			// assign to output
@@ -920,7 +564,7 @@ func RandomModule(inputs, outputs string, numnodes int) (M *Module) {
 	for i := range M.Nodes {
 		for j, a := range M.Nodes[i].Args {
 			if a == -1 {
-				M.Nodes[i].Args[j] = argument(i+1+rand.Intn(sz-i-1), 0)
+				M.Nodes[i].Args[j] = argument(i+1+m.Rand.Intn(sz-i-1), 0)
 			}
 		}
 	}
@@ -928,7 +572,7 @@ func RandomModule(inputs, outputs string, numnodes int) (M *Module) {
 	// 4) Assign at random the remaining outputs
 	for i := range M.Outputs {
 		if M.Outputs[i].Idx == -1 {
-			M.Outputs[i].Idx = rand.Intn(sz)
+			M.Outputs[i].Idx = m.Rand.Intn(sz)
 		}
 	}
 	M.reconstructInputs()
@@ -937,31 +581,11 @@ func RandomModule(inputs, outputs string, numnodes int) (M *Module) {
 	return M
 }
 
-var (
-	OperatorChangeProbability = 0.25
-	ConnectionSwapProbability = 0.25
-	InsertNodeProbability     = 0.25
-	RemoveNodeProbability     = 0.25
-)
-
-func (M *Module) Mutate() {
-	r := rand.Float64()
-	r -= OperatorChangeProbability
-	if r < 0 {
-		M.MutOperatorChange()
-	}
-	r -= ConnectionSwapProbability
-	if r < 0 {
-		M.MutConnectionSwap()
-	}
-	r -= InsertNodeProbability
-	if r < 0 {
-		M.MutInsertNode()
-	}
-	r -= RemoveNodeProbability
-	if r < 0 {
-		M.MutRemoveNode()
-	}
+// Mutate applies one of the mutations of a single module (see
+// MutationKinds), and tells whether it could.
+func (M *Module) Mutate() bool {
+	_, ok := defaultMutator().mutateModule(M)
+	return ok
 }
 
 type Queue struct {
@@ -1041,7 +665,12 @@ func swap(a, b *Argument) {
 	*a, *b = *b, *a
 }
 
-func (M *Module) MutConnectionSwap() {
+// MutConnectionSwap exchanges two arguments (without creating loops).
+func (M *Module) MutConnectionSwap() bool {
+	return M.mutConnectionSwap(defaultMutator())
+}
+
+func (M *Module) mutConnectionSwap(m *Mutator) bool {
 	for tries := 5; tries > 0; tries-- {
 		// escoger al azar 2 links
 		links1 := []Link{}
@@ -1054,7 +683,7 @@ func (M *Module) MutConnectionSwap() {
 		if sz1 == 0 {
 			continue
 		}
-		L1 := links1[rand.Intn(sz1)]
+		L1 := links1[m.Rand.Intn(sz1)]
 
 		predL1 := M.MarkPredecessorsOf(L1.Node)
 
@@ -1078,7 +707,7 @@ func (M *Module) MutConnectionSwap() {
 		if sz2 == 0 {
 			continue
 		}
-		L2 := links2[rand.Intn(sz2)]
+		L2 := links2[m.Rand.Intn(sz2)]
 
 		// swap
 		swap(
@@ -1086,11 +715,18 @@ func (M *Module) MutConnectionSwap() {
 			&M.Nodes[L2.Node].Args[L2.Input],
 		)
 		M.TopologicalSort()
-		return
+		return true
 	}
+	return false
 }
 
-func (M *Module) MutRemoveNode() {
+// MutRemoveNode removes a node, connecting its users to one of its
+// arguments.
+func (M *Module) MutRemoveNode() bool {
+	return M.mutRemoveNode(defaultMutator())
+}
+
+func (M *Module) mutRemoveNode(m *Mutator) bool {
 	uses := make([]int, len(M.Nodes))
 	for i := range M.Nodes {
 		for _, a := range M.Nodes[i].Args {
@@ -1112,8 +748,11 @@ func (M *Module) MutRemoveNode() {
 			candidates = append(candidates, i)
 		}
 	}
+	if len(candidates) == 0 {
+		return false
+	}
 	// Chose candidate + input
-	chosen := candidates[rand.Intn(len(candidates))]
+	chosen := candidates[m.Rand.Intn(len(candidates))]
 	choseninp := -1
 	for j, a := range M.Nodes[chosen].Args {
 		if uses[a.Node()] == 1 {
@@ -1122,7 +761,7 @@ func (M *Module) MutRemoveNode() {
 	}
 	nargs := len(M.Nodes[chosen].Args)
 	if choseninp == -1 {
-		choseninp = rand.Intn(nargs)
+		choseninp = m.Rand.Intn(nargs)
 	}
 	inp := M.Nodes[chosen].Args[choseninp]
 
@@ -1137,12 +776,19 @@ func (M *Module) MutRemoveNode() {
 	for i := range M.Outputs {
 		if M.Outputs[i].Idx == chosen {
 			M.Outputs[i].Idx = inp.Node()
+			M.Outputs[i].Out = inp.Output()
 		}
 	}
 	M.TreeShake()
+	return true
+}
+
+// MutInsertNode inserts a random node in the middle of a connection.
+func (M *Module) MutInsertNode() bool {
+	return M.mutInsertNode(defaultMutator())
 }
 
-func (M *Module) MutInsertNode() {
+func (M *Module) mutInsertNode(m *Mutator) bool {
 	// Choose a node+input.
 	nodes := []int{}
 	for i := range M.Nodes {
@@ -1150,46 +796,66 @@ func (M *Module) MutInsertNode() {
 			nodes = append(nodes, i)
 		}
 	}
-	chosen := nodes[rand.Intn(len(nodes))]
+	if len(nodes) == 0 {
+		return false
+	}
+	chosen := nodes[m.Rand.Intn(len(nodes))]
 	cargs := M.Nodes[chosen].Args
-	chosenarg := rand.Intn(len(cargs))
+	chosenarg := m.Rand.Intn(len(cargs))
 
-	// create a new node and put it in the middle
+	// create a new node to put in the middle
 	inew := len(M.Nodes)
-	node, info := RandomNode(false)
-	input := rand.Intn(info.Nargs)
+	node, info := m.randomNode(false)
+	if info.Nargs == 0 {
+		return false
+	}
+	input := m.Rand.Intn(info.Nargs)
+
+	// other arguments can be any node but the successors of the new
+	// one (the chosen node and its successors)
+	succ := M.MarkSuccessorsOf(chosen)
+	succ[chosen] = true
+	candidates := []int{}
+	for i := range succ {
+		if !succ[i] {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return false
+	}
 	node.Args[input] = M.Nodes[chosen].Args[chosenarg]
 	M.Nodes[chosen].Args[chosenarg] = argument(inew, 0)
-
-	// fill in other arguments
 	for i := range node.Args {
 		if node.Args[i] == Unset {
-			succ := M.MarkSuccessorsOf(inew)
-			candidates := []int{}
-			for i := range succ {
-				if !succ[i] {
-					candidates = append(candidates, i)
-				}
-			}
-			chosen := candidates[rand.Intn(len(candidates))]
-			node.Args[i] = argument(chosen, 0)
+			node.Args[i] = argument(candidates[m.Rand.Intn(len(candidates))], 0)
 		}
 	}
 
 	M.Nodes = append(M.Nodes, node)
 	M.TopologicalSort()
+	return true
+}
+
+// MutOperatorChange replaces the operator of a random node with another
+// one (built-in or registered) with the same number of arguments,
+// chosen according to OperatorWeights.
+func (M *Module) MutOperatorChange() bool {
+	return M.mutOperatorChange(defaultMutator())
 }
 
-func (M *Module) MutOperatorChange() {
+func (M *Module) mutOperatorChange(m *Mutator) bool {
 	candidates := []int{}
 	for i := range M.Nodes {
-		op := M.Nodes[i].Op
-		info := OperatorInfo[op]
-		if info.Nargs >= 1 && info.Nargs <= 2 {
+		info, ok := OperatorInfo[M.Nodes[i].Op]
+		if ok && info.Nargs >= 1 && len(NumArguments[info.Nargs]) > 1 {
 			candidates = append(candidates, i)
 		}
 	}
-	k := candidates[rand.Intn(len(candidates))]
+	if len(candidates) == 0 {
+		return false
+	}
+	k := candidates[m.Rand.Intn(len(candidates))]
 	chosen := M.Nodes[k].Op
 	info := OperatorInfo[chosen]
 	nargs := info.Nargs
@@ -1200,86 +866,126 @@ func (M *Module) MutOperatorChange() {
 			alternatives = append(alternatives, same_args[i])
 		}
 	}
-	M.Nodes[k].Op = alternatives[rand.Intn(len(alternatives))]
+	M.Nodes[k].Op = m.choose(alternatives)
+	return true
 }
 
-// Circuit /////////////////////////////////////////////////
+// Constant mutations
 
-func (C Circuit) EvalModule(name string, inputs []float64) (outputs []float64) {
-	mod, ok := C.Modules[name]
-	if !ok {
-		msg := fmt.Sprintf("Module '%s' missing", mod)
-		panic(msg)
+// constants returns the indices of the constant nodes of M.
+func (M Module) constants() (consts []int) {
+	for i := range M.Nodes {
+		if M.Nodes[i].Op == "=" {
+			consts = append(consts, i)
+		}
 	}
-	mod.SetInputs(inputs)
-	mod.EvalNodes(&C, mod.OutputIndices()...)
-	outputs = mod.GetOutputs()
 	return
 }
 
-func (C Circuit) Eval(inputs []float64) (outputs []float64) {
-	return C.EvalModule("", inputs)
+// MutPerturbConstant adds Gaussian noise with deviation sigma to the
+// value of a random constant.
+func (M *Module) MutPerturbConstant(sigma float64) bool {
+	m := defaultMutator()
+	m.Sigma = sigma
+	return M.mutPerturbConstant(m)
 }
 
-func _map(x float64) (y float64) {
-	y = x
-	if y > 1.0 {
-		y = 1.0
+func (M *Module) mutPerturbConstant(m *Mutator) bool {
+	consts := M.constants()
+	if len(consts) == 0 {
+		return false
 	}
-	if y < 0.0 {
-		y = 0.0
-	}
-	return
+	k := consts[m.Rand.Intn(len(consts))]
+	M.Nodes[k].Value += m.Rand.NormFloat64() * m.sigma()
+	return true
+}
+
+// MutCreepConstant adds a random step in [-step, step] to the value of
+// a random constant.
+func (M *Module) MutCreepConstant(step float64) bool {
+	m := defaultMutator()
+	m.Creep = step
+	return M.mutCreepConstant(m)
 }
 
-func (C Circuit) RenderPixel(xlow, ylow, xhigh, yhigh float64, samples int) Color {
-	xsz := (xhigh - xlow) / float64(samples)
-	ysz := (yhigh - ylow) / float64(samples)
-	S := make([]float64, samples*2)
-	for i := 0; i < samples; i++ {
-		S[i*2] = xlow + float64(i)*xsz + xsz*rand.Float64()
-		S[i*2+1] = ylow + float64(i)*ysz + ysz*rand.Float64()
+func (M *Module) mutCreepConstant(m *Mutator) bool {
+	consts := M.constants()
+	if len(consts) == 0 {
+		return false
 	}
-	for dim := 0; dim < 2; dim++ {
-		for i := 0; i < samples; i++ {
-			_i := rand.Intn(samples)
-			S[i*2+dim], S[_i*2+dim] = S[_i*2+dim], S[i*2+dim]
+	k := consts[m.Rand.Intn(len(consts))]
+	M.Nodes[k].Value += (2*m.Rand.Float64() - 1) * m.creep()
+	return true
+}
+
+// MutInsertConstant connects an argument of a random node to a new
+// constant with a random value in [0, 1).
+func (M *Module) MutInsertConstant() bool {
+	return M.mutInsertConstant(defaultMutator())
+}
+
+func (M *Module) mutInsertConstant(m *Mutator) bool {
+	nodes := []int{}
+	for i := range M.Nodes {
+		if len(M.Nodes[i].Args) > 0 {
+			nodes = append(nodes, i)
 		}
 	}
-	var c Color
-	for i := 0; i < len(S); i += 2 {
-		x, y := S[i], S[i+1]
-		_x, _y := x-.5, y-.5
-		r := math.Sqrt(_x*_x + _y*_y)
-		t := math.Atan2(_y, _x)/(2.0*math.Pi) + .5
-		inputs := []float64{x, y, r, t}
-		out := C.Eval(inputs)
-		c.Add(Color{out[0], out[1], out[2]})
-	}
-	return c.Divide(float64(samples))
-}
-
-func (C Circuit) Render(size, samples int) image.Image {
-	img := NewImage(size, size)
-	for i := 0; i < size; i++ {
-		for j := 0; j < size; j++ {
-			xlow := float64(i) / float64(size)
-			xhigh := float64(i+1) / float64(size)
-			ylow := float64(j) / float64(size)
-			yhigh := float64(j+1) / float64(size)
-			px := C.RenderPixel(xlow, ylow, xhigh, yhigh, samples)
-			img.px[i][j] = color.RGBA{
-				uint8(_map(px.R) * 255.0),
-				uint8(_map(px.G) * 255.0),
-				uint8(_map(px.B) * 255.0),
-				255,
-			}
+	if len(nodes) == 0 {
+		return false
+	}
+	chosen := nodes[m.Rand.Intn(len(nodes))]
+	args := M.Nodes[chosen].Args
+	args[m.Rand.Intn(len(args))] = argument(len(M.Nodes), 0)
+	M.Nodes = append(M.Nodes, &Node{
+		Op:    "=",
+		Value: m.Rand.Float64(),
+	})
+	M.TreeShake()
+	return true
+}
+
+// MutNodeToConstant replaces a random node (of which only the first
+// output is used) with a constant with a random value in [0, 1).
+func (M *Module) MutNodeToConstant() bool {
+	return M.mutNodeToConstant(defaultMutator())
+}
+
+func (M *Module) mutNodeToConstant(m *Mutator) bool {
+	candidates := []int{}
+	for i, node := range M.Nodes {
+		if node.Op != "=" && !M.isInput(i) && M.usedOutputs(i) <= 1 {
+			candidates = append(candidates, i)
 		}
 	}
-	return img
+	if len(candidates) == 0 {
+		return false
+	}
+	k := candidates[m.Rand.Intn(len(candidates))]
+	M.Nodes[k] = &Node{
+		Op:    "=",
+		Value: m.Rand.Float64(),
+	}
+	M.TreeShake()
+	return true
+}
+
+// Circuit /////////////////////////////////////////////////
+
+// EvalModule evaluates the module called name with a new Evaluator. To
+// evaluate many times, use an Evaluator (or a Program) instead.
+func (C Circuit) EvalModule(name string, inputs []float64) (outputs []float64) {
+	return NewEvaluator(&C).EvalModule(name, inputs)
+}
+
+func (C Circuit) Eval(inputs []float64) (outputs []float64) {
+	return C.EvalModule("", inputs)
 }
 
 func (C *Circuit) Clone() (newC Circuit) {
+	newC.Seed = C.Seed
+	newC.Meta = C.Meta
+	newC.Meta.Parents = append([]string(nil), C.Meta.Parents...)
 	newC.Modules = make(map[string]*Module)
 	for name, mod := range C.Modules {
 		newC.Modules[name] = mod.Clone()
@@ -1288,87 +994,139 @@ func (C *Circuit) Clone() (newC Circuit) {
 }
 
 func RandomCircuit(numnodes int) (C *Circuit) {
+	return RandomCircuitWithInputs("xyrt", numnodes)
+}
+
+// RandomCircuitWithInputs returns a random circuit whose main module
+// has the given inputs (from PixelInputs).
+func RandomCircuitWithInputs(inputs string, numnodes int) (C *Circuit) {
+	return defaultMutator().RandomCircuitWithInputs(inputs, numnodes)
+}
+
+// RandomCircuit is like the function RandomCircuit, but uses the random
+// generator and weights of m.
+func (m *Mutator) RandomCircuit(numnodes int) (C *Circuit) {
+	return m.RandomCircuitWithInputs("xyrt", numnodes)
+}
+
+func (m *Mutator) RandomCircuitWithInputs(inputs string, numnodes int) (C *Circuit) {
 	C = &Circuit{}
 	C.Modules = make(map[string]*Module)
-	C.Modules[""] = RandomModule("xyrt", "rgb", numnodes)
+	C.Modules[""] = m.RandomModule(inputs, "rgb", numnodes)
 	return C
 }
 
+// Mutate applies a random mutation (see Mutator), using the global
+// random generator and OperatorWeights.
 func (C *Circuit) Mutate() {
-	C.Modules[""].Mutate()
+	defaultMutator().Mutate(C)
 }
 
-func (C Circuit) String() (s string) {
-	i := 0
-	for _, mod := range C.Modules {
-		if i > 0 {
-			s += ";"
+// CallGraph returns, for each module, the sorted names of the modules
+// it calls.
+func (C Circuit) CallGraph() map[string][]string {
+	graph := make(map[string][]string)
+	for name, mod := range C.Modules {
+		seen := make(map[string]bool)
+		calls := []string{}
+		for i := range mod.Nodes {
+			if op := mod.Nodes[i].Op; mod.isCall(i) && !seen[op] {
+				seen[op] = true
+				calls = append(calls, op)
+			}
 		}
-		s += mod.String()
-		i++
+		sort.Strings(calls)
+		graph[name] = calls
 	}
-	return
+	return graph
 }
 
-func Read(s string) (C Circuit, err error) {
-	C.Modules = make(map[string]*Module)
-	smodules := strings.Split(s, ";")
-	for _, smod := range smodules {
-		mod, err := parseModule(smod)
-		if err != nil {
-			return C, err
+// ModuleOrder returns the names of the modules in topological order:
+// every module comes after the modules it calls, and the main module
+// comes last. It gives an error if some module calls itself, directly
+// or through other modules.
+func (C Circuit) ModuleOrder() (order []string, err error) {
+	graph := C.CallGraph()
+	names := make([]string, 0, len(graph))
+	for name := range graph {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	path := []string{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			path = append(path, name)
+			for i := range path {
+				if path[i] == name {
+					path = path[i:]
+					break
+				}
+			}
+			for i := range path {
+				if path[i] == "" {
+					path[i] = "main"
+				}
+			}
+			return fmt.Errorf("Recursive module call: %s", strings.Join(path, " -> "))
 		}
-		mod.TopologicalSort()
-		mod.TreeShake()
-		if _, ok := C.Modules[mod.Name]; !ok {
-			C.Modules[mod.Name] = mod
-		} else {
-			return C, fmt.Errorf("Duplicated module `%s`.", mod.Name)
+		state[name] = visiting
+		path = append(path, name)
+		for _, callee := range graph[name] {
+			if _, ok := graph[callee]; !ok {
+				return fmt.Errorf("Missing module `%s`", callee)
+			}
+			if err := visit(callee); err != nil {
+				return err
+			}
 		}
+		path = path[:len(path)-1]
+		state[name] = done
+		order = append(order, name)
+		return nil
 	}
-	// Checks:
-	// 1) There is a main module, with an empty name.
-	main, ok := C.Modules[""]
-	if !ok {
-		return C, fmt.Errorf("There is no main module (with empty name)")
-	}
-	// 2) The main module has rgb as outputs.
-	if names := main.OutputNamesAsString(); names != "rgb" {
-		return C, fmt.Errorf("Outputs != 'rgb'! (outputs = '%s')", names)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if err = visit(name); err != nil {
+			return nil, err
+		}
 	}
-	// 3) All modules except main have 1 output
-	for name, module := range C.Modules {
-		if module.Name != "" && len(module.Outputs) != 1 {
-			return C, fmt.Errorf("Module `%s` has more than one output", name)
+	if _, ok := graph[""]; ok {
+		if err = visit(""); err != nil {
+			return nil, err
 		}
 	}
+	return order, nil
+}
 
-	// Determine which nodes are calls to other modules
-	// + check number of args is correct
-	for name, mod := range C.Modules {
-		isInput := make(map[string]bool)
-		for i := range mod.Inputs {
-			sname := fmt.Sprintf("%c", mod.Inputs[i].Name)
-			isInput[sname] = true
-		}
-		for i, node := range mod.Nodes {
-			_, isOperator := OperatorInfo[node.Op]
-			if isOperator || isInput[node.Op] {
-				continue
-			}
-			if _, ok := C.Modules[node.Op]; ok {
-				C.Modules[name].Nodes[i].Call = true
-				has := len(C.Modules[node.Op].Inputs)
-				used := len(node.Args)
-				if used != has {
-					err = fmt.Errorf("Module `%s` has %d inputs, not %d.", node.Op, has, used)
-					return
-				}
-			} else {
-				err = fmt.Errorf("Missing module `%s`", node.Op)
-				return
-			}
+// String writes the main module first and then the other modules
+// sorted by name, so equal circuits give equal strings.
+func (C Circuit) String() (s string) {
+	names := make([]string, 0, len(C.Modules))
+	for name := range C.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if i > 0 {
+			s += ";"
 		}
+		s += C.Modules[name].String()
+	}
+	if C.Seed != 0 {
+		s += fmt.Sprintf(";@%d", C.Seed)
 	}
 	return
 }
@@ -1379,7 +1137,7 @@ var nodeLabelTmpl = template.Must(template.New("").Parse(`
 {{ range $i, $v := .inputs }}
    <TD port="i{{$i}}"><font point-size="7">{{$i}}</font></TD>{{end}}
 </TR>
-<TR><TD CELLPADDING="10" COLSPAN="{{.span}}">{{.name}}</TD></TR>
+<TR><TD CELLPADDING="10" COLSPAN="{{.span}}"{{if .boolean}} BGCOLOR="#dddddd"{{end}}>{{.name}}</TD></TR>
 <TR>
 {{ range $i, $v := .outputs }}
    <TD port="o{{$i}}"><font point-size="7">{{$i}}</font></TD>{{ end }}
@@ -1430,14 +1188,16 @@ func (C Circuit) Graphviz(w io.Writer) {
 				fmt.Fprintf(w, "      %d [%s];\n", i, sty)
 			} else {
 				var buf bytes.Buffer
+				outputs := make([]int, C.numOutputs(mod, i))
 				span := len(node.Args)
-				if len(node.Value) > span {
-					span = len(node.Value)
+				if len(outputs) > span {
+					span = len(outputs)
 				}
 				nodeLabelTmpl.Execute(&buf, map[string]interface{}{
-					"name":    node.Op,
+					"name":    html.EscapeString(node.Op),
+					"boolean": OperatorInfo[node.Op].Boolean,
 					"inputs":  node.Args,
-					"outputs": node.Value,
+					"outputs": outputs,
 					"span":    span,
 				})
 				fmt.Fprintf(w, "      %d [label=<%s>,shape=none];\n", i, buf.String())
@@ -1453,28 +1213,9 @@ func (C Circuit) Graphviz(w io.Writer) {
 		}
 		for i, out := range mod.Outputs {
 			k := len(mod.Nodes) + i
-			fmt.Fprintf(w, "      %d:o0 -> %d;\n", out.Idx, k)
+			fmt.Fprintf(w, "      %d:o%d -> %d;\n", out.Idx, out.Out, k)
 		}
 		fmt.Fprintf(w, "   }\n")
 	}
 	fmt.Fprintf(w, "}\n")
 }
-
-// Image ///////////////////////////////////////////////////
-
-type Image struct {
-	h, w int
-	px   [][]color.RGBA
-}
-
-func (I *Image) At(x, y int) color.Color { return I.px[x][y] }
-func (I *Image) ColorModel() color.Model { return color.RGBAModel }
-func (I *Image) Bounds() image.Rectangle { return image.Rect(0, 0, I.h, I.w) }
-
-func NewImage(h, w int) *Image {
-	px := make([][]color.RGBA, h)
-	for i := range px {
-		px[i] = make([]color.RGBA, w)
-	}
-	return &Image{h, w, px}
-}
@@ -1,7 +1,20 @@
 package evoimage
 
 import (
+	"encoding/json"
+	"fmt"
+	"go-evoimage/perlin"
+	"image"
+	"io/ioutil"
 	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -24,10 +37,10 @@ func TestReadErrorsModule(t *testing.T) {
 			"Nonexistent node 1",
 		}, {
 			"(y)(x)[y:+ 10|x]", // wrong number of args
-			"Error in node 0: `+` has 2 args, not 1.",
+			"`+` has 2 args, not 1 (module ``, node 0, char 9)",
 		}, {
-			"(y)(x)[y:+ 10|x]", // wrong number of args
-			"Error in node 0: `+` has 2 args, not 1.",
+			"(y)f(x)[y: +  10|x]", // wrong number of args
+			"`+` has 2 args, not 1 (module `f`, node 0, char 11)",
 		},
 	}
 	for _, cas := range cases {
@@ -83,6 +96,9 @@ func TestParseModule(t *testing.T) {
 		}, {
 			"(rgb)(x)[rgb:* 10 20|x|inv 10]",
 			"(rgb)(x)[rgb:* 10 20|x|inv 10]",
+		}, {
+			"(rgb)(xy)[r:+ 10 11|g0b1:sd 20 30|x|y]",
+			"(rgb)(xy)[r:+ 10 11|gb1:sd 20 30|x|y]",
 		},
 	}
 
@@ -199,6 +215,9 @@ func TestSortAndTreeShake(t *testing.T) {
 		}, {
 			"(p)(abc)[p:+ 20 10|b|c]",
 			"(p)(abc)[p:+ 20 10|b|c]",
+		}, {
+			"(pq)(ab)[p:+ 21 30|= 1|q2:f 30 40|a|b]",
+			"(pq)(ab)[p:+ 11 20|q2:f 20 30|a|b]",
 		},
 	}
 
@@ -230,21 +249,20 @@ func TestReadModuleName(t *testing.T) {
 }
 
 func TestEvalNodes(t *testing.T) {
-	e, err := readModule("(a)(xy)[a:+ 10 20|x|y]")
+	C, err := Read("(rgb)(xy)[r:+ 10 20|g:x|b:y]")
 	if err != nil {
-		t.Errorf("Error reading expression: %s", err)
+		t.Errorf("Error reading circuit: %s", err)
 	}
+	E := NewEvaluator(&C)
 	for x := 0.1; x < 1.0; x += .1 {
-		e.SetInputs([]float64{x, .5})
-		if e.EvalNodes(nil, 1); e.Nodes[1].Value[0] != x {
-			t.Errorf("Node 1 in '%s' should eval to %g", e.String(), x)
+		if out := E.EvalModule("", []float64{x, .5}); out[1] != x || out[0] != (x+.5)/2 {
+			t.Errorf("'%s' should eval to [%g %g .5] (evals to %v)", C, (x+.5)/2, x, out)
 		}
-		e.SetInputs([]float64{0, x})
-		if e.EvalNodes(nil, 2); e.Nodes[2].Value[0] != x {
-			t.Errorf("Node 2 in '%s' should eval to %g", e.String(), x)
+		if out := E.EvalModule("", []float64{0, x}); out[2] != x || out[0] != x/2 {
+			t.Errorf("'%s' should eval to [%g 0 %g] (evals to %v)", C, x/2, x, out)
 		}
 	}
-	e, err = readModule("(y)(x)[y:+ 10 20|x|= 0.5]")
+	e, err := readModule("(y)(x)[y:+ 10 20|x|= 0.5]")
 	if err != nil {
 		t.Errorf("Error reading expression: %s", err)
 	}
@@ -278,14 +296,26 @@ func TestReadErrorsCircuit(t *testing.T) {
 			"(rgb)(xyrt)[r:+ 1 2|g:+ 3 4|b:sum 5 6|x|y|r|t]",
 			"Missing module `sum`",
 		}, {
-			"(rgb)(xyrt)[r:+ 1 2|g:+ 3 4|b:sum 5 6|x|y|r|t];(fg)sum(xy)[f:+ 1 2|g:x|y]",
-			"Module `sum` has more than one output",
+			"(rgb)(x)[rgb:x];(abcdefghijk)m(x)[abcdefghijk:x]",
+			"Module `m` has more than 10 outputs",
+		}, {
+			"(rgb)(xy)[rgb:+ 11 20|x|y]",
+			"Node 1 has 1 outputs (module ``, node 0, char 16)",
+		}, {
+			"(rgb)(xy)[rg:x|b1:y]",
+			"Output `b` uses node 1, which has 1 outputs (module ``, char 3)",
 		}, {
 			"(rgb)(xy)[rgb:sum 1 2|x|y];(f)sum(xyz)[f:+ 1 2|x|+ 3 4|y|z]",
-			"Module `sum` has 3 inputs, not 2.",
+			"Module `sum` has 3 inputs, not 2 (module ``, node 0, char 14)",
 		}, {
 			"(rgb)(x)[rgb:x];(y)a(x)[y:x];(w)a(v)[w:v]",
-			"Duplicated module `a`.",
+			"Duplicated module `a` (module `a`, char 29)",
+		}, {
+			"(rgb)(x)[rgb:a 10|x];(y)a(x)[y:a 10|x]",
+			"Recursive module call: a -> a",
+		}, {
+			"(rgb)(x)[rgb:a 10|x];(y)a(x)[y:b 10|x];(y)b(x)[y:c 10|x];(y)c(x)[y:a 10|x]",
+			"Recursive module call: a -> b -> c -> a",
 		},
 	}
 	for _, cas := range cases {
@@ -326,6 +356,10 @@ func TestCircuitEval(t *testing.T) {
 			"(rgb)(xy)[r:mult 10 20|g:x|b:y];(f)mult(xy)[f:* 10 20|x|y]",
 			[]float64{0.5, 0.3},
 			[]float64{0.15, 0.5, 0.3},
+		}, {
+			"(rgb)(xy)[r:+ 10 11|g0b1:sd 20 30|x|y];(sd)sd(xy)[s:+ 20 30|d:- 20 30|x|y]",
+			[]float64{0.5, 0.2},
+			[]float64{0.325, 0.35, 0.3},
 		},
 	}
 	for _, cas := range cases {
@@ -348,3 +382,1796 @@ func TestCircuitEval(t *testing.T) {
 		}
 	}
 }
+
+func sameValue(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	if math.IsInf(a, 0) || math.IsInf(b, 0) {
+		return a == b
+	}
+	return math.Abs(a-b) <= 1e-9
+}
+
+func TestCompile(t *testing.T) {
+	circuits := []string{
+		"(rgb)(xy)[r:x|gb:y]",
+		"(rgb)(xy)[b:+ 10 20|r:x|g:y]",
+		"(rgb)(x)[rgb:mod1 10|x];(x)mod1(y)[x:y]",
+		"(rgb)(xy)[r:mult 10 20|g:x|b:y];(f)mult(xy)[f:* 10 20|x|y]",
+		"(rgb)(xy)[rgb:lerp 10 20 30|inv 20|x|band 40|y]",
+		"(rgb)(xyrt)[r:noise 10 20|g:if 30 40 50|b:x3 60|x|y|r|t|= 0.3|tri 20]",
+		"(rgb)(xy)[r:sq 10|g:sq 20|b:= 0.5|x|y];(s)sq(a)[s:mul 10 10|a];(p)mul(ab)[p:* 10 20|a|b]",
+		"(rgb)(xy)[r:+ 10 11|g0b1:sd 20 30|x|y];(sd)sd(xy)[s:+ 20 30|d:- 20 30|x|y]",
+	}
+	for i := 0; i < 50; i++ {
+		circuits = append(circuits, RandomCircuit(3+i%10).String())
+	}
+	for _, s := range circuits {
+		C, err := Read(s)
+		if err != nil {
+			t.Errorf("Cannot read '%s': %s", s, err)
+			continue
+		}
+		P, err := C.Compile()
+		if err != nil {
+			t.Errorf("Cannot compile '%s': %s", s, err)
+			continue
+		}
+		regs := P.Registers()
+		for x := 0.05; x < 1.0; x += .1 {
+			for y := 0.05; y < 1.0; y += .1 {
+				inputs := make([]float64, len(PixelInputs))
+				pixelInputs(x, y, .5, inputs)
+				want := C.Eval(inputs)
+				got := P.Eval(regs, inputs)
+				for k := range want {
+					if !sameValue(got[k], want[k]) {
+						t.Errorf("Output %d of '%s' at (%g, %g) is %g (should be %g)",
+							k, s, x, y, got[k], want[k])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	C, err := Read("(rgb)(x)[rgb:a 10|x];(y)a(x)[y:b 10|x];(y)b(x)[y:inv 10|x]")
+	if err != nil {
+		t.Fatalf("Cannot read circuit: %s", err)
+	}
+	C.Modules["b"].Nodes[0].Op = "a"
+	if _, err := C.Compile(); err == nil {
+		t.Errorf("Compiling a recursive circuit should give an error")
+	}
+	if _, err := C.RenderWith(RenderOptions{Width: 4, Height: 4}); err == nil {
+		t.Errorf("Rendering a recursive circuit should give an error")
+	}
+	if _, err := C.RenderFrames(RenderOptions{Width: 4, Height: 4}, 2); err == nil {
+		t.Errorf("Animating a recursive circuit should give an error")
+	}
+
+	C, err = Read("(rgb)(xy)[r:x|gb:y]")
+	if err != nil {
+		t.Fatalf("Cannot read circuit: %s", err)
+	}
+	for _, opts := range []RenderOptions{{Width: 0, Height: 4}, {Width: 4, Height: -1}} {
+		if _, err := C.RenderWith(opts); err == nil {
+			t.Errorf("Rendering a %dx%d image should give an error", opts.Width, opts.Height)
+		}
+	}
+	for _, n := range []int{0, -1} {
+		if _, err := C.RenderFrames(RenderOptions{Width: 4, Height: 4}, n); err == nil {
+			t.Errorf("Rendering %d frames should give an error", n)
+		}
+	}
+	if _, err := C.RenderFrames(RenderOptions{}, 2); err == nil {
+		t.Errorf("Rendering empty frames should give an error")
+	}
+	C.Modules[""].Outputs = C.Modules[""].Outputs[:2]
+	if _, err := C.Compile(); err == nil {
+		t.Errorf("Compiling a main module with 2 outputs should give an error")
+	}
+	if _, err := C.RenderWith(RenderOptions{Width: 4, Height: 4}); err == nil {
+		t.Errorf("Rendering a main module with 2 outputs should give an error")
+	}
+}
+
+func TestEvaluator(t *testing.T) {
+	circuits := []string{
+		"(rgb)(xyrt)[r:noise 10 20|g:if 30 40 50|b:x3 60|x|y|r|t|= 0.3|tri 20]",
+		"(rgb)(xy)[r:sq 10|g:sq 20|b:= 0.5|x|y];(s)sq(a)[s:mul 10 10|a];(p)mul(ab)[p:* 10 20|a|b]",
+		"(rgb)(xy)[r:+ 10 11|g0b1:sd 20 30|x|y];(sd)sd(xy)[s:+ 20 30|d:- 20 30|x|y]",
+	}
+	for i := 0; i < 20; i++ {
+		circuits = append(circuits, RandomCircuit(3+i%10).String())
+	}
+	for _, s := range circuits {
+		C, err := Read(s)
+		if err != nil {
+			t.Errorf("Cannot read '%s': %s", s, err)
+			continue
+		}
+		str := C.String()
+		var inputs, want [][]float64
+		for x := 0.05; x < 1.0; x += .1 {
+			for y := 0.05; y < 1.0; y += .1 {
+				in := make([]float64, len(PixelInputs))
+				pixelInputs(x, y, .5, in)
+				inputs = append(inputs, in)
+				want = append(want, C.Eval(in))
+			}
+		}
+		// Evaluate the same circuit from several goroutines at once
+		// (run the tests with -race to check it is not modified).
+		var wg sync.WaitGroup
+		errs := make([]int, 8)
+		for g := range errs {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				E := NewEvaluator(&C)
+				for i, in := range inputs {
+					out := E.Eval(in)
+					if g%2 == 1 {
+						out = C.Eval(in)
+					}
+					for k := range want[i] {
+						if !sameValue(out[k], want[i][k]) {
+							errs[g]++
+						}
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		for g, n := range errs {
+			if n > 0 {
+				t.Errorf("Goroutine %d got %d wrong outputs evaluating '%s'", g, n, s)
+			}
+		}
+		if C.String() != str {
+			t.Errorf("Evaluating '%s' changed it to '%s'", str, C.String())
+		}
+	}
+
+	// An Evaluator keeps evaluating the modules it was made with, even
+	// if they are replaced after
+	C, _ := Read("(rgb)(x)[r:f 20|g:= 0.25|b:x];(y)f(x)[y:inv 10|x]")
+	E := NewEvaluator(&C)
+	E.Eval([]float64{.5})
+	C.Modules["f"] = &Module{Name: "f", Nodes: []*Node{{Op: "x"}, {Op: "x"}},
+		Inputs:  []Port{{Name: 'x', Idx: 0}},
+		Outputs: []Port{{Name: 'y', Idx: 0}, {Name: 'z', Idx: 1}}}
+	if out := E.Eval([]float64{.2}); out[0] != .8 {
+		t.Errorf("An Evaluator of '%s' evaluates the replaced module (gives %v)", C, out)
+	}
+}
+
+func TestRenderParallel(t *testing.T) {
+	C, err := Read("(rgb)(xyrt)[r:noise 10 20|g:if 30 40 50|b:x3 60|x|y|r|t|= 0.3|tri 20]")
+	if err != nil {
+		t.Fatalf("Cannot read circuit: %s", err)
+	}
+	var images []image.Image
+	for _, workers := range []int{1, 3, 8} {
+		img, err := C.RenderParallel(37, 3, workers)
+		if err != nil {
+			t.Fatalf("Cannot render '%s': %s", C, err)
+		}
+		images = append(images, img)
+	}
+	b := images[0].Bounds()
+	for k := 1; k < len(images); k++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				if images[k].At(x, y) != images[0].At(x, y) {
+					t.Fatalf("Pixel (%d, %d) differs depending on the number of workers", x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestRenderPixel(t *testing.T) {
+	C, err := Read("(rgb)(xyrt)[r:noise 10 20|g:if 30 40 50|b:x3 60|x|y|r|t|= 0.3|tri 20];@5")
+	if err != nil {
+		t.Fatalf("Cannot read circuit: %s", err)
+	}
+	P, err := C.Compile()
+	if err != nil {
+		t.Fatalf("Cannot compile '%s': %s", C, err)
+	}
+	w := P.newWorker(0)
+	E := NewEvaluator(&C)
+	for seed := int64(0); seed < 5; seed++ {
+		w.rnd.Seed(seed)
+		want := w.pixel(.2, .3, .25, .35, 4)
+		a := C.RenderPixel(rand.New(rand.NewSource(seed)), .2, .3, .25, .35, 4)
+		b := E.RenderPixel(rand.New(rand.NewSource(seed)), .2, .3, .25, .35, 4)
+		if a != b {
+			t.Errorf("RenderPixel with seed %d gives %v and %v", seed, a, b)
+		}
+		if !sameValue(a.R, want.R) || !sameValue(a.G, want.G) || !sameValue(a.B, want.B) {
+			t.Errorf("RenderPixel with seed %d gives %v (the program gives %v)", seed, a, want)
+		}
+	}
+
+	// Without a main module the pixel is black
+	delete(C.Modules, "")
+	if c := C.RenderPixel(rand.New(rand.NewSource(1)), .2, .3, .25, .35, 4); c != (Color{}) {
+		t.Errorf("RenderPixel without a main module gives %v", c)
+	}
+}
+
+func TestRenderOptionsView(t *testing.T) {
+	cases := []struct {
+		opts                     RenderOptions
+		xlow, ylow, xhigh, yhigh float64 // domain covered by the image
+	}{
+		{RenderOptions{Width: 10, Height: 10}, 0, 0, 1, 1},
+		{RenderOptions{Width: 20, Height: 10}, -.5, 0, 1.5, 1},
+		{RenderOptions{Width: 10, Height: 20}, 0, -.5, 1, 1.5},
+		{RenderOptions{Width: 20, Height: 10, Aspect: AspectFill}, 0, .25, 1, .75},
+		{RenderOptions{Width: 20, Height: 10, Aspect: AspectStretch}, 0, 0, 1, 1},
+		{RenderOptions{Width: 10, Height: 10, Zoom: 2}, .25, .25, .75, .75},
+		{RenderOptions{Width: 10, Height: 10, Zoom: 4, PanX: .25, PanY: -.25}, .625, .125, .875, .375},
+	}
+	for _, cas := range cases {
+		v := cas.opts.view()
+		xlow, ylow, _, _ := v.pixel(0, 0)
+		_, _, xhigh, yhigh := v.pixel(cas.opts.Width-1, cas.opts.Height-1)
+		got := []float64{xlow, ylow, xhigh, yhigh}
+		want := []float64{cas.xlow, cas.ylow, cas.xhigh, cas.yhigh}
+		for i := range got {
+			if !sameValue(got[i], want[i]) {
+				t.Errorf("Options %+v cover %v (should be %v)", cas.opts, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestRenderBounds(t *testing.T) {
+	C, err := Read("(rgb)(xy)[r:x|gb:y]")
+	if err != nil {
+		t.Fatalf("Cannot read circuit: %s", err)
+	}
+	img := render(t, C, RenderOptions{Width: 30, Height: 17, Aspect: AspectStretch})
+	if b := img.Bounds(); b.Dx() != 30 || b.Dy() != 17 {
+		t.Fatalf("Image should be 30x17 (is %dx%d)", b.Dx(), b.Dy())
+	}
+	// red grows along x, green along y
+	r0, _, _, _ := img.At(0, 8).RGBA()
+	r1, _, _, _ := img.At(29, 8).RGBA()
+	_, g0, _, _ := img.At(15, 0).RGBA()
+	_, g1, _, _ := img.At(15, 16).RGBA()
+	if r0 >= r1 || g0 >= g1 {
+		t.Errorf("Image is not oriented correctly")
+	}
+}
+
+// render renders C, failing the test if it cannot be compiled.
+func render(t *testing.T, C Circuit, opts RenderOptions) image.Image {
+	img, err := C.RenderWith(opts)
+	if err != nil {
+		t.Fatalf("Cannot render '%s': %s", C, err)
+	}
+	return img
+}
+
+func sameImage(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	r := a.Bounds()
+	for x := r.Min.X; x < r.Max.X; x++ {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			if a.At(x, y) != b.At(x, y) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestSeed(t *testing.T) {
+	s := "(rgb)(xy)[rgb:noise 10 20|x|y];@42"
+	C, err := Read(s)
+	if err != nil {
+		t.Fatalf("Cannot read '%s': %s", s, err)
+	}
+	if C.Seed != 42 {
+		t.Errorf("Seed of '%s' should be 42 (is %d)", s, C.Seed)
+	}
+	if C.String() != s {
+		t.Errorf("'%s' prints as '%s'", s, C.String())
+	}
+	for _, bad := range []string{
+		"(rgb)(xy)[rgb:x|y];@x",
+		"(rgb)(xy)[rgb:x|y];@1;@2",
+	} {
+		if _, err := Read(bad); err == nil {
+			t.Errorf("Read should give an error for '%s'", bad)
+		}
+	}
+
+	opts := RenderOptions{Width: 20, Height: 20, Samples: 2, Seed: 7}
+	a, b := render(t, C, opts), render(t, C, opts)
+	if !sameImage(a, b) {
+		t.Errorf("Same seeds should render the same image")
+	}
+	opts.Seed = 8
+	if sameImage(a, render(t, C, opts)) {
+		t.Errorf("Different jitter seeds should render different images")
+	}
+	opts.Seed = 7
+	D := C.Clone()
+	D.Seed = 43
+	if sameImage(a, render(t, D, opts)) {
+		t.Errorf("Different noise seeds should render different images")
+	}
+}
+
+func TestCrossover(t *testing.T) {
+	A, _ := Read("(rgb)(xy)[rgb:inv 10|x]")
+	B, _ := Read("(rgb)(xy)[rgb:sin 10|y]")
+	if child := A.Crossover(&B); child.String() != "(rgb)(xy)[rgb:sin 10|y]" {
+		t.Errorf("Crossover of '%s' and '%s' gives '%s'", A, B, child)
+	}
+
+	A, _ = Read("(rgb)(xy)[rgb:inv 10|x]")
+	B, _ = Read("(rgb)(xy)[rgb:sq 10|y];(s)sq(a)[s:* 10 10|a]")
+	child := A.Crossover(&B)
+	if _, ok := child.Modules["sq"]; !ok {
+		t.Errorf("Crossover of '%s' and '%s' should import module 'sq'", A, B)
+	}
+
+	// Modules that clash are renamed, and the ones not called anymore
+	// are removed
+	A, _ = Read("(rgb)(xy)[rgb:b 10|x];(y)b(x)[y:sin 10|x]")
+	B, _ = Read("(rgb)(xy)[rgb:+ 10 20|c 30|a 30|x];(y)a(x)[y:b 10|x];(y)b(x)[y:cos 10|x];(y)c(x)[y:inv 10|x]")
+	child = A.Clone()
+	if !child.transplant(0, &B, 0) {
+		t.Fatalf("Transplanting from '%s' to '%s' should work", B, A)
+	}
+	if _, ok := child.Modules["b"]; ok || len(child.Modules) != 4 || !sameOutputs(t, child, B) {
+		t.Errorf("Transplanting from '%s' to '%s' gives '%s'", B, A, child)
+	}
+	if _, err := Read(child.String()); err != nil {
+		t.Errorf("Transplanting from '%s' to '%s' gives '%s': %s", B, A, child, err)
+	}
+
+	// Modules imported before a failure are not left in the child
+	B.Modules["b"].Nodes[0].Op = "d"
+	child = A.Clone()
+	if child.transplant(0, &B, 0) {
+		t.Errorf("Transplanting from '%s' (without module d) to '%s' should fail", B, A)
+	}
+	if child.String() != A.String() {
+		t.Errorf("Failed transplant from '%s' changes '%s' to '%s'", B, A, child)
+	}
+
+	// Crossovers with the same seed are the same
+	m1, m2 := NewMutator(7), NewMutator(7)
+	for i := 0; i < 50; i++ {
+		A, B := RandomCircuit(3+i%7), RandomCircuit(3+i%5)
+		if a, b := m1.Crossover(A, B), m2.Crossover(A, B); a.String() != b.String() {
+			t.Errorf("Crossovers of '%s' and '%s' with the same seed differ: '%s' and '%s'", A, B, a, b)
+		}
+	}
+
+	for i := 0; i < 200; i++ {
+		A, B := RandomCircuit(3+i%7), RandomCircuit(3+i%5)
+		child := A.Crossover(B)
+		s := child.String()
+		C, err := Read(s)
+		if err != nil {
+			t.Errorf("Crossover of '%s' and '%s' gives '%s': %s", A, B, s, err)
+			continue
+		}
+		if C.String() != s {
+			t.Errorf("Crossover of '%s' and '%s' is not sorted: '%s'", A, B, s)
+		}
+		if _, err := C.Compile(); err != nil {
+			t.Errorf("Crossover of '%s' and '%s' gives '%s': %s", A, B, s, err)
+		}
+	}
+}
+
+func TestTimeInput(t *testing.T) {
+	if _, err := Read("(rgb)(xq)[rgb:x|q]"); err == nil {
+		t.Errorf("Read should reject unknown inputs in the main module")
+	}
+	C, err := Read("(rgb)(Tx)[r:sin 10|g:T|b:x]")
+	if err != nil {
+		t.Fatalf("Cannot read circuit: %s", err)
+	}
+	frames, err := C.RenderFrames(RenderOptions{Width: 4, Height: 4}, 4)
+	if err != nil {
+		t.Fatalf("Cannot render '%s': %s", C, err)
+	}
+	if len(frames) != 4 {
+		t.Fatalf("There should be 4 frames (there are %d)", len(frames))
+	}
+	for i := range frames {
+		_, g, b, _ := frames[i].At(1, 1).RGBA()
+		if want := uint32(255*i/4) * 0x101; g != want {
+			t.Errorf("Frame %d should have T = %d (has %d)", i, want, g)
+		}
+		if _, _, b0, _ := frames[0].At(1, 1).RGBA(); b != b0 {
+			t.Errorf("Input x should not depend on time")
+		}
+	}
+	anim := GIF(frames, 5)
+	if len(anim.Image) != 4 || len(anim.Delay) != 4 {
+		t.Errorf("GIF should have 4 frames")
+	}
+}
+
+func TestModuleOrder(t *testing.T) {
+	C, err := Read("(rgb)(x)[r:a 10|g:b 20|b:x];(y)b(x)[y:a 10|x];(y)a(x)[y:c 10|x];(y)c(x)[y:inv 10|x];(y)d(x)[y:x]")
+	if err != nil {
+		t.Fatalf("Cannot read circuit: %s", err)
+	}
+	graph := C.CallGraph()
+	if s := strings.Join(graph[""], ","); s != "a,b" {
+		t.Errorf("Main module calls '%s' (should be 'a,b')", s)
+	}
+	if len(graph["c"]) != 0 {
+		t.Errorf("Module c calls %v (should be nothing)", graph["c"])
+	}
+	order, err := C.ModuleOrder()
+	if err != nil {
+		t.Fatalf("ModuleOrder gives an error: %s", err)
+	}
+	if s := strings.Join(order, ","); s != "c,a,b,d," {
+		t.Errorf("Module order is '%s' (should be 'c,a,b,d,')", s)
+	}
+}
+
+// sameOutputs tells whether A and B compute the same image.
+func sameOutputs(t *testing.T, A, B Circuit) bool {
+	PA, errA := A.Compile()
+	PB, errB := B.Compile()
+	if errA != nil || errB != nil {
+		t.Errorf("Cannot compile '%s' or '%s'", A, B)
+		return false
+	}
+	ra, rb := PA.Registers(), PB.Registers()
+	for x := 0.05; x < 1.0; x += .1 {
+		for y := 0.05; y < 1.0; y += .1 {
+			vals := make([]float64, len(PixelInputs))
+			pixelInputs(x, y, .5, vals)
+			ia := make([]float64, len(A.Modules[""].Inputs))
+			ib := make([]float64, len(B.Modules[""].Inputs))
+			bindInputs(A.Modules[""].Inputs, vals, ia)
+			bindInputs(B.Modules[""].Inputs, vals, ib)
+			a, b := PA.Eval(ra, ia), PB.Eval(rb, ib)
+			for k := range a {
+				if !sameValue(a[k], b[k]) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func TestModuleMutations(t *testing.T) {
+	C, _ := Read("(rgb)(xy)[r:+ 10 20|g:sin 20|b:y|x]")
+	D := C.Clone()
+	if !D.MutExtractModule() || len(D.Modules) != 2 {
+		t.Fatalf("Extracting a module from '%s' gives '%s'", C, D)
+	}
+	if !sameOutputs(t, C, D) {
+		t.Errorf("Extracting a module from '%s' changes the image ('%s')", C, D)
+	}
+	C, _ = Read("(rgb)(xy)[r:+ 10 11|g0b1:sd 20 30|x|y];(sd)sd(xy)[s:+ 20 30|d:- 20 30|x|y]")
+	D = C.Clone()
+	if !D.MutInlineCall() || D.String() != "(rgb)(xy)[r:+ 10 20|g:+ 30 40|b:- 30 40|x|y]" {
+		t.Errorf("Inlining the call in '%s' gives '%s'", C, D)
+	}
+	C, _ = Read("(rgb)(xy)[r:a 10|g:b 20|b:x|y];(o)a(i)[o:inv 10|i];(o)b(i)[o:sin 10|i]")
+	D = C.Clone()
+	if !D.MutRewireCall() || len(D.Modules) != 2 {
+		t.Errorf("Rewiring a call in '%s' gives '%s'", C, D)
+	}
+
+	mutations := map[string]func(C *Circuit) bool{
+		"extract":   (*Circuit).MutExtractModule,
+		"inline":    (*Circuit).MutInlineCall,
+		"duplicate": (*Circuit).MutDuplicateModule,
+		"rewire":    (*Circuit).MutRewireCall,
+	}
+	for i := 0; i < 100; i++ {
+		C := RandomCircuit(3 + i%10)
+		for j := 0; j < 10; j++ {
+			for name, mut := range mutations {
+				before := C.Clone()
+				applied := mut(C)
+				s := C.String()
+				D, err := Read(s)
+				if err != nil {
+					t.Fatalf("Mutation '%s' of '%s' gives '%s': %s", name, before, s, err)
+				}
+				if D.String() != s {
+					t.Errorf("Mutation '%s' of '%s' is not sorted: '%s'", name, before, s)
+				}
+				if (name == "extract" || name == "inline") && applied && !sameOutputs(t, before, D) {
+					t.Errorf("Mutation '%s' of '%s' changes the image ('%s')", name, before, s)
+				}
+			}
+		}
+	}
+}
+
+// registerTest registers an operator until the end of the test.
+func registerTest(t *testing.T, name string, op Operator) {
+	if err := RegisterOperator(name, op); err != nil {
+		t.Fatalf("Cannot register operator: %s", err)
+	}
+	t.Cleanup(func() { unregister(name) })
+}
+
+func TestRegisterOperator(t *testing.T) {
+	sq := OperatorFunc{OpInfo{Nargs: 1}, func(args []float64, _ *perlin.PerlinNoise) float64 {
+		return args[0] * args[0]
+	}}
+	registerTest(t, "sq.test", sq)
+	errors := []struct {
+		name string
+		op   Operator
+	}{
+		{"sq.test", sq},
+		{"+", sq},
+		{"", sq},
+		{"q", sq},
+		{"a b", sq},
+		{"a|b", sq},
+		{"f(x)", sq},
+		{"zero", OperatorFunc{OpInfo{Nargs: 0}, sq.F}},
+	}
+	for _, e := range errors {
+		if err := RegisterOperator(e.name, e.op); err == nil {
+			t.Errorf("Registering operator '%s' should give an error", e.name)
+		}
+	}
+	if OperatorInfo["sq.test"].Nargs != 1 || Operators[len(Operators)-1] != "sq.test" {
+		t.Errorf("Operator 'sq.test' is not in OperatorInfo")
+	}
+	found := false
+	for _, op := range NumArguments[1] {
+		found = found || op == "sq.test"
+	}
+	if !found {
+		t.Errorf("Operator 'sq.test' is not in NumArguments")
+	}
+
+	C, err := Read("(rgb)(xy)[r:sq.test 30|g:inv 40|b:sq.test 40|x|y]")
+	if err != nil {
+		t.Fatalf("Cannot read circuit: %s", err)
+	}
+	P, err := C.Compile()
+	if err != nil {
+		t.Fatalf("Cannot compile '%s': %s", C, err)
+	}
+	inputs := []float64{.5, .25}
+	want := []float64{.25, .75, .0625}
+	interpreted, compiled := C.Eval(inputs), P.Eval(P.Registers(), inputs)
+	for k := range want {
+		if !sameValue(interpreted[k], want[k]) || !sameValue(compiled[k], want[k]) {
+			t.Errorf("Output %d of '%s' is %g (compiled %g, should be %g)",
+				k, C, interpreted[k], compiled[k], want[k])
+		}
+	}
+	if _, err := Read("(rgb)(xy)[rgb:sq.test 10 20|x|y]"); err == nil {
+		t.Errorf("Read should check the number of args of registered operators")
+	}
+}
+
+func TestLibraryOperators(t *testing.T) {
+	noise := noiseFor(0)
+	tests := []struct {
+		op   string
+		args []float64
+		want float64
+	}{
+		{"abs", []float64{-.25}, .25},
+		{"exp", []float64{0}, 0},
+		{"exp", []float64{1}, 1},
+		{"log", []float64{1}, 1},
+		{"log", []float64{(math.Exp(.5) - 1) / (math.E - 1)}, .5},
+		{"fract", []float64{1.25}, .25},
+		{"fract", []float64{-.25}, .75},
+		{"gaussian", []float64{.5}, 1},
+		{"gaussian", []float64{.75}, math.Exp(-1)},
+		{"pow", []float64{.25, .5}, .25},
+		{"pow", []float64{.25, .75}, .0625},
+		{"atan2", []float64{1, .5}, .5},
+		{"atan2", []float64{.5, 1}, .75},
+		{"mod", []float64{.7, .25}, .2},
+		{"mod", []float64{-.1, .25}, .15},
+		{"mod", []float64{.7, 0}, 0},
+		{"scale", []float64{1, .75}, 1.5},
+		{"scale", []float64{.75, .25}, .625},
+		{"smoothstep", []float64{0, 1, .5}, .5},
+		{"smoothstep", []float64{0, 1, .25}, .15625},
+		{"smoothstep", []float64{.2, .4, .5}, 1},
+		{"smoothstep", []float64{.5, .5, .4}, 0},
+		{"clamp", []float64{1.5, 0, 1}, 1},
+		{"clamp", []float64{.3, .4, .6}, .4},
+		{"rotx", []float64{1, .5, .25}, .5},
+		{"roty", []float64{1, .5, .25}, 1},
+		{"rotx", []float64{1, .5, .5}, 0},
+		{"hsvr", []float64{0, 1, 1}, 1},
+		{"hsvg", []float64{0, 1, 1}, 0},
+		{"hsvg", []float64{1.0 / 3, 1, 1}, 1},
+		{"hsvb", []float64{2.0 / 3, 1, .5}, .5},
+		{"hsvr", []float64{.3, 0, .7}, .7},
+		{"dist", []float64{0, 0, .3, .4}, .5},
+		{"fbm", []float64{0, 0}, .5},
+		{"worley", []float64{noise.Hash(0, 0, 0) / 10, noise.Hash(0, 0, 1) / 10}, 0},
+	}
+	for _, test := range tests {
+		op, ok := LookupOperator(test.op)
+		if !ok {
+			t.Errorf("Operator '%s' is missing", test.op)
+			continue
+		}
+		if n := op.Info().Nargs; n != len(test.args) {
+			t.Errorf("Operator '%s' has %d args (should be %d)", test.op, n, len(test.args))
+			continue
+		}
+		if got := op.Eval(test.args, noise); !sameValue(got, test.want) {
+			t.Errorf("%s%v = %g (should be %g)", test.op, test.args, got, test.want)
+		}
+	}
+
+	// Noises are in [0, 1]
+	for x := 0.0; x < 1; x += .013 {
+		for y := 0.0; y < 1; y += .017 {
+			for _, name := range []string{"worley", "voronoi", "fbm"} {
+				op, _ := LookupOperator(name)
+				if v := op.Eval([]float64{x, y}, noise); v < 0 || v > 1 {
+					t.Errorf("%s(%g, %g) = %g (out of [0, 1])", name, x, y, v)
+				}
+			}
+		}
+	}
+
+	// They can be read, compiled and evaluated like the built-in ones
+	C, err := Read("(rgb)(xyt)[r:hsvr 30 40 50|g:hsvg 30 40 50|b:dist 40 50 60 60|worley 50 40|fbm 60 50|voronoi 60 60|x|y]")
+	if err != nil {
+		t.Fatalf("Cannot read circuit: %s", err)
+	}
+	P, err := C.Compile()
+	if err != nil {
+		t.Fatalf("Cannot compile '%s': %s", C, err)
+	}
+	regs := P.Registers()
+	for x := 0.05; x < 1.0; x += .1 {
+		inputs := []float64{x, 1 - x, .5}
+		want, got := C.Eval(inputs), P.Eval(regs, inputs)
+		for k := range want {
+			if !sameValue(got[k], want[k]) {
+				t.Errorf("Output %d of '%s' at %g is %g (should be %g)", k, C, x, got[k], want[k])
+			}
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+	W, err := ReadWeights(strings.NewReader(`{"ops": {"=": 0, "noise": 4}, "arity": {"3": 0.1}}`))
+	if err != nil {
+		t.Fatalf("Cannot read weights: %s", err)
+	}
+	probs := W.Probabilities()
+	total, three := 0.0, 0.0
+	for op, p := range probs {
+		total += p
+		if OperatorInfo[op].Nargs == 3 {
+			three += p
+		}
+	}
+	if !sameValue(total, 1) || !sameValue(three, .1) {
+		t.Errorf("Probabilities add up to %g (3 args: %g)", total, three)
+	}
+	if probs["="] != 0 || !sameValue(probs["noise"], 4*probs["+"]) {
+		t.Errorf("Wrong probabilities for '=' (%g) or 'noise' (%g)", probs["="], probs["noise"])
+	}
+
+	defer func(W Weights) { OperatorWeights = W }(OperatorWeights)
+	OperatorWeights = W
+	for i := 0; i < 200; i++ {
+		if op, _ := RandomOperator(); op == "=" {
+			t.Fatalf("RandomOperator chooses operators with zero weight")
+		}
+	}
+	OperatorWeights = Weights{Ops: map[string]float64{}}
+	for _, op := range NumArguments[1] {
+		OperatorWeights.Ops[op] = 0
+	}
+	OperatorWeights.Ops["sin"] = 1
+	for i := 0; i < 20; i++ {
+		C, _ := Read("(rgb)(x)[rgb:cos 10|x]")
+		C.Modules[""].MutOperatorChange()
+		if s := C.String(); s != "(rgb)(x)[rgb:sin 10|x]" {
+			t.Fatalf("MutOperatorChange ignores the weights: '%s'", s)
+		}
+	}
+	// Changes to weights already used are noticed
+	OperatorWeights.Ops["sin"], OperatorWeights.Ops["tri"] = 0, 1
+	for i := 0; i < 20; i++ {
+		C, _ := Read("(rgb)(x)[rgb:cos 10|x]")
+		C.Modules[""].MutOperatorChange()
+		if s := C.String(); s != "(rgb)(x)[rgb:tri 10|x]" {
+			t.Fatalf("MutOperatorChange ignores changed weights: '%s'", s)
+		}
+	}
+
+	// Mutators with different weights don't interfere, and notice the
+	// operators registered after they were used
+	msin, mtri := NewMutator(1), NewMutator(2)
+	msin.Weights = Weights{Ops: map[string]float64{}}
+	for _, op := range NumArguments[1] {
+		msin.Weights.Ops[op] = 0
+	}
+	msin.Weights.Ops["sin"] = 1
+	mtri.Weights = Weights{Ops: map[string]float64{"sin": 0, "tri": 1000}}
+	for i := 0; i < 20; i++ {
+		C, _ := Read("(rgb)(x)[rgb:cos 10|x]")
+		D := C.Clone()
+		C.Modules[""].mutOperatorChange(msin)
+		D.Modules[""].mutOperatorChange(mtri)
+		if C.String() != "(rgb)(x)[rgb:sin 10|x]" || D.String() == "(rgb)(x)[rgb:sin 10|x]" {
+			t.Fatalf("Mutators with different weights interfere: '%s' and '%s'", C, D)
+		}
+	}
+	registerTest(t, "sq.test", Unary{OpInfo{}, func(a float64) float64 { return a * a }})
+	found := false
+	for i := 0; i < 50 && !found; i++ {
+		C, _ := Read("(rgb)(x)[rgb:cos 10|x]")
+		C.Modules[""].mutOperatorChange(msin)
+		found = C.String() == "(rgb)(x)[rgb:sq.test 10|x]"
+	}
+	if !found {
+		t.Errorf("A Mutator ignores the operators registered after it was used")
+	}
+
+	errors := []string{
+		`{"ops": {"nonexistent": 1}}`,
+		`{"ops": {"+": -1}}`,
+		`{"arity": {"1": 2}}`,
+		`{"weights": {}}`,
+		`{"ops": `,
+	}
+	for _, s := range errors {
+		if _, err := ReadWeights(strings.NewReader(s)); err == nil {
+			t.Errorf("Reading weights '%s' should give an error", s)
+		}
+	}
+}
+
+func TestMutator(t *testing.T) {
+	// Nothing can be mutated here, but nothing should panic either
+	C, _ := Read("(rgb)(x)[rgb:x]")
+	if C.Modules[""].MutRemoveNode() || C.Modules[""].MutInsertNode() ||
+		C.Modules[""].MutOperatorChange() || C.Modules[""].MutConnectionSwap() {
+		t.Errorf("Mutations of '%s' should not be possible", C)
+	}
+	if applied := NewMutator(1).Mutate(&C); len(applied) != 0 || C.String() != "(rgb)(x)[rgb:x]" {
+		t.Errorf("Mutating '(rgb)(x)[rgb:x]' gives '%s' (%v)", C, applied)
+	}
+
+	// The same seed gives the same mutations
+	A := RandomCircuit(8)
+	B := A.Clone()
+	ma, mb := NewMutator(42), NewMutator(42)
+	for i := 0; i < 50; i++ {
+		ra, rb := ma.Mutate(A), mb.Mutate(&B)
+		if A.String() != B.String() || fmt.Sprint(ra) != fmt.Sprint(rb) {
+			t.Fatalf("Mutators with the same seed differ: '%s' %v and '%s' %v", A, ra, B, rb)
+		}
+	}
+
+	// Mutations keep the metadata
+	C, _ = Read("(rgb)(xy)[r:+ 10 20|g:sin 20|b:y|x]")
+	C.Meta = Metadata{Name: "sunset", Parents: []string{"p"}}
+	if applied := NewMutator(1).Mutate(&C); len(applied) != 1 ||
+		C.Meta.Name != "sunset" || len(C.Meta.Parents) != 1 || C.Meta.Parents[0] != "p" {
+		t.Errorf("Mutating '%s' (%v) loses its metadata (%+v)", C, applied, C.Meta)
+	}
+
+	// Only the kinds with a rate are applied
+	m := NewMutator(7)
+	m.Rates = map[string]float64{"insert": 1}
+	m.Count, m.MaxCount = 2, 4
+	C = RandomCircuit(5).Clone()
+	for i := 0; i < 20; i++ {
+		applied := m.Mutate(&C)
+		if len(applied) < 2 || len(applied) > 4 {
+			t.Errorf("Mutator applied %d mutations (should be between 2 and 4)", len(applied))
+		}
+		for _, mut := range applied {
+			if mut.Kind != "insert" {
+				t.Errorf("Mutator applied '%s' (only 'insert' has a rate)", mut)
+			}
+		}
+	}
+
+	// Results are always valid and within the limits
+	m = NewMutator(3)
+	m.Count, m.MaxNodes, m.MaxModules = 3, 12, 3
+	for i := 0; i < 100; i++ {
+		C := RandomCircuit(3 + i%6) // at most 12 nodes with the inputs
+		for j := 0; j < 20; j++ {
+			before := C.String()
+			m.Mutate(C)
+			s := C.String()
+			D, err := Read(s)
+			if err != nil {
+				t.Fatalf("Mutation of '%s' gives '%s': %s", before, s, err)
+			}
+			if _, err := D.Compile(); err != nil {
+				t.Fatalf("Mutation of '%s' gives '%s': %s", before, s, err)
+			}
+			if len(C.Modules) > 3 {
+				t.Errorf("Mutation of '%s' gives more than 3 modules: '%s'", before, s)
+			}
+			for _, mod := range C.Modules {
+				if len(mod.Nodes) > 12 {
+					t.Errorf("Mutation of '%s' gives more than 12 nodes: '%s'", before, s)
+				}
+			}
+		}
+	}
+}
+
+func TestDegenerateMutations(t *testing.T) {
+	// Every kind of mutation must give up (not panic) when there is
+	// nothing to choose from
+	circuits := []string{
+		"(rgb)()[rgb:= 0.5]",                        // a single node
+		"(rgb)(x)[rgb:= 0.5]",                       // unused input
+		"(rgb)(x)[rgb:x]",                           // inputs only
+		"(rgb)(xy)[r:x|gb:y]",                       // inputs only
+		"(rgb)(x)[rgb:inv 10|x]",                    // no free nodes
+		"(rgb)(x)[r:= 0.1|g:= 0.2|b:x]",             // constants only
+		"(rgb)(x)[rgb:f 10|x];(y)f(x)[y:x]",         // call of inputs only
+		"(rgb)(x)[rgb:f 10|x];(y)f(x)[y:= 1]",       // call of a constant
+		"(rgb)()[rgb:f 10|= 1];(y)f(x)[y:inv 10|x]", // call of a constant
+	}
+	for _, s := range circuits {
+		C, err := Read(s)
+		if err != nil {
+			t.Fatalf("Cannot read '%s': %s", s, err)
+		}
+		for _, kind := range MutationKinds {
+			for seed := int64(0); seed < 20; seed++ {
+				D := C.Clone()
+				if _, ok := NewMutator(seed).apply(kind, &D); !ok {
+					continue
+				}
+				if _, err := Read(D.String()); err != nil {
+					t.Errorf("Mutation '%s' of '%s' gives '%s': %s", kind, s, D, err)
+				}
+			}
+		}
+		m := NewMutator(1)
+		m.Count = 20
+		m.Mutate(&C)
+		if _, err := Read(C.String()); err != nil {
+			t.Errorf("Mutating '%s' gives '%s': %s", s, C, err)
+		}
+	}
+}
+
+func TestConstantMutations(t *testing.T) {
+	value := func(C Circuit) float64 {
+		for _, node := range C.Modules[""].Nodes {
+			if node.Op == "=" {
+				return node.Value
+			}
+		}
+		return math.NaN()
+	}
+	C, _ := Read("(rgb)(x)[r:+ 10 20|g:x|b:= 0.5]")
+	for i := 0; i < 50; i++ {
+		D := C.Clone()
+		if !D.Modules[""].MutCreepConstant(.01) {
+			t.Fatalf("Cannot creep a constant of '%s'", C)
+		}
+		if v := value(D); v == .5 || math.Abs(v-.5) > .01 {
+			t.Errorf("Creep of 0.5 with step 0.01 gives %g", v)
+		}
+		D = C.Clone()
+		if !D.Modules[""].MutPerturbConstant(1e-6) {
+			t.Fatalf("Cannot perturb a constant of '%s'", C)
+		}
+		if v := value(D); math.Abs(v-.5) > 1e-4 {
+			t.Errorf("Perturbation of 0.5 with sigma 1e-6 gives %g", v)
+		}
+	}
+
+	NoConst, _ := Read("(rgb)(x)[r:inv 10|gb:x]")
+	if NoConst.Modules[""].MutPerturbConstant(.1) || NoConst.Modules[""].MutCreepConstant(.1) {
+		t.Errorf("There are no constants to change in '%s'", NoConst)
+	}
+	D := NoConst.Clone()
+	if !D.Modules[""].MutNodeToConstant() || D.String() != fmt.Sprintf("(rgb)(x)[r:= %g|gb:x]", value(D)) {
+		t.Errorf("Replacing a node of '%s' with a constant gives '%s'", NoConst, D)
+	}
+	D = NoConst.Clone()
+	if !D.Modules[""].MutInsertConstant() || D.String() != fmt.Sprintf("(rgb)(x)[r:inv 20|gb:x|= %g]", value(D)) {
+		t.Errorf("Inserting a constant in '%s' gives '%s'", NoConst, D)
+	}
+
+	m := NewMutator(1)
+	m.Rates = map[string]float64{"perturb": 1, "creep": 1, "addconst": 1, "toconst": 1}
+	for i := 0; i < 100; i++ {
+		C := RandomCircuit(3 + i%8)
+		for j := 0; j < 10; j++ {
+			m.Mutate(C)
+			if _, err := Read(C.String()); err != nil {
+				t.Fatalf("Constant mutations give '%s': %s", C, err)
+			}
+		}
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	tests := []struct{ circuit, simplified string }{
+		{ // constant folding
+			"(rgb)(xy)[r:inv 30|g:* 20 30|b:x|= 0.25]",
+			"(rgb)(xy)[g:* 20 30|r:= 0.75|b:x|= 0.25]",
+		},
+		{ // identities
+			"(rgb)(xy)[r:min 40 40|g:* 40 50|b:if 50 40 30|y|x|= 1]",
+			"(rgb)(xy)[rgb:x]",
+		},
+		{ // and, or, bw
+			"(rgb)(xy)[r:and 40 40|g:or 40 50|b:bw 30|bw 40|x|= 0]",
+			"(rgb)(xy)[rgb:bw 10|x]",
+		},
+		{ // common subexpressions (+ is commutative)
+			"(rgb)(xy)[r:sin 30|g:sin 40|b:+ 50 60|+ 60 50|+ 60 50|x|y]",
+			"(rgb)(xy)[rg:sin 10|b:+ 30 20|x|y]",
+		},
+		{ // calls with constant arguments
+			"(rgb)(xy)[r:x|g0b1:sd 20 30|= 0.5|= 0.25];(sd)sd(xy)[s:+ 20 30|d:- 20 30|x|y]",
+			"(rgb)(xy)[r:x|g:= 0.375|b:= 0.25]",
+		},
+		{ // no exact simplification
+			"(rgb)(xy)[r:+ 30 30|g:* 40 30|b:/ 30 30|x|= 0]",
+			"(rgb)(xy)[r:+ 30 30|g:* 40 30|b:/ 30 30|x|= 0]",
+		},
+	}
+	for _, test := range tests {
+		C, err := Read(test.circuit)
+		if err != nil {
+			t.Fatalf("Cannot read '%s': %s", test.circuit, err)
+		}
+		D := C.Clone()
+		D.Simplify()
+		if D.String() != test.simplified {
+			t.Errorf("Simplifying '%s' gives '%s' (should be '%s')", C, D, test.simplified)
+		}
+		if !sameOutputs(t, C, D) {
+			t.Errorf("Simplifying '%s' changes the image ('%s')", C, D)
+		}
+	}
+
+	m := NewMutator(1)
+	m.Count, m.MaxCount = 5, 15
+	for i := 0; i < 200; i++ {
+		C := RandomCircuit(3 + i%10)
+		m.Mutate(C)
+		D := C.Clone()
+		D.Simplify()
+		if _, err := Read(D.String()); err != nil {
+			t.Fatalf("Simplifying '%s' gives '%s': %s", C, D, err)
+		}
+		if !sameOutputs(t, *C, D) {
+			t.Errorf("Simplifying '%s' changes the image ('%s')", C, D)
+		}
+		for name, mod := range D.Modules {
+			if len(mod.Nodes) > len(C.Modules[name].Nodes) {
+				t.Errorf("Simplifying '%s' adds nodes to module '%s' ('%s')", C, name, D)
+			}
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	equal := [][]string{
+		{
+			"(rgb)(xy)[r:+ 20 30|g:sin 20|b:y|x]",
+			"(rgb)(xy)[r:+ 30 20|g:sin 20|b:y|x]",
+			"(rgb)(xy)[g:sin 20|r:+ 30 20|b:y|x]",
+		},
+		{
+			"(rgb)(xy)[r:x|g0b1:sd 0 20|y];(sd)sd(xy)[s:+ 20 30|d:- 20 30|x|y]",
+			"(rgb)(xy)[g0b1:f 10 20|r:x|y];(sd)f(xy)[d:- 20 30|s:+ 30 20|x|y]",
+		},
+		{
+			"(rgb)(xy)[rgb:* 10 20|= 0.5|x];@3",
+			"(rgb)(xy)[rgb:* 10 20|x|= 0.5|noise 10 10];@3",
+		},
+	}
+	for _, group := range equal {
+		C, err := Read(group[0])
+		if err != nil {
+			t.Fatalf("Cannot read '%s': %s", group[0], err)
+		}
+		for _, s := range group[1:] {
+			D, err := Read(s)
+			if err != nil {
+				t.Fatalf("Cannot read '%s': %s", s, err)
+			}
+			if C.CanonicalString() != D.CanonicalString() || C.Hash() != D.Hash() {
+				t.Errorf("'%s' and '%s' have different canonical forms ('%s' and '%s')",
+					C, D, C.CanonicalString(), D.CanonicalString())
+			}
+		}
+	}
+	different := []string{
+		"(rgb)(xy)[r:+ 10 20|g:sin 20|b:y|x]",
+		"(rgb)(xy)[r:- 10 20|g:sin 20|b:y|x]",
+		"(rgb)(xy)[r:- 20 10|g:sin 20|b:y|x]",
+		"(rgb)(xy)[r:+ 10 20|g:sin 20|b:y|x];@1",
+		"(rgb)(xy)[r:+ 10 20|g:sin 10|b:y|x]",
+		"(rgb)(xy)[r:+ 10 20|b:sin 20|g:y|x]",
+	}
+	hashes := make(map[uint64]string)
+	for _, s := range different {
+		C, _ := Read(s)
+		if other, ok := hashes[C.Hash()]; ok {
+			t.Errorf("'%s' and '%s' have the same hash", other, s)
+		}
+		hashes[C.Hash()] = s
+	}
+
+	m := NewMutator(2)
+	m.Count = 10
+	for i := 0; i < 100; i++ {
+		C := RandomCircuit(3 + i%10)
+		m.Mutate(C)
+		D, err := C.Canonical()
+		if err != nil {
+			t.Fatalf("Cannot put '%s' in canonical form: %s", C, err)
+		}
+		if !sameOutputs(t, *C, D) {
+			t.Errorf("The canonical form of '%s' changes the image ('%s')", C, D)
+		}
+		E, err := Read(D.String())
+		if err != nil {
+			t.Fatalf("Cannot read the canonical form of '%s' ('%s'): %s", C, D, err)
+		}
+		if E.String() != D.String() || E.CanonicalString() != D.String() || E.Hash() != C.Hash() {
+			t.Errorf("The canonical form of '%s' is not stable ('%s', '%s')", C, D, E.CanonicalString())
+		}
+	}
+
+	// Circuits with recursive calls (which can't be read) have no
+	// canonical form, and their canonical string is their string
+	C, _ := Read("(rgb)(x)[rgb:a 10|x];(y)a(x)[y:inv 10|x]")
+	C.Modules["a"].Nodes[0].Op = "a"
+	if D, err := C.Canonical(); err == nil {
+		t.Errorf("The canonical form of '%s' should give an error (gives '%s')", C, D)
+	}
+	if s := C.CanonicalString(); s != C.String() {
+		t.Errorf("The canonical string of '%s' is '%s'", C, s)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	C, _ := Read("(rgb)(xy)[r:+ 20 30|g0b1:sd 20 30|x|y];(sd)sd(xy)[s:+ 20 30|d:- 20 30|x|y];@3")
+	C.Meta = Metadata{Name: "test", Author: "me", Parents: []string{"(rgb)(xy)[rgb:x]"}}
+	data, err := json.Marshal(C)
+	if err != nil {
+		t.Fatalf("Cannot marshal '%s': %s", C, err)
+	}
+	expected := `{"name":"test","author":"me","parents":["(rgb)(xy)[rgb:x]"],"seed":3,"modules":[` +
+		`{"name":"","inputs":[{"name":"x","node":2},{"name":"y","node":3}],` +
+		`"outputs":[{"name":"r","node":0},{"name":"g","node":1},{"name":"b","node":1,"output":1}],` +
+		`"nodes":[{"op":"+","args":[{"node":2},{"node":3}]},{"op":"sd","args":[{"node":2},{"node":3}]},{"op":"x"},{"op":"y"}]},` +
+		`{"name":"sd","inputs":[{"name":"x","node":2},{"name":"y","node":3}],` +
+		`"outputs":[{"name":"s","node":0},{"name":"d","node":1}],` +
+		`"nodes":[{"op":"+","args":[{"node":2},{"node":3}]},{"op":"-","args":[{"node":2},{"node":3}]},{"op":"x"},{"op":"y"}]}]}`
+	if string(data) != expected {
+		t.Errorf("JSON of '%s' is\n%s\n(should be\n%s)", C, data, expected)
+	}
+	var D Circuit
+	if err := json.Unmarshal(data, &D); err != nil {
+		t.Fatalf("Cannot unmarshal '%s': %s", data, err)
+	}
+	if D.String() != C.String() || D.Meta.Name != "test" || D.Meta.Author != "me" ||
+		len(D.Meta.Parents) != 1 || D.Meta.Parents[0] != C.Meta.Parents[0] {
+		t.Errorf("Unmarshaling the JSON of '%s' gives '%s' (%v)", C, D, D.Meta)
+	}
+
+	// Nodes in any order
+	var E Circuit
+	err = json.Unmarshal([]byte(`{"modules":[{"name":"","inputs":[{"name":"x"}],
+		"outputs":[{"name":"r","node":2},{"name":"g","node":1},{"name":"b","node":1}],
+		"nodes":[{"op":"x"},{"op":"=","value":0},{"op":"*","args":[{"node":0},{"node":1}]}]}]}`), &E)
+	if err != nil || E.String() != "(rgb)(x)[r:* 10 20|x|gb:= 0]" {
+		t.Errorf("Unmarshaling a circuit with unsorted nodes gives '%s' (%v)", E, err)
+	}
+
+	wrong := []string{
+		`{"modules":[]}`,
+		`{"modules":[null]}`,
+		`{"modules":[{"name":"","inputs":[],"outputs":[{"name":"r","node":0},{"name":"g","node":0},{"name":"b","node":0}],"nodes":[{"op":"inv","args":[{"node":1}]}]}]}`,
+		`{"modules":[{"name":"","inputs":[],"outputs":[{"name":"r","node":0},{"name":"g","node":0},{"name":"b","node":0}],"nodes":[{"op":"="}]}]}`,
+		`{"modules":[{"name":"","inputs":[],"outputs":[{"name":"r","node":0},{"name":"g","node":0},{"name":"b","node":0}],"nodes":[{"op":"inv","value":1}]}]}`,
+		`{"modules":[{"name":"","inputs":[],"outputs":[{"name":"r","node":0},{"name":"g","node":0},{"name":"b","node":0}],"nodes":[{"op":"a|b"}]}]}`,
+		`{"modules":[{"name":"","inputs":[],"outputs":[{"name":"r","node":0},{"name":"g","node":0},{"name":"b","node":0}],"nodes":[{"op":"f"}]}]}`,
+		`{"modules":[{"name":"","inputs":[],"outputs":[{"name":"rg","node":0},{"name":"b","node":0}],"nodes":[{"op":"=","value":1}]}]}`,
+		`{"modules":[{"name":"","inputs":[],"outputs":[{"name":"r","node":0},{"name":"g","node":0},{"name":"b","node":1}],"nodes":[{"op":"=","value":1}]}]}`,
+		`{"modules":[{"name":"","inputs":[{"name":"x"}],"outputs":[{"name":"r","node":0},{"name":"g","node":0},{"name":"b","node":0}],"nodes":[{"op":"+","args":[{"node":1,"output":12},{"node":1}]},{"op":"x"}]}]}`,
+	}
+	for _, s := range wrong {
+		var C Circuit
+		if err := json.Unmarshal([]byte(s), &C); err == nil {
+			t.Errorf("Unmarshaling '%s' should give an error (gives '%s')", s, C)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		C := RandomCircuit(3 + i%10)
+		C.Mutate()
+		data, err := json.Marshal(C)
+		if err != nil {
+			t.Fatalf("Cannot marshal '%s': %s", C, err)
+		}
+		var D Circuit
+		if err := json.Unmarshal(data, &D); err != nil || D.String() != C.String() {
+			t.Errorf("Unmarshaling the JSON of '%s' gives '%s' (%v)", C, D, err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct{ circuit, serror string }{
+		{"(rgb)(xy)[rgb:+ 10 abc|x|y]", "Wrong argument `abc` (module ``, node 0, char 19)"},
+		{"(rgb)(xy)[rgb:+ 10 -20|x|y]", "Wrong argument `-20` (module ``, node 0, char 19)"},
+		{"(rgb)(xy)[rgb:x|y];junk(a)f(x)[a:x]", "Modules must have format `(abc)name(xyz)[...]` (module ``, char 19)"},
+		{"(rgb)(xy)[rgb:x|y] junk", "Unexpected 'j' after module (module ``, char 19)"},
+		{"(rgb)(xy)[rgb:x 10|y]", "Input 'x' has no args (module ``, node 0, char 16)"},
+		{"(rgb)(xy)[rgb:= 0.5 1|x]", "A constant must have one value (module ``, node 0, char 14)"},
+		{"(rgb)(xy)[rgb:= abc]", "Wrong constant `abc` (module ``, node 0, char 16)"},
+		{"(rgb)(xy)[rgb:x|y", "Missing `]` (module ``, node 1, char 17)"},
+		{"(rgb)(xy)[rgb:x||y]", "Empty node (module ``, node 1, char 16)"},
+		{"(rgb)(xy)[rg:x|b:y|r:inv 0]", "Output 'r' is already in node 0 (module ``, node 2, char 19)"},
+		{"(rgb)(xy)[rgb:x];(a)f(x)[a:+ 10 2(0)|x]", "Unexpected '(' (module `f`, node 0, char 33)"},
+		{"(rgb)(xy)[rgb:f 10|x];(a)f(x)[a:inv 0|x]", "Node 0 depends on itself (module `f`, node 0, char 32)"},
+		{"(rgb)(xy)[rgb:f 10|x];(a)f(x)[a:g 10|x]", "Missing module `g` (module `f`, node 0, char 32)"},
+		{"(rgb)(xy)[rgb:x];@1;@2", "Duplicated seed `@2` (module ``, char 20)"},
+		{"(rgb)(xy)[rgb:x];", "Module is empty (module ``, char 17)"},
+		{"(rgb)(xx)[rgb:x]", "Duplicated input 'x' (module ``, char 7)"},
+	}
+	for _, c := range cases {
+		_, err := Read(c.circuit)
+		if err == nil || err.Error() != c.serror {
+			t.Errorf("Reading '%s' should give error '%s' (gives '%v')", c.circuit, c.serror, err)
+		}
+	}
+	_, err := Read("(rgb)(xy)[rgb:x];(a)f(x)[a:+ 10 abc|x]")
+	if e, ok := err.(*ParseError); !ok || e.Module != "f" || e.Node != 0 || e.Offset != 32 {
+		t.Errorf("Wrong ParseError %#v", err)
+	}
+
+	// Round trip
+	for _, s := range []string{
+		"(rgb)(xy)[r:+ 10 11|gb1:sd 20 30|x|y];(sd)sd(xy)[s:+ 20 30|d:- 20 30|x|y]",
+		"(rgb)(xyrt)[r:= -1e-07|g:= 1e+21|b:= 0]",
+		"(rgb)(xy)[rgb:noise 10 20|x|y];@-42",
+	} {
+		C, err := Read(s)
+		if err != nil || C.String() != s {
+			t.Errorf("Reading '%s' gives '%s' (%v)", s, C, err)
+		}
+	}
+	spaced := " (rgb) (xy) [ r : + 10 11 | g0b1: sd 20 30 |x|y ] ; (sd)sd(xy)[s:+ 20 30|d:- 20 30|x|y] ;  @3 "
+	if C, err := Read(spaced); err != nil || C.String() != "(rgb)(xy)[r:+ 10 11|gb1:sd 20 30|x|y];(sd)sd(xy)[s:+ 20 30|d:- 20 30|x|y];@3" {
+		t.Errorf("Reading '%s' gives '%s' (%v)", spaced, C, err)
+	}
+	m := NewMutator(3)
+	m.Count = 10
+	for i := 0; i < 100; i++ {
+		C := RandomCircuit(3 + i%10)
+		m.Mutate(C)
+		D, err := Read(C.String())
+		if err != nil || D.String() != C.String() {
+			t.Errorf("Reading '%s' gives '%s' (%v)", C, D, err)
+		}
+	}
+}
+
+func TestReadExpr(t *testing.T) {
+	cases := []struct{ expr, circuit string }{
+		{
+			"r = sin(x*y); g = noise(x, r); b = if(t, x, y)",
+			"(rgb)(xyt)[g:noise 40 10|r:sin 20|* 40 50|b:if 60 40 50|x|y|t]",
+		}, {
+			"# shared subexpressions\na = x * y\nr = sin(x * y); g = cos(a)\nb = x*y + y*x\n",
+			"(rgb)(xy)[r:sin 30|g:cos 30|b:+ 30 30|* 40 50|x|y]",
+		}, {
+			"def sd(a, b) -> s, d {\n\ts = a + b\n\td = a - b\n}\n\nr, g = sd(x, y); b = -x + -0.5",
+			"(rgb)(xy)[b:+ 20 60|rg1:sd 30 40|- 50 30|x|y|= 0|= -0.5];(sd)sd(ab)[s:+ 20 30|d:- 20 30|a|b]",
+		}, {
+			"r = x; r = inv(r)\ng = lerp(\n\tr,\n\tx, y)\nb = r",
+			"(rgb)(xy)[g:lerp 10 20 30|rb:inv 20|x|y]",
+		}, {
+			"def half(a) -> o { o = a / 2 }\ndef sq(a) -> o { o = half(a * a) }\nr = sq(x); g = sq(y); b = 1",
+			"(rgb)(xy)[r:sq 20|g:sq 30|x|y|b:= 1];(o)half(a)[o:/ 10 20|a|= 2];(o)sq(a)[o:half 10|* 20 20|a]",
+		},
+	}
+	for _, c := range cases {
+		C, err := ReadExpr(c.expr)
+		if err != nil {
+			t.Errorf("Cannot compile '%s': %s", c.expr, err)
+			continue
+		}
+		if C.String() != c.circuit {
+			t.Errorf("'%s' compiles to '%s' (should be '%s')", c.expr, C, c.circuit)
+		}
+	}
+
+	errors := []struct{ expr, serror string }{
+		{"r = x; g = y", "1:13: Output `b` is not assigned"},
+		{"r = x; g = y; b = z", "1:19: Unknown name `z`"},
+		{"r = x; g = y\nb = foo(x)", "2:5: Unknown function `foo`"},
+		{"r = x; g = y\nb = sin(x, y)", "2:5: `sin` has 1 args, not 2"},
+		{"r = x; g = y\nb = sin(x", "2:10: Unexpected end"},
+		{"r = x; g = y\nb = x $ y", "2:7: Unexpected '$'"},
+		{"r = x; g = y\nb = x y", "2:7: Unexpected `y`"},
+		{"r = x; g = y\nb = 1.2.3", "2:5: Wrong number `1.2.3`"},
+		{"def sd(a, b) -> s, d { s = a; d = b }\nr = sd(x, y); g = y; b = x", "2:5: Module `sd` has 2 outputs, not 1"},
+		{"def sd(a, b) -> s, d { s = a }\nr = x; g = y; b = x", "1:30: Output `d` is not assigned"},
+		{"def sd(a, bc) -> s { s = a }", "1:11: Inputs and outputs of modules must be single letters (not `bc`)"},
+		{"def sin(a) -> s { s = a }", "1:5: `sin` is reserved"},
+		{"def f(a) -> s { s = a }", "1:5: Module names must have more than one letter"},
+		{"r, g = x; b = y", "1:8: Assigning 1 values to 2 names"},
+		{"def id(a) -> o { o = a }\ndef id(a) -> o { o = a }", "2:5: Module `id` is already defined"},
+	}
+	for _, e := range errors {
+		_, err := ReadExpr(e.expr)
+		if err == nil || err.Error() != e.serror {
+			t.Errorf("Compiling '%s' should give error '%s' (gives '%v')", e.expr, e.serror, err)
+		}
+	}
+	_, err := ReadExpr("r = x\ng = y\nb = sin(q)")
+	if e, ok := err.(*ExprError); !ok || e.Line != 3 || e.Col != 9 {
+		t.Errorf("Wrong ExprError %#v", err)
+	}
+
+	// Errors of the compiled circuit are at the definition of the module
+	src := "r = x\ng = y\ndef sq(a) -> o { o = a * a }\nb = sq(x)"
+	toks, err := lexExpr(src)
+	if err != nil {
+		t.Fatalf("Cannot lex '%s': %s", src, err)
+	}
+	p := &exprParser{src: src, toks: toks, modules: make(map[string]*exprModule)}
+	if err := p.program(); err != nil {
+		t.Fatalf("Cannot compile '%s': %s", src, err)
+	}
+	p.modules["sq"].Nodes[0].Op = "cube"
+	_, err = p.circuit()
+	if e, ok := err.(*ExprError); !ok || e.Error() != "3:5: Missing module `cube`" {
+		t.Errorf("Wrong ExprError %#v", err)
+	}
+
+	// The same image as a hand-written circuit
+	A, _ := ReadExpr("s = (x + y) * 2\nr = cos(s); g = band(s); b = max(x, s)")
+	B, _ := Read("(rgb)(xy)[r:cos 30|g:band 30|b:max 40 30|* 50 60|x|+ 40 70|= 2|y]")
+	if !sameOutputs(t, A, B) {
+		t.Errorf("'%s' and '%s' should compute the same image", A, B)
+	}
+}
+
+func TestExpr(t *testing.T) {
+	cases := []struct{ circuit, expr string }{
+		{
+			"(rgb)(xyt)[g:noise 40 10|r:sin 20|* 40 50|b:if 60 40 50|x|y|t]",
+			"v1 = sin(x * y)\nr = v1\ng = noise(x, v1)\nb = if(t, x, y)\n",
+		}, {
+			"(rgb)(xy)[r:+ 10 11|g0b1:sd 20 30|x|y];(sd)sd(xy)[s:+ 20 30|d:- 20 30|x|y];@3",
+			"# seed 3\ndef sd(x, y) -> s, d {\n\ts = x + y\n\td = x - y\n}\n\nv1, v2 = sd(x, y)\nr = v1 + v2\ng = v1\nb = v2\n",
+		}, {
+			"(rgb)(xr)[g:lerp 10 20 30|b:inv 20|r:inv 40|x|r]",
+			"v1 = inv(r)\nv2 = inv(v1)\ng = lerp(v2, v1, x)\nb = v2\nr = v1\n",
+		}, {
+			"(rgb)(x)[r:a 10|g:b 20|b:x];(o)a(i)[o:inv 10|i];(o)b(i)[o:sin 10|i]",
+			"def m1(i) -> o {\n\to = inv(i)\n}\n\ndef m2(i) -> o {\n\to = sin(i)\n}\n\nv1 = m2(x)\nr = m1(v1)\ng = v1\nb = x\n",
+		}, {
+			"(rgb)(x)[r:* 10 20|g:- 30 40|b:/ 40 50|+ 60 50|- 50 60|= 0|x]",
+			"v1 = -x\nv2 = v1 / 0\nv3 = x + 0 - v1\nr = v3 * v2\ng = v3\nb = v2\n",
+		}, {
+			"(rgb)(xy)[r:- 30 40|g:* 50 60|b:+ 70 30|= -2|- 80 90|+ 80 90|/ 90 80|* 90 90|y|x]",
+			"r = -2 - (y - x)\ng = (y + x) * (x / y)\nb = x * x + -2\n",
+		}, {
+			"(ab)sw(ab)[a:b|b:a];(rgb)(xr)[rg:sw 10 20|b:r|x]",
+			"def sw(a, b) -> a, b {\n\tv1 = a\n\tv2 = b\n\ta = v2\n\tb = v1\n}\n\nv1, _ = sw(r, x)\ng = v1\nb = r\nr = v1\n",
+		},
+	}
+	for _, c := range cases {
+		C, err := Read(c.circuit)
+		if err != nil {
+			t.Errorf("Cannot read '%s': %s", c.circuit, err)
+			continue
+		}
+		if expr := C.Expr(); expr != c.expr {
+			t.Errorf("'%s' decompiles to\n%s\n(should be\n%s)", C, expr, c.expr)
+		}
+		D, err := ReadExpr(C.Expr())
+		D.Seed = C.Seed
+		if err != nil || D.CanonicalString() != C.CanonicalString() {
+			t.Errorf("'%s' compiles back to '%s' (%v)", C, D, err)
+		}
+	}
+
+	// Decompiling and compiling computes the same image
+	m := NewMutator(4)
+	m.Count = 10
+	for i := 0; i < 100; i++ {
+		C := RandomCircuit(3 + i%10)
+		m.Mutate(C)
+		D, err := ReadExpr(C.Expr())
+		if err != nil {
+			t.Errorf("Cannot compile the expression of '%s': %s\n%s", C, err, C.Expr())
+			continue
+		}
+		D.Seed = C.Seed
+		if !sameOutputs(t, *C, D) {
+			t.Errorf("'%s' and its expression compute different images\n%s", C, C.Expr())
+		}
+	}
+}
+
+var (
+	glslFuncDef  = regexp.MustCompile(`^(?:float|void|vec2) (\w+)\(`)
+	glslCall     = regexp.MustCompile(`\b(\w+)\(`)
+	glslOwnFunc  = regexp.MustCompile(`^(?:op_\w+|module\d+|circuit|grad2d|perlin|hash|cellular|expScale|hsv|rotate)$`)
+	glslNodeDecl = regexp.MustCompile(`^\tfloat (n\d+(?:_\d+)?(?:, n\d+_\d+)*)(?: = |;)`)
+	glslNodeUse  = regexp.MustCompile(`\bn\d+(?:_\d+)?\b`)
+)
+
+// checkGLSL checks the structure of a shader: brackets are balanced,
+// functions are defined before they are called and the variables of
+// the nodes are declared before they are used.
+func checkGLSL(src string) error {
+	for _, pair := range []string{"()", "{}", "[]"} {
+		if strings.Count(src, pair[:1]) != strings.Count(src, pair[1:]) {
+			return fmt.Errorf("Unbalanced '%s'", pair)
+		}
+	}
+	defined := make(map[string]bool)
+	nodes := make(map[string]bool)
+	for i, line := range strings.Split(src, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "//") {
+			continue
+		}
+		if m := glslFuncDef.FindStringSubmatch(line); m != nil {
+			if defined[m[1]] {
+				return fmt.Errorf("Line %d: `%s` is defined twice", i+1, m[1])
+			}
+			defined[m[1]] = true
+			nodes = make(map[string]bool)
+			continue
+		}
+		for _, m := range glslCall.FindAllStringSubmatch(line, -1) {
+			if glslOwnFunc.MatchString(m[1]) && !defined[m[1]] {
+				return fmt.Errorf("Line %d: `%s` is not defined", i+1, m[1])
+			}
+		}
+		decl := []string{}
+		if m := glslNodeDecl.FindStringSubmatch(line); m != nil {
+			decl = strings.Split(m[1], ", ")
+			line = line[len(m[0]):]
+		}
+		for _, n := range glslNodeUse.FindAllString(line, -1) {
+			if !nodes[n] {
+				return fmt.Errorf("Line %d: `%s` is not declared", i+1, n)
+			}
+		}
+		for _, n := range decl {
+			nodes[n] = true
+		}
+	}
+	return nil
+}
+
+func TestGLSL(t *testing.T) {
+	C, _ := Read("(rgb)(xr)[r:sin 30|g:if 40 30 50|b:sq 30|* 50 60|r|x|= 1.5];(o)sq(a)[o:* 10 10|a]")
+	if src, err := C.GLSL(); err != nil || src != glslGolden {
+		t.Errorf("The shader of '%s' is\n%s\n(should be\n%s) %v", C, src, glslGolden, err)
+	}
+	if err := checkGLSL(glslGolden); err != nil {
+		t.Errorf("Wrong structure of the golden shader: %s", err)
+	}
+
+	// Every operator, with the noise of the seed
+	for _, op := range Operators {
+		if op == "=" {
+			continue
+		}
+		args := []string{}
+		for i := 0; i < OperatorInfo[op].Nargs; i++ {
+			args = append(args, fmt.Sprint(10*(1+i%2)))
+		}
+		s := fmt.Sprintf("(rgb)(xy)[rgb:%s %s|x|y];@7", op, strings.Join(args, " "))
+		C, err := Read(s)
+		if err != nil {
+			t.Errorf("Cannot read '%s': %s", s, err)
+			continue
+		}
+		src, err := C.GLSL()
+		if err != nil {
+			t.Errorf("Operator `%s` has no GLSL: %s", op, err)
+			continue
+		}
+		if fn := glslOperator(op); !strings.Contains(src, "float "+fn+"(") {
+			t.Errorf("The shader of '%s' has no function `%s`", s, fn)
+		}
+		if err := checkGLSL(src); err != nil {
+			t.Errorf("Wrong shader for '%s': %s\n%s", s, err, src)
+		}
+		if OperatorInfo[op].Noise {
+			perm := noiseFor(7).Permutation()
+			table := fmt.Sprint(perm[:])
+			table = strings.Replace(table[1:len(table)-1], " ", ", ", -1)
+			inshader := strings.Join(strings.Fields(src[strings.Index(src, "int[256](")+9:strings.Index(src, ");")]), " ")
+			if inshader != table {
+				t.Errorf("The noise table of '%s' is not the one of its seed", s)
+			}
+		}
+	}
+
+	// Random circuits with modules
+	m := NewMutator(5)
+	m.Count = 10
+	for i := 0; i < 100; i++ {
+		C := RandomCircuit(3 + i%10)
+		m.Mutate(C)
+		src, err := C.GLSL()
+		if err != nil {
+			t.Errorf("Cannot generate the shader of '%s': %s", C, err)
+			continue
+		}
+		if err := checkGLSL(src); err != nil {
+			t.Errorf("Wrong shader for '%s': %s\n%s", C, err, src)
+		}
+	}
+
+	// Registered operators have no GLSL unless they give it
+	registerTest(t, "cube.test", Unary{OpInfo{}, func(a float64) float64 {
+		return a * a * a
+	}})
+	C, _ = Read("(rgb)(x)[rgb:cube.test 10|x]")
+	if _, err := C.GLSL(); err == nil || err.Error() != "Operator `cube.test` has no GLSL code" {
+		t.Errorf("The shader of '%s' should give an error (gives %v)", C, err)
+	}
+}
+
+const glslGolden = `#version 300 es
+// (rgb)(xr)[r:sin 30|g:if 40 30 50|b:sq 30|* 50 60|r|x|= 1.5];(o)sq(a)[o:* 10 10|a]
+precision highp float;
+precision highp int;
+
+uniform vec2 resolution; // size of the canvas, in pixels
+uniform float time;      // the T input
+out vec4 color;
+
+const float PI = 3.141592653589793;
+const float E = 2.718281828459045;
+
+float op_mul(float a, float b) {
+	return a * b;
+}
+
+float op_if(float a, float b, float c) {
+	return a > 0.5 ? b : c;
+}
+
+float op_sin(float a) {
+	return (1.0 + sin(2.0 * PI * a)) / 2.0;
+}
+
+// (o)sq(a)[o:* 10 10|a]
+void module1(float i0, out float o0) {
+	float n0 = op_mul(i0, i0);
+	o0 = n0;
+}
+
+// (rgb)(xr)[r:sin 30|g:if 40 30 50|b:sq 30|* 50 60|r|x|= 1.5]
+void circuit(float i0, float i1, out float o0, out float o1, out float o2) {
+	float n3 = op_mul(i0, 1.5);
+	float n2_0;
+	module1(n3, n2_0);
+	float n1 = op_if(i1, n3, i0);
+	float n0 = op_sin(n3);
+	o0 = n0;
+	o1 = n1;
+	o2 = n2_0;
+}
+
+void main() {
+	// The unit square, centered and fitted in the canvas (y goes down)
+	vec2 size = resolution.x > resolution.y ?
+		vec2(resolution.x / resolution.y, 1.0) : vec2(1.0, resolution.y / resolution.x);
+	vec2 pixel = vec2(gl_FragCoord.x, resolution.y - gl_FragCoord.y);
+	vec2 p = 0.5 - size / 2.0 + size * pixel / resolution;
+	float red, green, blue;
+	circuit(p.x, length(p - 0.5), red, green, blue);
+	color = vec4(clamp(vec3(red, green, blue), 0.0, 1.0), 1.0);
+}
+`
+
+func TestGoSource(t *testing.T) {
+	C, _ := Read("(rgb)(xr)[r:sin 30|g:if 40 30 50|b:sq 30|* 50 60|r|x|= 1.5];(o)sq(a)[o:* 10 10|a]")
+	if src, err := C.GoSource("textures", "Glow"); err != nil || string(src) != goSourceGolden {
+		t.Errorf("The Go source of '%s' is\n%s\n(should be\n%s) %v", C, src, goSourceGolden, err)
+	}
+	if _, err := C.GoSource("textures", "a-b"); err == nil {
+		t.Errorf("`a-b` should not be a valid function name")
+	}
+	t.Run("no code", func(t *testing.T) {
+		registerTest(t, "cube.test", Unary{OpInfo{}, func(a float64) float64 {
+			return a * a * a
+		}})
+		C, _ := Read("(rgb)(x)[rgb:cube.test 10|x]")
+		if _, err := C.GoSource("textures", "Cube"); err == nil || err.Error() != "Operator `cube.test` has no Go code" {
+			t.Errorf("The Go source of '%s' should give an error (gives %v)", C, err)
+		}
+	})
+
+	// Compile circuits with every operator (and a time input), and
+	// random ones, in a program that prints their outputs at some points
+	circuits := []Circuit{}
+	for _, op := range Operators {
+		if op == "=" {
+			continue
+		}
+		args := []string{}
+		for i := 0; i < OperatorInfo[op].Nargs; i++ {
+			args = append(args, fmt.Sprint(10*(2+i%3)))
+		}
+		s := fmt.Sprintf("(rgb)(xyT)[r:%s %s|gb1:sd 30 40|x|y|T];(sd)sd(ab)[s:+ 20 30|d:- 20 30|a|b];@5",
+			op, strings.Join(args, " "))
+		C, err := Read(s)
+		if err != nil {
+			t.Fatalf("Cannot read '%s': %s", s, err)
+		}
+		circuits = append(circuits, C)
+	}
+	m := NewMutator(6)
+	m.Count = 10
+	for i := 0; i < 40; i++ {
+		C := RandomCircuit(3 + i%10)
+		m.Mutate(C)
+		C.Seed = int64(i)
+		circuits = append(circuits, *C)
+	}
+
+	points := [][]float64{}
+	for x := 0.05; x < 1.0; x += .2 {
+		for y := 0.05; y < 1.0; y += .2 {
+			vals := make([]float64, len(PixelInputs))
+			pixelInputs(x, y, .3, vals)
+			points = append(points, vals)
+		}
+	}
+	results := runGoSource(t, circuits, points)
+	for i, C := range circuits {
+		for j, p := range points {
+			inputs := make([]float64, len(C.Modules[""].Inputs))
+			bindInputs(C.Modules[""].Inputs, p, inputs)
+			outputs := C.Eval(inputs)
+			for k, v := range results[i][j] {
+				if !sameValue(v, outputs[k]) || v != outputs[k] && !math.IsNaN(v) {
+					t.Errorf("The Go source of '%s' gives %v (not %v) at %v", C, v, outputs[k], p)
+				}
+			}
+		}
+	}
+}
+
+// runGoSource runs the Go source of the circuits (with a main module
+// with three outputs) at the points (values of PixelInputs), and returns
+// the outputs of each circuit at each point. It skips the test if there
+// is no go command.
+func runGoSource(t *testing.T, circuits []Circuit, points [][]float64) [][][]float64 {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("Cannot find the go command to compile the sources")
+	}
+	dir, err := ioutil.TempDir("", "evoimage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []string{"main.go"}
+	main := "package main\n\nimport \"fmt\"\nimport \"math\"\n\nvar points = [][]float64{\n"
+	for _, p := range points {
+		main += fmt.Sprintf("\t{%s, %s, %s, %s, %s},\n", goFloat(p[0]), goFloat(p[1]), goFloat(p[2]), goFloat(p[3]), goFloat(p[4]))
+	}
+	main += "}\n\nvar circuits = []func(x, y, r, t, T float64) (float64, float64, float64){\n"
+	for i, C := range circuits {
+		src, err := C.GoSource("main", fmt.Sprintf("C%d", i))
+		if err != nil {
+			t.Fatalf("Cannot generate the Go source of '%s': %s", C, err)
+		}
+		file := fmt.Sprintf("c%d.go", i)
+		if err := ioutil.WriteFile(filepath.Join(dir, file), src, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+		if C.Modules[""].inputIndex('T') != -1 {
+			main += fmt.Sprintf("\tC%d,\n", i)
+		} else {
+			main += fmt.Sprintf("\tfunc(x, y, r, t, T float64) (float64, float64, float64) { return C%d(x, y, r, t) },\n", i)
+		}
+	}
+	main += `}
+
+func main() {
+	for _, f := range circuits {
+		for _, p := range points {
+			r, g, b := f(p[0], p[1], p[2], p[3], p[4])
+			fmt.Printf("%x %x %x ", math.Float64bits(r), math.Float64bits(g), math.Float64bits(b))
+		}
+		fmt.Println()
+	}
+}
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(gobin, append([]string{"run"}, files...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Cannot run the generated sources: %s\n%s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != len(circuits) {
+		t.Fatalf("The generated sources give %d lines, not %d", len(lines), len(circuits))
+	}
+	results := make([][][]float64, len(circuits))
+	for i := range circuits {
+		values := strings.Fields(lines[i])
+		if len(values) != 3*len(points) {
+			t.Fatalf("The Go source of '%s' gives %d values, not %d", circuits[i], len(values), 3*len(points))
+		}
+		for j := range points {
+			rgb := make([]float64, 3)
+			for k := range rgb {
+				bits, _ := strconv.ParseUint(values[3*j+k], 16, 64)
+				rgb[k] = math.Float64frombits(bits)
+			}
+			results[i] = append(results[i], rgb)
+		}
+	}
+	return results
+}
+
+const goSourceGolden = `// Code generated by evoimage. DO NOT EDIT.
+
+package textures
+
+import "math"
+
+// Glow computes the color (r, g, b) of the point (x, y), with polar
+// coordinates (r, t), of the circuit
+//
+//	(rgb)(xr)[r:sin 30|g:if 40 30 50|b:sq 30|* 50 60|r|x|= 1.5];(o)sq(a)[o:* 10 10|a]
+func Glow(x, y, r, t float64) (float64, float64, float64) {
+	n3 := glowOpMul(x, 1.5)
+	n2 := glowModule1(n3)
+	n1 := glowOpIf(r, n3, x)
+	n0 := glowOpSin(n3)
+	return n0, n1, n2
+}
+
+// glowModule1 is the module (o)sq(a)[o:* 10 10|a]
+func glowModule1(a float64) float64 {
+	n0 := glowOpMul(a, a)
+	return n0
+}
+
+func glowOpMul(a, b float64) float64 {
+	return a * b
+}
+
+func glowOpIf(a, b, c float64) float64 {
+	if a > .5 {
+		return b
+	}
+	return c
+}
+
+func glowOpSin(a float64) float64 {
+	return (1 + math.Sin(2*math.Pi*a)) / 2
+}
+`
+
+// TestOperators evaluates every operator (and a registered one with
+// code) with the Evaluator, the compiled Program and the generated Go,
+// which must agree.
+func TestOperators(t *testing.T) {
+	registerTest(t, "half.test", Unary{OpInfo{GLSL: "return a / 2.0;", Go: "return a / 2"},
+		func(a float64) float64 { return a / 2 }})
+	cases := [][]float64{
+		{0, 0, 0, 0},
+		{.25, .75, .5, .1},
+		{.5, .5, .5, .5},
+		{.9, .2, .7, .4},
+		{1, 1, 1, 1},
+		{-.3, 1.7, .3333, .66},
+		{.6666, -2, 3, 0},
+		{1.5, .3334, .1, .9},
+	}
+	ops, circuits := []string{}, []Circuit{}
+	for _, op := range Operators {
+		if op == "=" {
+			continue
+		}
+		info := OperatorInfo[op]
+		if info.GLSL == "" || info.Go == "" {
+			t.Errorf("Operator `%s` has no GLSL or Go code", op)
+			continue
+		}
+		args := []string{}
+		for i := 0; i < info.Nargs; i++ {
+			args = append(args, fmt.Sprint(10*(1+i)))
+		}
+		s := fmt.Sprintf("(rgb)(xyrT)[rgb:f 10 20 30 40|x|y|r|T];(o)f(abcd)[o:%s %s|a|b|c|d];@3",
+			op, strings.Join(args, " "))
+		C, err := Read(s)
+		if err != nil {
+			t.Fatalf("Cannot read '%s': %s", s, err)
+		}
+		ops, circuits = append(ops, op), append(circuits, C)
+	}
+
+	// Evaluator and Program
+	want := make([][]float64, len(circuits))
+	for i, C := range circuits {
+		op, _ := LookupOperator(ops[i])
+		E := NewEvaluator(&C)
+		P, err := C.Compile()
+		if err != nil {
+			t.Fatalf("Cannot compile '%s': %s", C, err)
+		}
+		regs := P.Registers()
+		for _, args := range cases {
+			direct := op.Eval(args[:op.Info().Nargs], noiseFor(C.Seed))
+			v := E.Eval(args)[0]
+			if !sameValue(v, direct) {
+				t.Errorf("The Evaluator gives %g for `%s` %v (should be %g)", v, ops[i], args, direct)
+			}
+			if p := P.Eval(regs, args)[0]; !sameValue(p, v) {
+				t.Errorf("The Program gives %g for `%s` %v (the Evaluator %g)", p, ops[i], args, v)
+			}
+			want[i] = append(want[i], v)
+		}
+	}
+
+	// Generated Go (the inputs are x, y, r and T)
+	points := make([][]float64, len(cases))
+	for j, c := range cases {
+		points[j] = []float64{c[0], c[1], c[2], 0, c[3]}
+	}
+	results := runGoSource(t, circuits, points)
+	for i := range circuits {
+		for j := range cases {
+			if v := results[i][j][0]; !sameValue(v, want[i][j]) {
+				t.Errorf("The Go source gives %g for `%s` %v (the Evaluator %g)", v, ops[i], cases[j], want[i][j])
+			}
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Evolution of circuits towards a target image.
+//
+// Circuits are scored by the distance between a small render and a
+// downsampled version of the target, and evolved with a (μ+λ) or a
+// tournament genetic algorithm using a Mutator.
+package evolve
+
+import (
+	"fmt"
+	eimg "go-evoimage"
+	"image"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Target ///////////////////////////////////////////////////
+
+// A Target is an image downsampled to the size used for scoring, with
+// its pixels as rgb values in [0, 1].
+type Target struct {
+	W, H int
+	Pix  []float64 // r, g, b for each pixel, row by row
+}
+
+// NewTarget downsamples img (averaging boxes of pixels) so that its
+// largest side is size. It gives an error if img or size are empty.
+func NewTarget(img image.Image, size int) (*Target, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, fmt.Errorf("Empty target image")
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("Target size must be positive")
+	}
+	w, h := size, size
+	if b.Dx() > b.Dy() {
+		h = max(1, size*b.Dy()/b.Dx())
+	} else {
+		w = max(1, size*b.Dx()/b.Dy())
+	}
+	T := &Target{W: w, H: h, Pix: make([]float64, w*h*3)}
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/h, b.Min.Y+(y+1)*b.Dy()/h
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/w, b.Min.X+(x+1)*b.Dx()/w
+			var sum [3]float64
+			n := 0
+			for i := x0; i < max(x1, x0+1); i++ {
+				for j := y0; j < max(y1, y0+1); j++ {
+					r, g, b, _ := img.At(i, j).RGBA()
+					sum[0] += float64(r) / 0xffff
+					sum[1] += float64(g) / 0xffff
+					sum[2] += float64(b) / 0xffff
+					n++
+				}
+			}
+			k := (y*w + x) * 3
+			for c := range sum {
+				T.Pix[k+c] = sum[c] / float64(n)
+			}
+		}
+	}
+	return T, nil
+}
+
+// pixels returns the rgb values of img, which must have the size of T.
+func (T *Target) pixels(img image.Image) []float64 {
+	pix := make([]float64, T.W*T.H*3)
+	b := img.Bounds()
+	for y := 0; y < T.H; y++ {
+		for x := 0; x < T.W; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			k := (y*T.W + x) * 3
+			pix[k] = float64(r) / 0xffff
+			pix[k+1] = float64(g) / 0xffff
+			pix[k+2] = float64(bl) / 0xffff
+		}
+	}
+	return pix
+}
+
+// Metric ///////////////////////////////////////////////////
+
+// A Metric measures the distance between two images of the same size
+// (as returned by Target.pixels). Zero means identical.
+type Metric int
+
+const (
+	MSE  Metric = iota // mean squared error
+	SSIM               // 1 - structural similarity, over 8x8 windows
+)
+
+var Metrics = map[string]Metric{
+	"mse":  MSE,
+	"ssim": SSIM,
+}
+
+func mse(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return sum / float64(len(a))
+}
+
+const ssimWindow = 8
+
+func (T *Target) ssim(a, b []float64) float64 {
+	const c1, c2 = 0.01 * 0.01, 0.03 * 0.03
+	sum, n := 0.0, 0
+	for wy := 0; wy < T.H; wy += ssimWindow {
+		for wx := 0; wx < T.W; wx += ssimWindow {
+			for c := 0; c < 3; c++ {
+				var ma, mb, va, vb, cov, k float64
+				for y := wy; y < wy+ssimWindow && y < T.H; y++ {
+					for x := wx; x < wx+ssimWindow && x < T.W; x++ {
+						i := (y*T.W+x)*3 + c
+						ma += a[i]
+						mb += b[i]
+						k++
+					}
+				}
+				ma, mb = ma/k, mb/k
+				for y := wy; y < wy+ssimWindow && y < T.H; y++ {
+					for x := wx; x < wx+ssimWindow && x < T.W; x++ {
+						i := (y*T.W+x)*3 + c
+						va += (a[i] - ma) * (a[i] - ma)
+						vb += (b[i] - mb) * (b[i] - mb)
+						cov += (a[i] - ma) * (b[i] - mb)
+					}
+				}
+				va, vb, cov = va/k, vb/k, cov/k
+				sum += ((2*ma*mb + c1) * (2*cov + c2)) /
+					((ma*ma + mb*mb + c1) * (va + vb + c2))
+				n++
+			}
+		}
+	}
+	return 1 - sum/float64(n)
+}
+
+// Distance returns the distance between img (of the size of T) and T.
+func (T *Target) Distance(img image.Image, metric Metric) float64 {
+	pix := T.pixels(img)
+	switch metric {
+	case SSIM:
+		return T.ssim(T.Pix, pix)
+	default:
+		return mse(T.Pix, pix)
+	}
+}
+
+// Evolution ////////////////////////////////////////////////
+
+type Strategy int
+
+const (
+	Plus       Strategy = iota // (μ+λ): the best μ of parents and offspring survive
+	Tournament                 // offspring of tournament winners replace all but the best
+)
+
+var Strategies = map[string]Strategy{
+	"plus":       Plus,
+	"tournament": Tournament,
+}
+
+type Options struct {
+	Metric         Metric
+	Strategy       Strategy
+	Mu             int // population size
+	Lambda         int // offspring per generation (Plus)
+	TournamentSize int
+	NumNodes       int           // nodes of the initial random circuits
+	Initial        []string      // circuits to start from (random if empty)
+	Samples        int           // samples per pixel when rendering
+	Seed           int64         // seed of selection (and of Mutator, if nil)
+	Mutator        *eimg.Mutator // mutates and makes random circuits (a new one with Seed if nil)
+}
+
+type Individual struct {
+	Circuit  eimg.Circuit
+	Distance float64
+}
+
+type Evolver struct {
+	Target     *Target
+	Opts       Options
+	Population []Individual // sorted by distance
+	Generation int
+	rnd        *rand.Rand
+}
+
+// Mutant returns a mutated copy of C (using the global random
+// generator).
+func Mutant(C eimg.Circuit) eimg.Circuit {
+	M := C.Clone()
+	M.Mutate()
+	return M
+}
+
+// mutant returns a mutated copy of C, using the mutator of E.
+func (E *Evolver) mutant(C eimg.Circuit) eimg.Circuit {
+	M := C.Clone()
+	E.Opts.Mutator.Mutate(&M)
+	return M
+}
+
+func (E *Evolver) score(C eimg.Circuit) float64 {
+	P, err := C.Compile()
+	if err != nil {
+		return math.Inf(1)
+	}
+	img := P.RenderWith(eimg.RenderOptions{
+		Width:   E.Target.W,
+		Height:  E.Target.H,
+		Samples: E.Opts.Samples,
+		Workers: 1,
+	})
+	d := E.Target.Distance(img, E.Opts.Metric)
+	if math.IsNaN(d) {
+		return math.Inf(1)
+	}
+	return d
+}
+
+// evaluate scores the circuits in parallel, with a worker per CPU.
+func (E *Evolver) evaluate(circuits []eimg.Circuit) []Individual {
+	inds := make([]Individual, len(circuits))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for k := 0; k < runtime.GOMAXPROCS(0); k++ {
+		wg.Add(1)
+		go func() {
+			for i := range next {
+				inds[i] = Individual{circuits[i], E.score(circuits[i])}
+			}
+			wg.Done()
+		}()
+	}
+	for i := range circuits {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return inds
+}
+
+func sortIndividuals(inds []Individual) {
+	sort.SliceStable(inds, func(i, j int) bool {
+		return inds[i].Distance < inds[j].Distance
+	})
+}
+
+// New creates the initial population.
+func New(T *Target, opts Options) (*Evolver, error) {
+	if opts.Mu <= 0 {
+		return nil, fmt.Errorf("Population size must be positive")
+	}
+	// Selection draws from another stream than a Mutator with Seed
+	seed := rand.New(rand.NewSource(opts.Seed)).Int63()
+	E := &Evolver{
+		Target: T,
+		Opts:   opts,
+		rnd:    rand.New(rand.NewSource(seed)),
+	}
+	if E.Opts.Mutator == nil {
+		E.Opts.Mutator = eimg.NewMutator(opts.Seed)
+	}
+	circuits := []eimg.Circuit{}
+	for _, s := range opts.Initial {
+		C, err := eimg.Read(s)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read '%s': %s", s, err)
+		}
+		circuits = append(circuits, C)
+	}
+	for len(circuits) < opts.Mu {
+		circuits = append(circuits, *E.Opts.Mutator.RandomCircuit(opts.NumNodes))
+	}
+	E.Population = E.evaluate(circuits)
+	sortIndividuals(E.Population)
+	return E, nil
+}
+
+func (E *Evolver) tournament() Individual {
+	k := E.Opts.TournamentSize
+	if k <= 0 {
+		k = 2
+	}
+	best := E.Population[E.rnd.Intn(len(E.Population))]
+	for i := 1; i < k; i++ {
+		ind := E.Population[E.rnd.Intn(len(E.Population))]
+		if ind.Distance < best.Distance {
+			best = ind
+		}
+	}
+	return best
+}
+
+// Step runs one generation and returns the best individual.
+func (E *Evolver) Step() Individual {
+	offspring := []eimg.Circuit{}
+	switch E.Opts.Strategy {
+	case Tournament:
+		for len(offspring) < len(E.Population)-1 {
+			offspring = append(offspring, E.mutant(E.tournament().Circuit))
+		}
+		next := append([]Individual{E.Population[0]}, E.evaluate(offspring)...)
+		E.Population = next
+	default:
+		lambda := E.Opts.Lambda
+		if lambda <= 0 {
+			lambda = E.Opts.Mu
+		}
+		for len(offspring) < lambda {
+			parent := E.Population[E.rnd.Intn(len(E.Population))]
+			offspring = append(offspring, E.mutant(parent.Circuit))
+		}
+		E.Population = append(E.Population, E.evaluate(offspring)...)
+	}
+	sortIndividuals(E.Population)
+	if len(E.Population) > E.Opts.Mu {
+		E.Population = E.Population[:E.Opts.Mu]
+	}
+	E.Generation++
+	return E.Population[0]
+}
+
+// Best returns the best individual found so far.
+func (E *Evolver) Best() Individual {
+	return E.Population[0]
+}
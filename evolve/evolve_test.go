@@ -0,0 +1,122 @@
+package evolve
+
+import (
+	eimg "go-evoimage"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+// render renders C at w×h.
+func render(t *testing.T, C eimg.Circuit, w, h int) image.Image {
+	img, err := C.RenderWith(eimg.RenderOptions{Width: w, Height: h})
+	if err != nil {
+		t.Fatalf("Cannot render '%s': %s", C, err)
+	}
+	return img
+}
+
+// target renders s at w×h and makes a target of the given size.
+func target(t *testing.T, s string, w, h, size int) *Target {
+	C, err := eimg.Read(s)
+	if err != nil {
+		t.Fatalf("Cannot read '%s': %s", s, err)
+	}
+	T, err := NewTarget(render(t, C, w, h), size)
+	if err != nil {
+		t.Fatalf("Cannot make a target of '%s': %s", s, err)
+	}
+	return T
+}
+
+func TestNewTarget(t *testing.T) {
+	T := target(t, "(rgb)(xy)[r:x|gb:y]", 64, 32, 16)
+	if T.W != 16 || T.H != 8 {
+		t.Errorf("Target should be 16x8 (is %dx%d)", T.W, T.H)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	if _, err := NewTarget(image.NewRGBA(image.Rectangle{}), 16); err == nil {
+		t.Errorf("An empty image should not be a target")
+	}
+	if _, err := NewTarget(img, 0); err == nil {
+		t.Errorf("A target of size 0 should give an error")
+	}
+}
+
+func TestDistance(t *testing.T) {
+	s := "(rgb)(xy)[b:* 10 20|r:x|g:y]"
+	C, _ := eimg.Read(s)
+	T := target(t, s, 16, 16, 16)
+	img := render(t, C, T.W, T.H)
+	for _, metric := range Metrics {
+		if d := T.Distance(img, metric); d > 1e-3 {
+			t.Errorf("Distance of '%s' to itself is %g (metric %d)", s, d, metric)
+		}
+	}
+	D, _ := eimg.Read("(rgb)(xy)[rgb:inv 10|x]")
+	other := render(t, D, T.W, T.H)
+	for _, metric := range Metrics {
+		if d := T.Distance(other, metric); d < 1e-2 {
+			t.Errorf("Distance of different images is %g (metric %d)", d, metric)
+		}
+	}
+}
+
+func TestEvolve(t *testing.T) {
+	T := target(t, "(rgb)(xy)[b:* 10 20|r:x|g:y]", 48, 48, 12)
+	for _, strategy := range Strategies {
+		E, err := New(T, Options{
+			Strategy: strategy,
+			Mu:       4,
+			Lambda:   6,
+			NumNodes: 5,
+			Seed:     1,
+		})
+		if err != nil {
+			t.Fatalf("Cannot create evolver: %s", err)
+		}
+		prev := E.Best().Distance
+		for g := 0; g < 5; g++ {
+			best := E.Step()
+			if best.Distance > prev {
+				t.Errorf("Best distance went up from %g to %g", prev, best.Distance)
+			}
+			prev = best.Distance
+			if len(E.Population) != 4 {
+				t.Errorf("Population has %d individuals (should be 4)", len(E.Population))
+			}
+		}
+	}
+}
+
+func TestEvolveSeed(t *testing.T) {
+	T := target(t, "(rgb)(xy)[b:* 10 20|r:x|g:y]", 48, 48, 12)
+	run := func(globalSeed int64) []string {
+		rand.Seed(globalSeed) // must not matter
+		E, err := New(T, Options{Mu: 4, Lambda: 6, NumNodes: 5, Seed: 3})
+		if err != nil {
+			t.Fatalf("Cannot create evolver: %s", err)
+		}
+		E.Step()
+		var circuits []string
+		for _, ind := range E.Population {
+			circuits = append(circuits, ind.Circuit.String())
+		}
+		return circuits
+	}
+	a, b := run(1), run(2)
+	for i := range a {
+		if a[i] != b[i] {
+			t.Errorf("Individual %d differs with the same seed: '%s' and '%s'", i, a[i], b[i])
+		}
+	}
+
+	// Selection and mutation don't draw the same numbers
+	E, err := New(T, Options{Mu: 1, Initial: []string{"(rgb)(xy)[rgb:x]"}, Seed: 3})
+	if err != nil {
+		t.Fatalf("Cannot create evolver: %s", err)
+	}
+	if E.rnd.Int63() == E.Opts.Mutator.Rand.Int63() {
+		t.Errorf("Selection and mutation use the same random numbers")
+	}
+}
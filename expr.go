@@ -0,0 +1,851 @@
+package evoimage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expressions /////////////////////////////////////////////
+
+// ReadExpr compiles a program in a small expression language to a
+// circuit. A program assigns the outputs r, g and b of the main module:
+//
+//	# stripes
+//	a = sin(x * 10)
+//	r = a; g = noise(x, a); b = if(t, x, y)
+//
+// Names are the pixel inputs (x, y, r, t and T) or variables, which can
+// be assigned more than once: a name is its last assignment, so `r` is
+// the input until it is assigned. Functions are the operators and the
+// modules defined before. The operators `+`, `-`, `*` and `/` can also
+// be written infix, and they are the operators of circuits (so `a + b`
+// is the average of a and b). Modules have single letter inputs and
+// outputs, and a call to a module with more than one output must be
+// assigned to all of them:
+//
+//	def sd(a, b) -> s, d {
+//		s = a + b
+//		d = a - b
+//	}
+//	r, g = sd(x, y)
+//
+// Statements are separated by newlines or `;`, and `#` starts a
+// comment. Equal subexpressions are computed only once. Errors are
+// ExprErrors.
+func ReadExpr(src string) (C Circuit, err error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return C, err
+	}
+	p := &exprParser{src: src, toks: toks, modules: make(map[string]*exprModule)}
+	if err = p.program(); err != nil {
+		return C, err
+	}
+	return p.circuit()
+}
+
+// An ExprError is an error in an expression program, at the given line
+// and column (both from 1).
+type ExprError struct {
+	Line, Col int
+	Msg       string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+}
+
+// Tokens
+
+const (
+	tokEOF = iota
+	tokSep // newline or `;`
+	tokIdent
+	tokNumber
+	tokPunct
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+func exprErrorf(src string, pos int, format string, args ...interface{}) error {
+	line := 1 + strings.Count(src[:pos], "\n")
+	col := 1 + utf8.RuneCountInString(src[strings.LastIndex(src[:pos], "\n")+1:pos])
+	return &ExprError{Line: line, Col: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// isIdentRune tells whether r can be in a name (`.` is allowed after the
+// first rune, for operators like `sq.test`).
+func isIdentRune(r rune, first bool) bool {
+	return r == '_' || unicode.IsLetter(r) || !first && (unicode.IsDigit(r) || r == '.')
+}
+
+func lexExpr(src string) (toks []exprToken, err error) {
+	depth := 0 // of parentheses, inside which newlines don't separate
+	for pos := 0; pos < len(src); {
+		r, size := utf8.DecodeRuneInString(src[pos:])
+		start := pos
+		switch {
+		case r == '#':
+			for pos < len(src) && src[pos] != '\n' {
+				pos++
+			}
+		case r == '\n' || r == ';':
+			pos += size
+			if depth == 0 || r == ';' {
+				toks = append(toks, exprToken{tokSep, src[start:pos], start})
+			}
+		case unicode.IsSpace(r):
+			pos += size
+		case isIdentRune(r, true):
+			for pos < len(src) {
+				r, size := utf8.DecodeRuneInString(src[pos:])
+				if !isIdentRune(r, false) {
+					break
+				}
+				pos += size
+			}
+			toks = append(toks, exprToken{tokIdent, src[start:pos], start})
+		case unicode.IsDigit(r) || r == '.':
+			for pos < len(src) && (unicode.IsDigit(rune(src[pos])) || src[pos] == '.') {
+				pos++
+			}
+			if pos < len(src) && (src[pos] == 'e' || src[pos] == 'E') {
+				pos++
+				if pos < len(src) && (src[pos] == '+' || src[pos] == '-') {
+					pos++
+				}
+				for pos < len(src) && unicode.IsDigit(rune(src[pos])) {
+					pos++
+				}
+			}
+			if _, err := strconv.ParseFloat(src[start:pos], 64); err != nil {
+				return nil, exprErrorf(src, start, "Wrong number `%s`", src[start:pos])
+			}
+			toks = append(toks, exprToken{tokNumber, src[start:pos], start})
+		case strings.HasPrefix(src[pos:], "->"):
+			pos += 2
+			toks = append(toks, exprToken{tokPunct, "->", start})
+		case strings.ContainsRune("(),=+-*/{}", r):
+			pos += size
+			if r == '(' {
+				depth++
+			} else if r == ')' && depth > 0 {
+				depth--
+			}
+			toks = append(toks, exprToken{tokPunct, src[start:pos], start})
+		default:
+			return nil, exprErrorf(src, start, "Unexpected '%c'", r)
+		}
+	}
+	toks = append(toks, exprToken{tokEOF, "", len(src)})
+	return toks, nil
+}
+
+// Modules
+
+type exprModule struct {
+	*Module
+	outputs []rune              // declared outputs
+	vars    map[string]Argument // current value of each variable
+	pixel   bool                // inputs are the pixel inputs (main module)
+	nodes   map[string]int      // nodes by operation, to share them
+	pos     int                 // of its name in the source (0 for main)
+}
+
+func newExprModule(name string) *exprModule {
+	return &exprModule{
+		Module: &Module{Name: name},
+		vars:   make(map[string]Argument),
+		nodes:  make(map[string]int),
+	}
+}
+
+// node returns a node with the given op and args, adding it if there is
+// no equal node.
+func (m *exprModule) node(op string, args []Argument, value float64) int {
+	sargs := make([]string, len(args))
+	for i, a := range args {
+		sargs[i] = fmt.Sprint(int(a))
+	}
+	if info, ok := OperatorInfo[op]; ok && info.Commutative {
+		sort.Strings(sargs)
+	}
+	key := op + " " + strings.Join(sargs, " ")
+	if op == "=" {
+		key = fmt.Sprintf("= %x", math.Float64bits(value))
+	}
+	if n, ok := m.nodes[key]; ok {
+		return n
+	}
+	node := &Node{Op: op, Args: args, Value: value}
+	m.Nodes = append(m.Nodes, node)
+	m.nodes[key] = len(m.Nodes) - 1
+	return len(m.Nodes) - 1
+}
+
+// input returns the input node with the given name, if there is one.
+func (m *exprModule) input(name string) (Argument, bool) {
+	r, size := utf8.DecodeRuneInString(name)
+	if size != len(name) {
+		return Unset, false
+	}
+	if k := m.inputIndex(r); k != -1 {
+		return argument(m.node(name, nil, 0), 0), true
+	}
+	if m.pixel && strings.ContainsRune(PixelInputs, r) {
+		m.Inputs = append(m.Inputs, Port{Name: r, Idx: -1})
+		sort.Slice(m.Inputs, func(i, j int) bool {
+			return strings.IndexRune(PixelInputs, m.Inputs[i].Name) <
+				strings.IndexRune(PixelInputs, m.Inputs[j].Name)
+		})
+		return argument(m.node(name, nil, 0), 0), true
+	}
+	return Unset, false
+}
+
+// Parser
+
+type exprParser struct {
+	src     string
+	toks    []exprToken
+	i       int
+	modules map[string]*exprModule
+	order   []*exprModule
+	m       *exprModule // module being compiled
+}
+
+func (p *exprParser) peek() exprToken { return p.toks[p.i] }
+
+func (p *exprParser) next() exprToken {
+	tok := p.toks[p.i]
+	if tok.kind != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+func (p *exprParser) is(text string) bool {
+	tok := p.peek()
+	return tok.kind == tokPunct && tok.text == text
+}
+
+func (p *exprParser) errorf(tok exprToken, format string, args ...interface{}) error {
+	return exprErrorf(p.src, tok.pos, format, args...)
+}
+
+func (p *exprParser) unexpected(tok exprToken) error {
+	switch tok.kind {
+	case tokEOF:
+		return p.errorf(tok, "Unexpected end")
+	case tokSep:
+		return p.errorf(tok, "Unexpected end of statement")
+	}
+	return p.errorf(tok, "Unexpected `%s`", tok.text)
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.is(text) {
+		return p.unexpected(p.peek())
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) ident() (exprToken, error) {
+	tok := p.next()
+	if tok.kind != tokIdent {
+		return tok, p.unexpected(tok)
+	}
+	return tok, nil
+}
+
+// letter reads the name of an input or output of a module.
+func (p *exprParser) letter() (rune, error) {
+	tok, err := p.ident()
+	if err != nil {
+		return 0, err
+	}
+	r, size := utf8.DecodeRuneInString(tok.text)
+	if size != len(tok.text) || !unicode.IsLetter(r) {
+		return 0, p.errorf(tok, "Inputs and outputs of modules must be single letters (not `%s`)", tok.text)
+	}
+	return r, nil
+}
+
+func (p *exprParser) skipSeps() {
+	for p.peek().kind == tokSep {
+		p.next()
+	}
+}
+
+// endStatement reads the end of a statement (which can also end at a
+// `}` or at the end of the program).
+func (p *exprParser) endStatement() error {
+	switch tok := p.peek(); {
+	case tok.kind == tokSep:
+		p.skipSeps()
+	case tok.kind != tokEOF && !p.is("}"):
+		return p.unexpected(tok)
+	}
+	return nil
+}
+
+func (p *exprParser) program() error {
+	main := newExprModule("")
+	main.outputs = []rune("rgb")
+	main.pixel = true
+	for p.skipSeps(); p.peek().kind != tokEOF; {
+		var err error
+		if tok := p.peek(); tok.kind == tokIdent && tok.text == "def" {
+			err = p.def()
+		} else {
+			p.m = main
+			err = p.assignment()
+		}
+		if err == nil {
+			err = p.endStatement()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	p.order = append([]*exprModule{main}, p.order...)
+	return p.finish(main, p.peek())
+}
+
+// finish sets the outputs of m from its variables.
+func (p *exprParser) finish(m *exprModule, end exprToken) error {
+	for _, name := range m.outputs {
+		a, ok := m.vars[string(name)]
+		if !ok {
+			return p.errorf(end, "Output `%c` is not assigned", name)
+		}
+		m.Outputs = append(m.Outputs, Port{Name: name, Idx: a.Node(), Out: a.Output()})
+	}
+	return nil
+}
+
+// circuit reads the compiled modules as a Circuit. A ParseError means
+// that a module was compiled wrong, and is reported at its definition.
+func (p *exprParser) circuit() (Circuit, error) {
+	smodules := []string{}
+	for _, m := range p.order {
+		smodules = append(smodules, m.String())
+	}
+	C, err := Read(strings.Join(smodules, ";"))
+	if perr, ok := err.(*ParseError); ok {
+		pos := 0
+		if m := p.modules[perr.Module]; m != nil {
+			pos = m.pos
+		}
+		err = exprErrorf(p.src, pos, "%s", perr.Msg)
+	}
+	return C, err
+}
+
+// def reads `def name(a, b) -> s, d { ... }`.
+func (p *exprParser) def() error {
+	p.next()
+	tok, err := p.ident()
+	if err != nil {
+		return err
+	}
+	name := tok.text
+	switch _, isOperator := OperatorInfo[name]; {
+	case isOperator || name == "def":
+		return p.errorf(tok, "`%s` is reserved", name)
+	case utf8.RuneCountInString(name) < 2:
+		return p.errorf(tok, "Module names must have more than one letter")
+	case p.modules[name] != nil:
+		return p.errorf(tok, "Module `%s` is already defined", name)
+	}
+	m := newExprModule(name)
+	m.pos = tok.pos
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.is(")") {
+		if len(m.Inputs) > 0 {
+			if err := p.expect(","); err != nil {
+				return err
+			}
+		}
+		at := p.peek()
+		r, err := p.letter()
+		if err != nil {
+			return err
+		}
+		if m.inputIndex(r) != -1 {
+			return p.errorf(at, "Duplicated input `%c`", r)
+		}
+		m.Inputs = append(m.Inputs, Port{Name: r, Idx: -1})
+	}
+	p.next()
+	if err := p.expect("->"); err != nil {
+		return err
+	}
+	for len(m.outputs) == 0 || p.is(",") {
+		if len(m.outputs) > 0 {
+			p.next()
+		}
+		at := p.peek()
+		r, err := p.letter()
+		if err != nil {
+			return err
+		}
+		for _, o := range m.outputs {
+			if o == r {
+				return p.errorf(at, "Duplicated output `%c`", r)
+			}
+		}
+		m.outputs = append(m.outputs, r)
+	}
+	if len(m.outputs) > MAX_ARGS {
+		return p.errorf(tok, "Module `%s` has more than %d outputs", name, MAX_ARGS)
+	}
+	if err := p.expect("{"); err != nil {
+		return err
+	}
+	p.m = m
+	for p.skipSeps(); !p.is("}"); {
+		if p.peek().kind == tokEOF {
+			return p.unexpected(p.peek())
+		}
+		if err := p.assignment(); err != nil {
+			return err
+		}
+		if err := p.endStatement(); err != nil {
+			return err
+		}
+	}
+	if err := p.finish(m, p.next()); err != nil {
+		return err
+	}
+	p.modules[name] = m
+	p.order = append(p.order, m)
+	return nil
+}
+
+// assignment reads `a = expr` or `a, b = call(...)`.
+func (p *exprParser) assignment() error {
+	names := []exprToken{}
+	for len(names) == 0 || p.is(",") {
+		if len(names) > 0 {
+			p.next()
+		}
+		tok, err := p.ident()
+		if err != nil {
+			return err
+		}
+		names = append(names, tok)
+	}
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	at := p.peek()
+	values, err := p.expr(len(names))
+	if err != nil {
+		return err
+	}
+	if len(values) != len(names) {
+		return p.errorf(at, "Assigning %d values to %d names", len(values), len(names))
+	}
+	for i, tok := range names {
+		p.m.vars[tok.text] = values[i]
+	}
+	return nil
+}
+
+// expr reads an expression. Only calls to modules can have more than
+// one value, so only them are given want values.
+func (p *exprParser) expr(want int) ([]Argument, error) {
+	if want > 1 {
+		if tok := p.peek(); tok.kind == tokIdent && p.toks[p.i+1].text == "(" {
+			return p.call(want)
+		}
+	}
+	a, err := p.sum()
+	return []Argument{a}, err
+}
+
+func (p *exprParser) binary(op string, a, b Argument) Argument {
+	return argument(p.m.node(op, []Argument{a, b}, 0), 0)
+}
+
+// sum reads terms separated by `+` or `-`.
+func (p *exprParser) sum() (Argument, error) {
+	a, err := p.term()
+	for err == nil && (p.is("+") || p.is("-")) {
+		op := p.next().text
+		var b Argument
+		if b, err = p.term(); err == nil {
+			a = p.binary(op, a, b)
+		}
+	}
+	return a, err
+}
+
+// term reads factors separated by `*` or `/`.
+func (p *exprParser) term() (Argument, error) {
+	a, err := p.factor()
+	for err == nil && (p.is("*") || p.is("/")) {
+		op := p.next().text
+		var b Argument
+		if b, err = p.factor(); err == nil {
+			a = p.binary(op, a, b)
+		}
+	}
+	return a, err
+}
+
+func (p *exprParser) factor() (Argument, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokPunct && tok.text == "-":
+		if num := p.peek(); num.kind == tokNumber {
+			// A negative constant
+			p.next()
+			v, _ := strconv.ParseFloat(num.text, 64)
+			return argument(p.m.node("=", nil, -v), 0), nil
+		}
+		a, err := p.factor()
+		if err != nil {
+			return a, err
+		}
+		zero := argument(p.m.node("=", nil, 0), 0)
+		return p.binary("-", zero, a), nil
+	case tok.kind == tokPunct && tok.text == "(":
+		a, err := p.sum()
+		if err != nil {
+			return a, err
+		}
+		return a, p.expect(")")
+	case tok.kind == tokNumber:
+		v, _ := strconv.ParseFloat(tok.text, 64)
+		return argument(p.m.node("=", nil, v), 0), nil
+	case tok.kind == tokIdent && p.is("("):
+		p.i--
+		values, err := p.call(1)
+		if err != nil {
+			return Unset, err
+		}
+		return values[0], nil
+	case tok.kind == tokIdent:
+		if a, ok := p.m.vars[tok.text]; ok {
+			return a, nil
+		}
+		if a, ok := p.m.input(tok.text); ok {
+			return a, nil
+		}
+		return Unset, p.errorf(tok, "Unknown name `%s`", tok.text)
+	}
+	return Unset, p.unexpected(tok)
+}
+
+// call reads a call to an operator or module with want values.
+func (p *exprParser) call(want int) ([]Argument, error) {
+	tok := p.next()
+	p.next() // (
+	args := []Argument{}
+	for !p.is(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		a, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	p.next()
+
+	name := tok.text
+	if info, ok := OperatorInfo[name]; ok && name != "=" {
+		if len(args) != info.Nargs {
+			return nil, p.errorf(tok, "`%s` has %d args, not %d", name, info.Nargs, len(args))
+		}
+		if want != 1 {
+			return nil, p.errorf(tok, "`%s` has one value, not %d", name, want)
+		}
+		return []Argument{argument(p.m.node(name, args, 0), 0)}, nil
+	}
+	m, ok := p.modules[name]
+	if !ok {
+		return nil, p.errorf(tok, "Unknown function `%s`", name)
+	}
+	if len(args) != len(m.Inputs) {
+		return nil, p.errorf(tok, "Module `%s` has %d inputs, not %d", name, len(m.Inputs), len(args))
+	}
+	if len(m.outputs) != want {
+		return nil, p.errorf(tok, "Module `%s` has %d outputs, not %d", name, len(m.outputs), want)
+	}
+	n := p.m.node(name, args, 0)
+	values := make([]Argument, want)
+	for k := range values {
+		values[k] = argument(n, k)
+	}
+	return values, nil
+}
+
+// Decompiling /////////////////////////////////////////////
+
+// Expr returns C in the expression language (see ReadExpr): a `def` for
+// each module other than main (callees first) and then the statements of
+// main. ReadExpr(C.Expr()) computes the same image, but the seed of the
+// noise is not part of the language, so it is written in a comment.
+// Modules whose names are not valid function names are renamed (but
+// operators registered with such names cannot be read back).
+func (C Circuit) Expr() string {
+	order, err := C.ModuleOrder()
+	if err != nil {
+		return fmt.Sprintf("# %s\n", err)
+	}
+	names := make(map[string]string)
+	for _, name := range order {
+		if name == "" || exprFuncName(name) {
+			names[name] = name
+		}
+	}
+	for i, k := 0, 1; i < len(order); i++ {
+		if _, ok := names[order[i]]; ok {
+			continue
+		}
+		for ; ; k++ {
+			if newname := fmt.Sprintf("m%d", k); C.Modules[newname] == nil {
+				names[order[i]] = newname
+				k++
+				break
+			}
+		}
+	}
+	s := ""
+	if C.Seed != 0 {
+		s += fmt.Sprintf("# seed %d\n", C.Seed)
+	}
+	for _, name := range order {
+		if name != "" {
+			s += C.Modules[name].expr(&C, names) + "\n"
+		}
+	}
+	return s + C.Modules[""].expr(&C, names)
+}
+
+// Expr returns M in the expression language: a `def`, or the statements
+// of the main module. Nodes used more than once and calls to modules
+// with more than one output are assigned to variables (v1, v2, ...), and
+// the other nodes are written inline. Without the circuit, calls only
+// get variables for the outputs that are used.
+func (M Module) Expr() string {
+	return M.expr(nil, nil)
+}
+
+// exprFuncName tells whether name can be the name of a module in the
+// expression language.
+func exprFuncName(name string) bool {
+	if _, isOperator := OperatorInfo[name]; isOperator || name == "def" ||
+		utf8.RuneCountInString(name) < 2 {
+		return false
+	}
+	for i, r := range name {
+		if !isIdentRune(r, i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Precedences of expressions, for parentheses
+const (
+	precSum = iota + 1
+	precTerm
+	precUnary
+	precAtom
+)
+
+type exprPrinter struct {
+	C     *Circuit // to know the outputs of calls (can be nil)
+	M     Module
+	names map[string]string   // new names of the modules (if not nil)
+	vars  map[Argument]string // nodes (and inputs) assigned to variables
+	nvars int
+}
+
+// outputs returns the number of outputs of call n (the ones used if
+// the circuit is not known).
+func (p *exprPrinter) outputs(n int) int {
+	if p.C == nil {
+		return p.M.usedOutputs(n)
+	}
+	return p.C.numOutputs(&p.M, n)
+}
+
+func (p *exprPrinter) newVar() string {
+	p.nvars++
+	return fmt.Sprintf("v%d", p.nvars)
+}
+
+func (p *exprPrinter) funcName(name string) string {
+	if newname, ok := p.names[name]; ok {
+		return newname
+	}
+	return name
+}
+
+func exprNumber(v float64) (string, int) {
+	switch {
+	case math.IsNaN(v):
+		return "0 / 0", precTerm
+	case math.IsInf(v, 1):
+		return "1 / 0", precTerm
+	case math.IsInf(v, -1):
+		return "-1 / 0", precTerm
+	case math.Signbit(v):
+		return strconv.FormatFloat(v, 'g', -1, 64), precUnary
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64), precAtom
+}
+
+// operand writes a with parentheses if its precedence is lower than min.
+func (p *exprPrinter) operand(a Argument, min int) string {
+	s, prec := p.expr(a)
+	if prec < min {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// expr writes a, and returns its precedence.
+func (p *exprPrinter) expr(a Argument) (string, int) {
+	if v, ok := p.vars[a]; ok {
+		return v, precAtom
+	}
+	n := a.Node()
+	node := p.M.Nodes[n]
+	switch {
+	case p.M.isInput(n):
+		return node.Op, precAtom
+	case node.Op == "=":
+		return exprNumber(node.Value)
+	case p.M.isCall(n):
+		return p.call(n), precAtom
+	}
+	args := node.Args
+	switch node.Op {
+	case "-":
+		// `-a` is `- 0 a` (but `-1` is a constant)
+		zero := p.M.Nodes[args[0].Node()]
+		if zero.Op == "=" && math.Float64bits(zero.Value) == 0 &&
+			p.M.Nodes[args[1].Node()].Op != "=" {
+			return "-" + p.operand(args[1], precAtom), precUnary
+		}
+		fallthrough
+	case "+":
+		return p.operand(args[0], precSum) + " " + node.Op + " " + p.operand(args[1], precTerm), precSum
+	case "*", "/":
+		return p.operand(args[0], precTerm) + " " + node.Op + " " + p.operand(args[1], precUnary), precTerm
+	}
+	return p.call(n), precAtom
+}
+
+// call writes node n as a call.
+func (p *exprPrinter) call(n int) string {
+	node := p.M.Nodes[n]
+	args := make([]string, len(node.Args))
+	for i, a := range node.Args {
+		args[i], _ = p.expr(a)
+	}
+	name := node.Op
+	if p.M.isCall(n) {
+		name = p.funcName(name)
+	}
+	return name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (M Module) expr(C *Circuit, names map[string]string) string {
+	p := &exprPrinter{C: C, M: M, names: names, vars: make(map[Argument]string)}
+	uses := make([]int, len(M.Nodes))
+	used := make(map[Argument]bool)
+	for _, node := range M.Nodes {
+		for _, a := range node.Args {
+			uses[a.Node()]++
+			used[a] = true
+		}
+	}
+	for _, outp := range M.Outputs {
+		uses[outp.Idx]++
+		used[argument(outp.Idx, outp.Out)] = true
+	}
+
+	// Outputs are assigned at the end, and the ones that hide an input
+	// (like r in the main module) last of all. If more than one does, the
+	// inputs they hide are assigned to variables first.
+	outputs, hiding := []Port{}, []Port{}
+	for _, outp := range M.Outputs {
+		if k := M.inputIndex(outp.Name); k != -1 && M.Inputs[k].Idx != -1 {
+			hiding = append(hiding, outp)
+		} else {
+			outputs = append(outputs, outp)
+		}
+	}
+	stmts := []string{}
+	if len(hiding) > 1 {
+		for _, outp := range hiding {
+			inp := M.Inputs[M.inputIndex(outp.Name)]
+			v := p.newVar()
+			stmts = append(stmts, fmt.Sprintf("%s = %c", v, inp.Name))
+			p.vars[argument(inp.Idx, 0)] = v
+		}
+	}
+	for n := len(M.Nodes) - 1; n >= 0; n-- {
+		node := M.Nodes[n]
+		if M.isInput(n) || node.Op == "=" || uses[n] == 0 {
+			continue
+		}
+		if M.isCall(n) && p.outputs(n) > 1 {
+			call := p.call(n)
+			vars := make([]string, p.outputs(n))
+			for k := range vars {
+				vars[k] = "_"
+				if used[argument(n, k)] {
+					vars[k] = p.newVar()
+					p.vars[argument(n, k)] = vars[k]
+				}
+			}
+			stmts = append(stmts, strings.Join(vars, ", ")+" = "+call)
+		} else if uses[n] > 1 {
+			s, _ := p.expr(argument(n, 0))
+			v := p.newVar()
+			stmts = append(stmts, v+" = "+s)
+			p.vars[argument(n, 0)] = v
+		}
+	}
+	for _, outp := range append(outputs, hiding...) {
+		s, _ := p.expr(argument(outp.Idx, outp.Out))
+		stmts = append(stmts, fmt.Sprintf("%c = %s", outp.Name, s))
+	}
+
+	if M.Name == "" {
+		return strings.Join(stmts, "\n") + "\n"
+	}
+	inputs := make([]string, len(M.Inputs))
+	for i, inp := range M.Inputs {
+		inputs[i] = string(inp.Name)
+	}
+	outnames := make([]string, len(M.Outputs))
+	for i, outp := range M.Outputs {
+		outnames[i] = string(outp.Name)
+	}
+	return fmt.Sprintf("def %s(%s) -> %s {\n\t%s\n}\n", p.funcName(M.Name),
+		strings.Join(inputs, ", "), strings.Join(outnames, ", "), strings.Join(stmts, "\n\t"))
+}
@@ -0,0 +1,333 @@
+package evoimage
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GLSL ////////////////////////////////////////////////////
+
+// GLSL returns a fragment shader (GLSL ES 3.00, for WebGL 2) that
+// renders C, to preview circuits in a browser. Each module is a function
+// with `out` parameters for its outputs, each operator is a function
+// that computes the same as in Go, and the tables of the noise of
+// C.Seed are constants. The unit square is centered and fitted in the
+// canvas, like AspectFit in Render. The shader has two uniforms,
+// `resolution` (the size of the canvas in pixels) and `time` (the T
+// input), and writes `color`. GPUs compute with 32 bit floats, so the
+// image can differ slightly from Render. Circuits with operators that
+// have no GLSL code (see OpInfo) give an error.
+func (C Circuit) GLSL() (string, error) {
+	order, err := C.ModuleOrder()
+	if err != nil {
+		return "", err
+	}
+	w := &glslWriter{C: C, names: make(map[string]string)}
+	for i, name := range order {
+		w.names[name] = fmt.Sprintf("module%d", i+1)
+	}
+	w.names[""] = "circuit"
+
+	// Operators and helpers used
+	ops := []string{}
+	needed := make(map[string]bool)
+	for _, M := range C.Modules {
+		for n, node := range M.Nodes {
+			if M.isInput(n) || M.isCall(n) || node.Op == "=" || needed[node.Op] {
+				continue
+			}
+			code := OperatorInfo[node.Op].GLSL
+			if code == "" {
+				return "", fmt.Errorf("Operator `%s` has no GLSL code", node.Op)
+			}
+			needed[node.Op] = true
+			ops = append(ops, node.Op)
+			for _, h := range glslHelpers {
+				if strings.Contains(code, h.name+"(") {
+					glslNeed(h.name, needed)
+				}
+			}
+		}
+	}
+	sort.Strings(ops)
+
+	w.header()
+	if needed["tables"] {
+		w.tables()
+	}
+	for _, h := range glslHelpers {
+		if needed[h.name] {
+			fmt.Fprintf(&w.buf, "\n%s", h.code)
+		}
+	}
+	for _, name := range ops {
+		w.operator(name)
+	}
+	for _, name := range order {
+		w.module(C.Modules[name])
+	}
+	w.main()
+	return w.buf.String(), nil
+}
+
+// glslHelpers are functions used by the operators (which call them by
+// name), after the ones they use. The tables of the noise ("tables") are
+// written apart.
+var glslHelpers = []struct {
+	name, code string
+	needs      []string
+}{
+	{"perlin", `vec2 grad2d(int x, int y) {
+	return GRAD[((x & 255) + PERM[y & 255]) & 255];
+}
+
+float perlin(float x, float y) {
+	float x0 = floor(x), y0 = floor(y);
+	int ix = int(x0), iy = int(y0);
+	vec2 gS = grad2d(ix, iy), gT = grad2d(ix + 1, iy);
+	vec2 gU = grad2d(ix, iy + 1), gV = grad2d(ix + 1, iy + 1);
+	float dx = x - x0, dy = y - y0;
+	float dotS = gS.x * dx + gS.y * dy;
+	float dotT = gT.x * (dx - 1.0) + gT.y * dy;
+	float dotU = gU.x * dx + gU.y * (dy - 1.0);
+	float dotV = gV.x * (dx - 1.0) + gV.y * (dy - 1.0);
+	float sx = 3.0 * dx * dx - 2.0 * dx * dx * dx;
+	float a = dotS + sx * (dotT - dotS);
+	float b = dotU + sx * (dotV - dotU);
+	float sy = 3.0 * dy * dy - 2.0 * dy * dy * dy;
+	return a + sy * (b - a);
+}
+`, []string{"tables"}},
+	{"hash", `float hash(int x, int y, int k) {
+	int a = PERM[k & 255];
+	int b = PERM[(y + a) & 255];
+	int c = PERM[(x + b) & 255];
+	int d = PERM[(c + k + 1) & 255];
+	return (float(c) + float(d) / 256.0) / 256.0;
+}
+`, []string{"tables"}},
+	{"cellular", `// cellular returns the distance to the closest feature point and the
+// value of its cell.
+vec2 cellular(float x, float y) {
+	x *= 10.0;
+	y *= 10.0;
+	int cx = int(floor(x)), cy = int(floor(y));
+	float dist = uintBitsToFloat(0x7f800000u), value = 0.0;
+	for (int i = cx - 1; i <= cx + 1; i++) {
+		for (int j = cy - 1; j <= cy + 1; j++) {
+			float d = length(vec2(x - float(i) - hash(i, j, 0), y - float(j) - hash(i, j, 1)));
+			if (d < dist) {
+				dist = d;
+				value = hash(i, j, 2);
+			}
+		}
+	}
+	return vec2(dist, value);
+}
+`, []string{"hash"}},
+	{"expScale", `float expScale(float s) {
+	return exp2(4.0 * s - 2.0);
+}
+`, nil},
+	{"hsv", `float hsv(float n, float h, float s, float v) {
+	s = min(max(s, 0.0), 1.0);
+	v = min(max(v, 0.0), 1.0);
+	float k = mod(n + fract(h) * 6.0, 6.0);
+	return v - v * s * max(0.0, min(min(k, 4.0 - k), 1.0));
+}
+`, nil},
+	{"rotate", `vec2 rotate(float x, float y, float a) {
+	float s = sin(2.0 * PI * a), c = cos(2.0 * PI * a);
+	float dx = x - 0.5, dy = y - 0.5;
+	return vec2(0.5 + dx * c - dy * s, 0.5 + dx * s + dy * c);
+}
+`, nil},
+}
+
+func glslNeed(name string, needed map[string]bool) {
+	if needed[name] {
+		return
+	}
+	needed[name] = true
+	for _, h := range glslHelpers {
+		if h.name == name {
+			for _, n := range h.needs {
+				glslNeed(n, needed)
+			}
+		}
+	}
+}
+
+// glslFloat writes v as a GLSL float.
+func glslFloat(v float64) string {
+	f := float64(float32(v))
+	switch {
+	case math.IsNaN(f):
+		return "uintBitsToFloat(0x7fc00000u)"
+	case math.IsInf(f, 1):
+		return "uintBitsToFloat(0x7f800000u)"
+	case math.IsInf(f, -1):
+		return "uintBitsToFloat(0xff800000u)"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 32)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+type glslWriter struct {
+	C     Circuit
+	buf   bytes.Buffer
+	names map[string]string // functions of the modules
+}
+
+func (w *glslWriter) header() {
+	fmt.Fprintf(&w.buf, `#version 300 es
+// %s
+precision highp float;
+precision highp int;
+
+uniform vec2 resolution; // size of the canvas, in pixels
+uniform float time;      // the T input
+out vec4 color;
+
+const float PI = 3.141592653589793;
+const float E = 2.718281828459045;
+`, w.C)
+}
+
+// tables writes the permutation and the gradients of the noise.
+func (w *glslWriter) tables() {
+	noise := noiseFor(w.C.Seed)
+	perm, grad := noise.Permutation(), noise.Gradients()
+	fmt.Fprintf(&w.buf, "\n// Noise of seed %d\nconst int PERM[256] = int[256](", w.C.Seed)
+	for i, p := range perm {
+		if i%16 == 0 {
+			w.buf.WriteString("\n\t")
+		} else {
+			w.buf.WriteString(" ")
+		}
+		fmt.Fprintf(&w.buf, "%d", p)
+		if i < len(perm)-1 {
+			w.buf.WriteString(",")
+		}
+	}
+	w.buf.WriteString("\n);\nconst vec2 GRAD[256] = vec2[256](")
+	for i, g := range grad {
+		if i%4 == 0 {
+			w.buf.WriteString("\n\t")
+		} else {
+			w.buf.WriteString(" ")
+		}
+		fmt.Fprintf(&w.buf, "vec2(%s, %s)", glslFloat(g[0]), glslFloat(g[1]))
+		if i < len(grad)-1 {
+			w.buf.WriteString(",")
+		}
+	}
+	w.buf.WriteString("\n);\n")
+}
+
+// glslOperator is the name of the function of an operator.
+func glslOperator(name string) string {
+	return "op_" + opIdent(name)
+}
+
+func (w *glslWriter) operator(name string) {
+	info := OperatorInfo[name]
+	params := make([]string, info.Nargs)
+	for i := range params {
+		params[i] = fmt.Sprintf("float %c", 'a'+i)
+	}
+	body := strings.Replace(info.GLSL, "\n", "\n\t", -1)
+	fmt.Fprintf(&w.buf, "\nfloat %s(%s) {\n\t%s\n}\n", glslOperator(name), strings.Join(params, ", "), body)
+}
+
+// arg returns the GLSL of argument a of M.
+func (w *glslWriter) arg(M *Module, a Argument) string {
+	n := a.Node()
+	node := M.Nodes[n]
+	for i, inp := range M.Inputs {
+		if inp.Idx == n {
+			return fmt.Sprintf("i%d", i)
+		}
+	}
+	switch {
+	case node.Op == "=":
+		return glslFloat(node.Value)
+	case M.isCall(n):
+		return fmt.Sprintf("n%d_%d", n, a.Output())
+	}
+	return fmt.Sprintf("n%d", n)
+}
+
+// module writes M as a function with the inputs (i0, i1, ...) and the
+// outputs (o0, o1, ...) as parameters. Nodes are variables (n0, n1,
+// ...), and calls have a variable per output (n3_0, n3_1, ...).
+func (w *glslWriter) module(M *Module) {
+	params := []string{}
+	for i := range M.Inputs {
+		params = append(params, fmt.Sprintf("float i%d", i))
+	}
+	for i := range M.Outputs {
+		params = append(params, fmt.Sprintf("out float o%d", i))
+	}
+	fmt.Fprintf(&w.buf, "\n// %s\nvoid %s(%s) {\n", M, w.names[M.Name], strings.Join(params, ", "))
+	for n := len(M.Nodes) - 1; n >= 0; n-- {
+		node := M.Nodes[n]
+		if M.isInput(n) || node.Op == "=" {
+			continue
+		}
+		args := make([]string, len(node.Args))
+		for i, a := range node.Args {
+			args[i] = w.arg(M, a)
+		}
+		if M.isCall(n) {
+			outs := make([]string, w.C.numOutputs(M, n))
+			for k := range outs {
+				outs[k] = fmt.Sprintf("n%d_%d", n, k)
+			}
+			fmt.Fprintf(&w.buf, "\tfloat %s;\n", strings.Join(outs, ", "))
+			fmt.Fprintf(&w.buf, "\t%s(%s);\n", w.names[node.Op], strings.Join(append(args, outs...), ", "))
+			continue
+		}
+		fmt.Fprintf(&w.buf, "\tfloat n%d = %s(%s);\n", n, glslOperator(node.Op), strings.Join(args, ", "))
+	}
+	for i, outp := range M.Outputs {
+		fmt.Fprintf(&w.buf, "\to%d = %s;\n", i, w.arg(M, argument(outp.Idx, outp.Out)))
+	}
+	w.buf.WriteString("}\n")
+}
+
+// glslInputs are the GLSL of the pixel inputs, at point p.
+var glslInputs = map[rune]string{
+	'x': "p.x",
+	'y': "p.y",
+	'r': "length(p - 0.5)",
+	't': "atan(p.y - 0.5, p.x - 0.5) / (2.0 * PI) + 0.5",
+	'T': "time",
+}
+
+func (w *glslWriter) main() {
+	args := []string{}
+	for _, inp := range w.C.Modules[""].Inputs {
+		args = append(args, glslInputs[inp.Name])
+	}
+	args = append(args, "red", "green", "blue")
+	fmt.Fprintf(&w.buf, `
+void main() {
+	// The unit square, centered and fitted in the canvas (y goes down)
+	vec2 size = resolution.x > resolution.y ?
+		vec2(resolution.x / resolution.y, 1.0) : vec2(1.0, resolution.y / resolution.x);
+	vec2 pixel = vec2(gl_FragCoord.x, resolution.y - gl_FragCoord.y);
+	vec2 p = 0.5 - size / 2.0 + size * pixel / resolution;
+	float red, green, blue;
+	circuit(%s);
+	color = vec4(clamp(vec3(red, green, blue), 0.0, 1.0), 1.0);
+}
+`, strings.Join(args, ", "))
+}
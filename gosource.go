@@ -0,0 +1,379 @@
+package evoimage
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Go source ///////////////////////////////////////////////
+
+// GoSource returns a Go source file of package pkg with a function
+//
+//	func name(x, y, r, t float64) (float64, float64, float64)
+//
+// that computes the color (r, g, b) of a point like C.Eval, to bake a
+// circuit into a program that doesn't need this package (or to make it
+// faster). If C has the time input, the function also has a T
+// parameter. Modules are functions, nodes are local variables and the
+// operators (and the noise of C.Seed) are copied into the file, with
+// names that start like name (so that a package can have several
+// circuits). Circuits with operators that have no Go code (see OpInfo)
+// give an error.
+func (C Circuit) GoSource(pkg, name string) ([]byte, error) {
+	if !token.IsIdentifier(pkg) || !token.IsIdentifier(name) {
+		return nil, fmt.Errorf("Wrong package or function name (`%s`, `%s`)", pkg, name)
+	}
+	order, err := C.ModuleOrder()
+	if err != nil {
+		return nil, err
+	}
+	r, size := utf8.DecodeRuneInString(name)
+	w := &goWriter{C: C, prefix: string(unicode.ToLower(r)) + name[size:]}
+	w.names = map[string]string{"": name}
+	for i, mod := range order {
+		if mod != "" {
+			w.names[mod] = fmt.Sprintf("%sModule%d", w.prefix, i+1)
+		}
+	}
+
+	// Operators and helpers used
+	ops := []string{}
+	needed := make(map[string]bool)
+	for _, M := range C.Modules {
+		for n, node := range M.Nodes {
+			if M.isInput(n) || M.isCall(n) || node.Op == "=" || needed["op "+node.Op] {
+				continue
+			}
+			code := OperatorInfo[node.Op].Go
+			if code == "" {
+				return nil, fmt.Errorf("Operator `%s` has no Go code", node.Op)
+			}
+			needed["op "+node.Op] = true
+			ops = append(ops, node.Op)
+			for _, h := range goHelpers {
+				if strings.Contains(code, "$"+upperFirst(h.name)+"(") {
+					goNeed(h.name, needed)
+				}
+			}
+		}
+	}
+	sort.Strings(ops)
+
+	for i := len(order) - 1; i >= 0; i-- {
+		w.module(C.Modules[order[i]])
+	}
+	for _, op := range ops {
+		w.operator(op)
+	}
+	for _, h := range goHelpers {
+		if needed[h.name] {
+			w.buf.WriteString("\n" + strings.Replace(h.code, "$", w.prefix, -1))
+		}
+	}
+	if needed["tables"] {
+		w.tables()
+	}
+
+	var file bytes.Buffer
+	fmt.Fprintf(&file, "// Code generated by evoimage. DO NOT EDIT.\n\npackage %s\n", pkg)
+	if bytes.Contains(w.buf.Bytes(), []byte("math.")) {
+		file.WriteString("\nimport \"math\"\n")
+	}
+	file.Write(w.buf.Bytes())
+	return format.Source(file.Bytes())
+}
+
+// goHelpers are functions used by the operators (copies of the ones of
+// this package and of package perlin), which call them as `$` followed
+// by the name in upper case. The tables of the noise ("tables") are
+// written apart.
+var goHelpers = []struct {
+	name, code string
+	needs      []string
+}{
+	{"bool", `func $Bool(b bool) float64 {
+	if b {
+		return 1.0
+	}
+	return 0.0
+}
+`, nil},
+	{"clamp", `func $Clamp(x, lo, hi float64) float64 {
+	return math.Min(math.Max(x, lo), hi)
+}
+`, nil},
+	{"fract", `func $Fract(x float64) float64 {
+	return x - math.Floor(x)
+}
+`, nil},
+	{"expScale", `func $ExpScale(s float64) float64 {
+	return math.Pow(2, 4*s-2)
+}
+`, nil},
+	{"smoothstep", `func $Smoothstep(e0, e1, x float64) float64 {
+	if e0 == e1 {
+		return $Bool(x >= e0)
+	}
+	t := $Clamp((x-e0)/(e1-e0), 0, 1)
+	return t * t * (3 - 2*t)
+}
+`, []string{"bool", "clamp"}},
+	{"hsv", `func $Hsv(n, h, s, v float64) float64 {
+	s, v = $Clamp(s, 0, 1), $Clamp(v, 0, 1)
+	k := math.Mod(n+$Fract(h)*6, 6)
+	return v - v*s*math.Max(0, math.Min(math.Min(k, 4-k), 1))
+}
+`, []string{"clamp", "fract"}},
+	{"rotate", `func $Rotate(x, y, a float64) (float64, float64) {
+	sin, cos := math.Sincos(2 * math.Pi * a)
+	dx, dy := x-.5, y-.5
+	return .5 + dx*cos - dy*sin, .5 + dx*sin + dy*cos
+}
+`, nil},
+	{"perlin", `func $Floor(n float64) float64 {
+	if n >= 0 {
+		return float64(int32(n))
+	}
+	return float64(int32(n) - 1)
+}
+
+func $Grad(x, y int) *[2]float64 {
+	return &$Gradients[(x&0xff+$Permutation[y&0xff])&0xff]
+}
+
+func $Perlin(x, y float64) float64 {
+	x0 := $Floor(x)
+	y0 := $Floor(y)
+	x1 := x0 + 1
+	y1 := y0 + 1
+	gradS := $Grad(int(x0), int(y0))
+	gradT := $Grad(int(x1), int(y0))
+	gradU := $Grad(int(x0), int(y1))
+	gradV := $Grad(int(x1), int(y1))
+	dotS := gradS[0]*(x-x0) + gradS[1]*(y-y0)
+	dotT := gradT[0]*(x-x1) + gradT[1]*(y-y0)
+	dotU := gradU[0]*(x-x0) + gradU[1]*(y-y1)
+	dotV := gradV[0]*(x-x1) + gradV[1]*(y-y1)
+	dx := x - x0
+	sx := 3*dx*dx - 2*dx*dx*dx
+	a := dotS + sx*(dotT-dotS)
+	b := dotU + sx*(dotV-dotU)
+	dy := y - y0
+	sy := 3*dy*dy - 2*dy*dy*dy
+	return a + sy*(b-a)
+}
+`, []string{"tables"}},
+	{"fbm", `func $Fbm(x, y float64) float64 {
+	sum, amp, freq, total := 0.0, 1.0, 10.0, 0.0
+	for i := 0; i < ` + strconv.Itoa(fbmOctaves) + `; i++ {
+		sum += amp * $Perlin(freq*x, freq*y)
+		total += amp
+		amp, freq = amp/2, freq*2
+	}
+	return .5 + sum/total
+}
+`, []string{"perlin"}},
+	{"hash", `func $Hash(x, y, k int) float64 {
+	a := $Permutation[k&0xff]
+	b := $Permutation[(y+a)&0xff]
+	c := $Permutation[(x+b)&0xff]
+	d := $Permutation[(c+k+1)&0xff]
+	return (float64(c) + float64(d)/256) / 256
+}
+`, []string{"tables"}},
+	{"cellular", `func $Cellular(x, y float64) (dist, value float64) {
+	x, y = 10*x, 10*y
+	cx, cy := int(math.Floor(x)), int(math.Floor(y))
+	dist = math.Inf(1)
+	for i := cx - 1; i <= cx+1; i++ {
+		for j := cy - 1; j <= cy+1; j++ {
+			px := float64(i) + $Hash(i, j, 0)
+			py := float64(j) + $Hash(i, j, 1)
+			if d := math.Hypot(x-px, y-py); d < dist {
+				dist, value = d, $Hash(i, j, 2)
+			}
+		}
+	}
+	return
+}
+`, []string{"hash"}},
+}
+
+func goNeed(name string, needed map[string]bool) {
+	if needed[name] {
+		return
+	}
+	needed[name] = true
+	for _, h := range goHelpers {
+		if h.name == name {
+			for _, n := range h.needs {
+				goNeed(n, needed)
+			}
+		}
+	}
+}
+
+// goFloat writes v as a Go float64 (exactly).
+func goFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "math.NaN()"
+	case math.IsInf(v, 0):
+		return fmt.Sprintf("math.Inf(%d)", int(math.Copysign(1, v)))
+	case v == 0 && math.Signbit(v):
+		return "math.Copysign(0, -1)"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type goWriter struct {
+	C      Circuit
+	buf    bytes.Buffer
+	prefix string            // of the names of operators and helpers
+	names  map[string]string // functions of the modules
+}
+
+// tables writes the permutation and the gradients of the noise.
+func (w *goWriter) tables() {
+	noise := noiseFor(w.C.Seed)
+	fmt.Fprintf(&w.buf, "\n// Noise of seed %d\nvar %sPermutation = [256]int{", w.C.Seed, w.prefix)
+	for i, p := range noise.Permutation() {
+		if i%16 == 0 {
+			w.buf.WriteString("\n")
+		}
+		fmt.Fprintf(&w.buf, "%d, ", p)
+	}
+	fmt.Fprintf(&w.buf, "\n}\n\nvar %sGradients = [256][2]float64{", w.prefix)
+	for i, g := range noise.Gradients() {
+		if i%2 == 0 {
+			w.buf.WriteString("\n")
+		}
+		fmt.Fprintf(&w.buf, "{%s, %s}, ", goFloat(g[0]), goFloat(g[1]))
+	}
+	w.buf.WriteString("\n}\n")
+}
+
+// operatorName is the name of the function of an operator.
+func (w *goWriter) operatorName(name string) string {
+	return w.prefix + "Op" + upperFirst(opIdent(name))
+}
+
+func (w *goWriter) operator(name string) {
+	info := OperatorInfo[name]
+	params := make([]string, info.Nargs)
+	for i := range params {
+		params[i] = string('a' + rune(i))
+	}
+	fmt.Fprintf(&w.buf, "\nfunc %s(%s float64) float64 {\n%s\n}\n", w.operatorName(name),
+		strings.Join(params, ", "), strings.Replace(info.Go, "$", w.prefix, -1))
+}
+
+// arg returns the Go of argument a of M.
+func (w *goWriter) arg(M *Module, a Argument) string {
+	n := a.Node()
+	node := M.Nodes[n]
+	switch {
+	case M.isInput(n):
+		return node.Op
+	case node.Op == "=":
+		return goFloat(node.Value)
+	case M.isCall(n) && w.C.numOutputs(M, n) > 1:
+		return fmt.Sprintf("n%d_%d", n, a.Output())
+	}
+	return fmt.Sprintf("n%d", n)
+}
+
+// module writes M as a function, with a local variable per node (n0,
+// n1, ...) and per output of calls to modules with more than one output
+// (n3_0, n3_1, ...). Nodes that the outputs don't use are left out.
+func (w *goWriter) module(M *Module) {
+	used := make(map[Argument]bool)
+	for _, outp := range M.Outputs {
+		used[argument(outp.Idx, outp.Out)] = true
+	}
+	for n := 0; n < len(M.Nodes); n++ {
+		if anyOutputUsed(used, n) {
+			for _, a := range M.Nodes[n].Args {
+				used[a] = true
+			}
+		}
+	}
+
+	results := make([]string, len(M.Outputs))
+	for i := range results {
+		results[i] = "float64"
+	}
+	if M.Name == "" {
+		params, time := "x, y, r, t float64", ""
+		if M.inputIndex('T') != -1 {
+			params, time = "x, y, r, t, T float64", " at time T"
+		}
+		fmt.Fprintf(&w.buf, "\n// %s computes the color (r, g, b) of the point (x, y), with polar\n", w.names[""])
+		fmt.Fprintf(&w.buf, "// coordinates (r, t),%s of the circuit\n//\n//\t%s\n", time, w.C)
+		fmt.Fprintf(&w.buf, "func %s(%s) (%s) {\n", w.names[""], params, strings.Join(results, ", "))
+	} else {
+		params := make([]string, len(M.Inputs))
+		for i, inp := range M.Inputs {
+			params[i] = string(inp.Name)
+		}
+		sparams := ""
+		if len(params) > 0 {
+			sparams = strings.Join(params, ", ") + " float64"
+		}
+		fmt.Fprintf(&w.buf, "\n// %s is the module %s\nfunc %s(%s) (%s) {\n",
+			w.names[M.Name], M, w.names[M.Name], sparams, strings.Join(results, ", "))
+	}
+
+	for n := len(M.Nodes) - 1; n >= 0; n-- {
+		node := M.Nodes[n]
+		if M.isInput(n) || node.Op == "=" || !anyOutputUsed(used, n) {
+			continue
+		}
+		args := make([]string, len(node.Args))
+		for i, a := range node.Args {
+			args[i] = w.arg(M, a)
+		}
+		call := fmt.Sprintf("%s(%s)", w.names[node.Op], strings.Join(args, ", "))
+		if !M.isCall(n) {
+			call = fmt.Sprintf("%s(%s)", w.operatorName(node.Op), strings.Join(args, ", "))
+		}
+		vars := []string{fmt.Sprintf("n%d", n)}
+		if M.isCall(n) && w.C.numOutputs(M, n) > 1 {
+			vars = make([]string, w.C.numOutputs(M, n))
+			for k := range vars {
+				vars[k] = "_"
+				if used[argument(n, k)] {
+					vars[k] = fmt.Sprintf("n%d_%d", n, k)
+				}
+			}
+		}
+		fmt.Fprintf(&w.buf, "%s := %s\n", strings.Join(vars, ", "), call)
+	}
+	outputs := make([]string, len(M.Outputs))
+	for i, outp := range M.Outputs {
+		outputs[i] = w.arg(M, argument(outp.Idx, outp.Out))
+	}
+	fmt.Fprintf(&w.buf, "return %s\n}\n", strings.Join(outputs, ", "))
+}
+
+func upperFirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+func anyOutputUsed(used map[Argument]bool, n int) bool {
+	for k := 0; k < MAX_ARGS; k++ {
+		if used[argument(n, k)] {
+			return true
+		}
+	}
+	return false
+}
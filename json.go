@@ -0,0 +1,239 @@
+package evoimage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// JSON ////////////////////////////////////////////////////
+
+// Circuits can also be written in JSON, for programs that would rather
+// not parse the string format. A circuit is an object with its metadata
+// (all optional), its seed and its modules (main first, then sorted by
+// name):
+//
+//	{
+//	  "name": "sunset",
+//	  "author": "pauek",
+//	  "parents": ["(rgb)(xy)[...]"],
+//	  "seed": 3,
+//	  "modules": [
+//	    {
+//	      "name": "",
+//	      "inputs": [{"name": "x", "node": 2}, {"name": "y", "node": 3}],
+//	      "outputs": [{"name": "r", "node": 0}, {"name": "g", "node": 1}, {"name": "b", "node": 1}],
+//	      "nodes": [
+//	        {"op": "+", "args": [{"node": 2}, {"node": 4}]},
+//	        {"op": "sin", "args": [{"node": 3}]},
+//	        {"op": "x"},
+//	        {"op": "y"},
+//	        {"op": "=", "value": 0.5}
+//	      ]
+//	    }
+//	  ]
+//	}
+//
+// Arguments and ports refer to nodes by index, and "output" is the
+// output of the node (for calls; it is omitted if it is 0). Input nodes
+// have the name of the input as "op", and calls the name of the module.
+// Constants have a "value". The "node" of inputs is ignored when
+// reading (inputs that are not used have node -1). Reading a circuit
+// checks it like Read.
+
+// Metadata describes a circuit. It is not part of the string format.
+type Metadata struct {
+	Name    string   `json:"name,omitempty"`
+	Author  string   `json:"author,omitempty"`
+	Parents []string `json:"parents,omitempty"` // the parents, as strings or hashes
+}
+
+func (A Argument) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonArgument{Node: A.Node(), Output: A.Output()})
+}
+
+func (A *Argument) UnmarshalJSON(data []byte) error {
+	var a jsonArgument
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+	if a.Node < 0 || a.Output < 0 || a.Output >= MAX_ARGS {
+		return fmt.Errorf("Wrong argument (node %d, output %d)", a.Node, a.Output)
+	}
+	*A = argument(a.Node, a.Output)
+	return nil
+}
+
+type jsonArgument struct {
+	Node   int `json:"node"`
+	Output int `json:"output,omitempty"`
+}
+
+type jsonPort struct {
+	Name   string `json:"name"`
+	Node   int    `json:"node"`
+	Output int    `json:"output,omitempty"`
+}
+
+func (P Port) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonPort{Name: string(P.Name), Node: P.Idx, Output: P.Out})
+}
+
+func (P *Port) UnmarshalJSON(data []byte) error {
+	var p jsonPort
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	name := []rune(p.Name)
+	if len(name) != 1 || !unicode.IsLetter(name[0]) {
+		return fmt.Errorf("Wrong port name `%s`", p.Name)
+	}
+	if p.Output < 0 || p.Output >= MAX_ARGS {
+		return fmt.Errorf("Wrong output %d in port `%s`", p.Output, p.Name)
+	}
+	*P = Port{Name: name[0], Idx: p.Node, Out: p.Output}
+	return nil
+}
+
+type jsonNode struct {
+	Op    string     `json:"op"`
+	Args  []Argument `json:"args,omitempty"`
+	Value *float64   `json:"value,omitempty"`
+}
+
+func (N Node) MarshalJSON() ([]byte, error) {
+	node := jsonNode{Op: N.Op, Args: N.Args}
+	if N.Op == "=" {
+		node.Value = &N.Value
+	}
+	return json.Marshal(node)
+}
+
+func (N *Node) UnmarshalJSON(data []byte) error {
+	var node jsonNode
+	if err := json.Unmarshal(data, &node); err != nil {
+		return err
+	}
+	if node.Op != "=" && !validName(node.Op) {
+		return fmt.Errorf("Wrong op `%s`", node.Op)
+	}
+	*N = Node{Op: node.Op, Args: node.Args}
+	if node.Op == "=" {
+		if node.Value == nil || len(node.Args) > 0 {
+			return fmt.Errorf("Constants must have a value (and no args)")
+		}
+		N.Value = *node.Value
+	} else if node.Value != nil {
+		return fmt.Errorf("Only constants have a value (op `%s`)", node.Op)
+	}
+	return nil
+}
+
+// validName tells whether s can be the name of an operator, module or
+// input in the string format.
+func validName(s string) bool {
+	return s != "" && !strings.ContainsAny(s, reservedChars) &&
+		strings.IndexFunc(s, unicode.IsSpace) == -1
+}
+
+type jsonModule struct {
+	Name    string  `json:"name"`
+	Inputs  []Port  `json:"inputs"`
+	Outputs []Port  `json:"outputs"`
+	Nodes   []*Node `json:"nodes"`
+}
+
+func (M Module) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonModule{
+		Name:    M.Name,
+		Inputs:  M.Inputs,
+		Outputs: M.Outputs,
+		Nodes:   M.Nodes,
+	})
+}
+
+// UnmarshalJSON reads a module and checks it like the string format
+// (but it doesn't know the other modules, so calls are not checked).
+func (M *Module) UnmarshalJSON(data []byte) error {
+	var m jsonModule
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	if m.Name != "" && !validName(m.Name) {
+		return fmt.Errorf("Wrong module name `%s`", m.Name)
+	}
+	for i, node := range m.Nodes {
+		if node == nil {
+			return fmt.Errorf("Node %d of module `%s` is null", i, m.Name)
+		}
+		for _, arg := range node.Args {
+			if arg.Node() >= len(m.Nodes) {
+				return fmt.Errorf("Error in node %d of module `%s`: nonexistent node %d",
+					i, m.Name, arg.Node())
+			}
+		}
+	}
+	for _, outp := range m.Outputs {
+		if outp.Idx < 0 || outp.Idx >= len(m.Nodes) {
+			return fmt.Errorf("Output `%c` of module `%s`: nonexistent node %d",
+				outp.Name, m.Name, outp.Idx)
+		}
+	}
+	// Go through the string format, which sorts and checks the nodes
+	mod, err := readModule(Module{
+		Name:    m.Name,
+		Inputs:  m.Inputs,
+		Outputs: m.Outputs,
+		Nodes:   m.Nodes,
+	}.String())
+	if err != nil {
+		return err
+	}
+	*M = *mod
+	return nil
+}
+
+type jsonCircuit struct {
+	Metadata
+	Seed    int64     `json:"seed,omitempty"`
+	Modules []*Module `json:"modules"`
+}
+
+func (C Circuit) MarshalJSON() ([]byte, error) {
+	c := jsonCircuit{Metadata: C.Meta, Seed: C.Seed}
+	names := make([]string, 0, len(C.Modules))
+	for name := range C.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.Modules = append(c.Modules, C.Modules[name])
+	}
+	return json.Marshal(c)
+}
+
+func (C *Circuit) UnmarshalJSON(data []byte) error {
+	var c jsonCircuit
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	smodules := []string{}
+	for i, mod := range c.Modules {
+		if mod == nil {
+			return fmt.Errorf("Module %d is null", i)
+		}
+		smodules = append(smodules, mod.String())
+	}
+	if c.Seed != 0 {
+		smodules = append(smodules, fmt.Sprintf("@%d", c.Seed))
+	}
+	D, err := Read(strings.Join(smodules, ";"))
+	if err != nil {
+		return err
+	}
+	D.Meta = c.Metadata
+	*C = D
+	return nil
+}
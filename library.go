@@ -0,0 +1,250 @@
+package evoimage
+
+import (
+	"go-evoimage/perlin"
+	"math"
+	"strconv"
+)
+
+// Operator library ////////////////////////////////////////
+
+// More operators, for math, geometry and color. They are registered
+// like any other operator, with lower weights than the built-in ones so
+// that random circuits are not dominated by them. Coordinates are in
+// [0, 1] and centered at (.5, .5), like the x and y inputs.
+
+func clamp(x, lo, hi float64) float64 {
+	return math.Min(math.Max(x, lo), hi)
+}
+
+func fract(x float64) float64 {
+	return x - math.Floor(x)
+}
+
+// expScale maps [0, 1] to factors from 1/4 to 4 (1 at .5).
+func expScale(s float64) float64 {
+	return math.Pow(2, 4*s-2)
+}
+
+func smoothstep(e0, e1, x float64) float64 {
+	if e0 == e1 {
+		return boolean(x >= e0)
+	}
+	t := clamp((x-e0)/(e1-e0), 0, 1)
+	return t * t * (3 - 2*t)
+}
+
+// hsv returns channel n (5 for red, 3 for green, 1 for blue) of the
+// color with hue h, saturation s and value v.
+func hsv(n, h, s, v float64) float64 {
+	s, v = clamp(s, 0, 1), clamp(v, 0, 1)
+	k := math.Mod(n+fract(h)*6, 6)
+	return v - v*s*math.Max(0, math.Min(math.Min(k, 4-k), 1))
+}
+
+// rotate rotates (x, y) around the center by a turns.
+func rotate(x, y, a float64) (float64, float64) {
+	sin, cos := math.Sincos(2 * math.Pi * a)
+	dx, dy := x-.5, y-.5
+	return .5 + dx*cos - dy*sin, .5 + dx*sin + dy*cos
+}
+
+const fbmOctaves = 4
+
+func fbm(noise *perlin.PerlinNoise, x, y float64) float64 {
+	sum, amp, freq, total := 0.0, 1.0, 10.0, 0.0
+	for i := 0; i < fbmOctaves; i++ {
+		sum += amp * noise.At2d(freq*x, freq*y)
+		total += amp
+		amp, freq = amp/2, freq*2
+	}
+	return .5 + sum/total
+}
+
+// cellular returns the distance from (x, y) to the closest feature
+// point (one per cell of a grid of 10x10 cells per unit) and a random
+// value of the cell of that point.
+func cellular(noise *perlin.PerlinNoise, x, y float64) (dist, value float64) {
+	x, y = 10*x, 10*y
+	cx, cy := int(math.Floor(x)), int(math.Floor(y))
+	dist = math.Inf(1)
+	for i := cx - 1; i <= cx+1; i++ {
+		for j := cy - 1; j <= cy+1; j++ {
+			px := float64(i) + noise.Hash(i, j, 0)
+			py := float64(j) + noise.Hash(i, j, 1)
+			if d := math.Hypot(x-px, y-py); d < dist {
+				dist, value = d, noise.Hash(i, j, 2)
+			}
+		}
+	}
+	return
+}
+
+func registerLibrary() {
+	library := []struct {
+		name string
+		op   Operator
+	}{
+		{"abs", Unary{OpInfo{
+			Weight: .5,
+			GLSL:   "return abs(a);",
+			Go:     "return math.Abs(a)",
+		}, math.Abs}},
+		{"exp", Unary{OpInfo{
+			Weight: .5,
+			GLSL:   "return (exp(a) - 1.0) / (E - 1.0);",
+			Go:     "return (math.Exp(a) - 1) / (math.E - 1)",
+		}, func(a float64) float64 {
+			return (math.Exp(a) - 1) / (math.E - 1)
+		}}},
+		{"log", Unary{OpInfo{
+			Weight: .5,
+			GLSL:   "return log(1.0 + (E - 1.0) * abs(a));",
+			Go:     "return math.Log(1 + (math.E-1)*math.Abs(a))",
+		}, func(a float64) float64 {
+			return math.Log(1 + (math.E-1)*math.Abs(a))
+		}}},
+		{"fract", Unary{OpInfo{
+			Periodic: true, Weight: .5,
+			GLSL: "return a - floor(a);",
+			Go:   "return $Fract(a)",
+		}, fract}},
+		{"gaussian", Unary{OpInfo{
+			Weight: .5,
+			GLSL:   "float d = 4.0 * (a - 0.5);\nreturn exp(-d * d);",
+			Go:     "d := 4 * (a - .5)\nreturn math.Exp(-d * d)",
+		}, func(a float64) float64 {
+			d := 4 * (a - .5)
+			return math.Exp(-d * d)
+		}}},
+		{"pow", Binary{OpInfo{
+			Weight: .5,
+			GLSL:   "return pow(abs(a), expScale(b));",
+			Go:     "return math.Pow(math.Abs(a), $ExpScale(b))",
+		}, func(a, b float64) float64 {
+			return math.Pow(math.Abs(a), expScale(b))
+		}}},
+		{"atan2", Binary{OpInfo{
+			Weight: .5,
+			GLSL:   "return atan(b - 0.5, a - 0.5) / (2.0 * PI) + 0.5;",
+			Go:     "return math.Atan2(b-.5, a-.5)/(2*math.Pi) + .5",
+		}, func(x, y float64) float64 {
+			return math.Atan2(y-.5, x-.5)/(2*math.Pi) + .5
+		}}},
+		{"mod", Binary{OpInfo{
+			Weight: .5,
+			GLSL:   "return b == 0.0 ? 0.0 : a - b * floor(a / b);",
+			Go: `if b == 0 {
+	return 0
+}
+return a - b*math.Floor(a/b)`,
+		}, func(a, b float64) float64 {
+			if b == 0 {
+				return 0
+			}
+			return a - b*math.Floor(a/b)
+		}}},
+		{"scale", Binary{OpInfo{
+			Weight: .5,
+			GLSL:   "return 0.5 + (a - 0.5) * expScale(b);",
+			Go:     "return .5 + (a-.5)*$ExpScale(b)",
+		}, func(a, s float64) float64 {
+			return .5 + (a-.5)*expScale(s)
+		}}},
+		{"fbm", OperatorFunc{OpInfo{
+			Nargs: 2, Noise: true, Weight: .5,
+			GLSL: `float sum = 0.0, amp = 1.0, freq = 10.0, total = 0.0;
+for (int i = 0; i < ` + strconv.Itoa(fbmOctaves) + `; i++) {
+	sum += amp * perlin(freq * a, freq * b);
+	total += amp;
+	amp /= 2.0;
+	freq *= 2.0;
+}
+return 0.5 + sum / total;`,
+			Go: "return $Fbm(a, b)",
+		}, func(args []float64, noise *perlin.PerlinNoise) float64 {
+			return fbm(noise, args[0], args[1])
+		}}},
+		{"worley", OperatorFunc{OpInfo{
+			Nargs: 2, Noise: true, Weight: .5,
+			GLSL: "return min(cellular(a, b).x, 1.0);",
+			Go:   "dist, _ := $Cellular(a, b)\nreturn math.Min(dist, 1)",
+		}, func(args []float64, noise *perlin.PerlinNoise) float64 {
+			dist, _ := cellular(noise, args[0], args[1])
+			return math.Min(dist, 1)
+		}}},
+		{"voronoi", OperatorFunc{OpInfo{
+			Nargs: 2, Noise: true, Weight: .5,
+			GLSL: "return cellular(a, b).y;",
+			Go:   "_, value := $Cellular(a, b)\nreturn value",
+		}, func(args []float64, noise *perlin.PerlinNoise) float64 {
+			_, value := cellular(noise, args[0], args[1])
+			return value
+		}}},
+		{"smoothstep", OperatorFunc{OpInfo{
+			Nargs: 3, Weight: .5,
+			GLSL: `if (a == b) {
+	return c >= a ? 1.0 : 0.0;
+}
+float t = min(max((c - a) / (b - a), 0.0), 1.0);
+return t * t * (3.0 - 2.0 * t);`,
+			Go: "return $Smoothstep(a, b, c)",
+		}, func(args []float64, _ *perlin.PerlinNoise) float64 {
+			return smoothstep(args[0], args[1], args[2])
+		}}},
+		{"clamp", OperatorFunc{OpInfo{
+			Nargs: 3, Weight: .5,
+			GLSL: "return min(max(a, b), c);",
+			Go:   "return $Clamp(a, b, c)",
+		}, func(args []float64, _ *perlin.PerlinNoise) float64 {
+			return clamp(args[0], args[1], args[2])
+		}}},
+		{"rotx", OperatorFunc{OpInfo{
+			Nargs: 3, Weight: .5,
+			GLSL: "return rotate(a, b, c).x;",
+			Go:   "x, _ := $Rotate(a, b, c)\nreturn x",
+		}, func(args []float64, _ *perlin.PerlinNoise) float64 {
+			x, _ := rotate(args[0], args[1], args[2])
+			return x
+		}}},
+		{"roty", OperatorFunc{OpInfo{
+			Nargs: 3, Weight: .5,
+			GLSL: "return rotate(a, b, c).y;",
+			Go:   "_, y := $Rotate(a, b, c)\nreturn y",
+		}, func(args []float64, _ *perlin.PerlinNoise) float64 {
+			_, y := rotate(args[0], args[1], args[2])
+			return y
+		}}},
+		{"hsvr", OperatorFunc{OpInfo{
+			Nargs: 3, Weight: .3,
+			GLSL: "return hsv(5.0, a, b, c);",
+			Go:   "return $Hsv(5, a, b, c)",
+		}, func(args []float64, _ *perlin.PerlinNoise) float64 {
+			return hsv(5, args[0], args[1], args[2])
+		}}},
+		{"hsvg", OperatorFunc{OpInfo{
+			Nargs: 3, Weight: .3,
+			GLSL: "return hsv(3.0, a, b, c);",
+			Go:   "return $Hsv(3, a, b, c)",
+		}, func(args []float64, _ *perlin.PerlinNoise) float64 {
+			return hsv(3, args[0], args[1], args[2])
+		}}},
+		{"hsvb", OperatorFunc{OpInfo{
+			Nargs: 3, Weight: .3,
+			GLSL: "return hsv(1.0, a, b, c);",
+			Go:   "return $Hsv(1, a, b, c)",
+		}, func(args []float64, _ *perlin.PerlinNoise) float64 {
+			return hsv(1, args[0], args[1], args[2])
+		}}},
+		{"dist", OperatorFunc{OpInfo{
+			Nargs: 4, Weight: .5,
+			GLSL: "return length(vec2(a - c, b - d));",
+			Go:   "return math.Hypot(a-c, b-d)",
+		}, func(args []float64, _ *perlin.PerlinNoise) float64 {
+			return math.Hypot(args[0]-args[2], args[1]-args[3])
+		}}},
+	}
+	for _, l := range library {
+		register(l.name, l.op)
+	}
+}
@@ -0,0 +1,287 @@
+package evoimage
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// Mutator /////////////////////////////////////////////////
+
+// globalSource is a rand.Source that uses the top-level functions of
+// math/rand, so that the functions without a Mutator (Circuit.Mutate,
+// RandomNode, etc.) depend on rand.Seed as before.
+type globalSource struct{}
+
+func (globalSource) Int63() int64    { return rand.Int63() }
+func (globalSource) Uint64() uint64  { return rand.Uint64() }
+func (globalSource) Seed(seed int64) { rand.Seed(seed) }
+
+var globalRand = rand.New(globalSource{})
+
+// Kinds of mutations. The first ones change a single module, the rest
+// change the modules of a circuit and the calls between them.
+var MutationKinds = []string{
+	"operator",  // change the operator of a node (Module.MutOperatorChange)
+	"swap",      // exchange two arguments (Module.MutConnectionSwap)
+	"insert",    // insert a node in a connection (Module.MutInsertNode)
+	"remove",    // remove a node (Module.MutRemoveNode)
+	"perturb",   // add Gaussian noise to a constant (Module.MutPerturbConstant)
+	"creep",     // add a small uniform step to a constant (Module.MutCreepConstant)
+	"addconst",  // connect an argument to a new constant (Module.MutInsertConstant)
+	"toconst",   // replace a node with a constant (Module.MutNodeToConstant)
+	"extract",   // move part of the main module to a new module (Circuit.MutExtractModule)
+	"inline",    // replace a call with the body of the module (Circuit.MutInlineCall)
+	"duplicate", // call a mutated copy of a module (Circuit.MutDuplicateModule)
+	"rewire",    // call another module (Circuit.MutRewireCall)
+}
+
+var moduleMutations = map[string]func(*Module, *Mutator) bool{
+	"operator": (*Module).mutOperatorChange,
+	"swap":     (*Module).mutConnectionSwap,
+	"insert":   (*Module).mutInsertNode,
+	"remove":   (*Module).mutRemoveNode,
+	"perturb":  (*Module).mutPerturbConstant,
+	"creep":    (*Module).mutCreepConstant,
+	"addconst": (*Module).mutInsertConstant,
+	"toconst":  (*Module).mutNodeToConstant,
+}
+
+var circuitMutations = map[string]func(*Circuit, *Mutator) bool{
+	"extract":   (*Circuit).mutExtractModule,
+	"inline":    (*Circuit).mutInlineCall,
+	"duplicate": (*Circuit).mutDuplicateModule,
+	"rewire":    (*Circuit).mutRewireCall,
+}
+
+// DefaultRates are the relative rates of the kinds of mutations used
+// when a Mutator has no Rates.
+var DefaultRates = map[string]float64{
+	"operator":  1,
+	"swap":      1,
+	"insert":    1,
+	"remove":    1,
+	"perturb":   .5,
+	"creep":     .5,
+	"addconst":  .25,
+	"toconst":   .25,
+	"extract":   .25,
+	"inline":    .25,
+	"duplicate": .25,
+	"rewire":    .25,
+}
+
+// A Mutation is a mutation applied by a Mutator.
+type Mutation struct {
+	Kind   string // one of MutationKinds
+	Module string // the mutated module, for single module mutations
+}
+
+func (mut Mutation) String() string {
+	if _, ok := moduleMutations[mut.Kind]; ok {
+		return fmt.Sprintf("%s(%s)", mut.Kind, mut.Module)
+	}
+	return mut.Kind
+}
+
+// A Mutator applies random mutations to circuits. Mutations that are
+// not possible (there are no candidate nodes, the result would break a
+// size limit, etc.) are not applied, so the result is always a valid
+// circuit. The probabilities of the Weights are computed when they are
+// first needed, so make a new Mutator to use other weights. A Mutator is
+// not safe for concurrent use.
+type Mutator struct {
+	Rand       *rand.Rand
+	Weights    Weights            // for the operators of new and changed nodes
+	Rates      map[string]float64 // relative rate of each kind (DefaultRates if nil)
+	Count      int                // mutations per call (1 if <= 0)
+	MaxCount   int                // if > Count, mutations per call are random in [Count, MaxCount]
+	MaxNodes   int                // maximum nodes per module (no limit if <= 0)
+	MaxModules int                // maximum modules (no limit if <= 0)
+	Sigma      float64            // deviation of "perturb" (DefaultSigma if <= 0)
+	Creep      float64            // maximum step of "creep" (DefaultCreep if <= 0)
+
+	probs         map[string]float64 // of Weights
+	registrations int                // of the registry when probs were computed
+}
+
+// Default strengths of the constant mutations.
+const (
+	DefaultSigma = .1
+	DefaultCreep = .02
+)
+
+func (m *Mutator) sigma() float64 {
+	if m.Sigma <= 0 {
+		return DefaultSigma
+	}
+	return m.Sigma
+}
+
+func (m *Mutator) creep() float64 {
+	if m.Creep <= 0 {
+		return DefaultCreep
+	}
+	return m.Creep
+}
+
+// choose picks one of ops according to the probabilities of m.Weights,
+// which are computed the first time and again after operators are
+// registered.
+func (m *Mutator) choose(ops []string) string {
+	if m.probs == nil || m.registrations != registrations {
+		m.probs = m.Weights.Probabilities()
+		m.registrations = registrations
+	}
+	return choose(m.Rand, m.probs, ops)
+}
+
+// NewMutator returns a Mutator with its own random generator, the
+// current OperatorWeights and the default rates.
+func NewMutator(seed int64) *Mutator {
+	return &Mutator{
+		Rand:    rand.New(rand.NewSource(seed)),
+		Weights: OperatorWeights,
+	}
+}
+
+func defaultMutator() *Mutator {
+	return &Mutator{Rand: globalRand, Weights: OperatorWeights}
+}
+
+func (m *Mutator) rate(kind string) float64 {
+	if m.Rates == nil {
+		return DefaultRates[kind]
+	}
+	return m.Rates[kind]
+}
+
+// pick chooses one of kinds according to the rates, and returns its
+// index (-1 if all rates are zero).
+func (m *Mutator) pick(kinds []string) int {
+	total := 0.0
+	for _, kind := range kinds {
+		total += m.rate(kind)
+	}
+	if total <= 0 {
+		return -1
+	}
+	r := m.Rand.Float64() * total
+	for i, kind := range kinds {
+		if r -= m.rate(kind); r < 0 {
+			return i
+		}
+	}
+	return len(kinds) - 1
+}
+
+// mutateModule applies one of the single module mutations to M.
+func (m *Mutator) mutateModule(M *Module) (kind string, ok bool) {
+	kinds := []string{}
+	for _, kind := range MutationKinds {
+		if _, ok := moduleMutations[kind]; ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	for len(kinds) > 0 {
+		k := m.pick(kinds)
+		if k == -1 {
+			break
+		}
+		kind = kinds[k]
+		if moduleMutations[kind](M, m) {
+			return kind, true
+		}
+		kinds = append(kinds[:k], kinds[k+1:]...)
+	}
+	return "", false
+}
+
+// apply applies a mutation of the given kind to C.
+func (m *Mutator) apply(kind string, C *Circuit) (module string, ok bool) {
+	if mut, isModule := moduleMutations[kind]; isModule {
+		// Try the modules in random order
+		names := make([]string, 0, len(C.Modules))
+		for name := range C.Modules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, i := range m.Rand.Perm(len(names)) {
+			if mut(C.Modules[names[i]], m) {
+				return names[i], true
+			}
+		}
+		return "", false
+	}
+	return "", circuitMutations[kind](C, m)
+}
+
+// check returns the circuit mutated reads back as (with its Meta, which
+// is not part of the string), if it is valid and within the size limits
+// (or no bigger than before).
+func (m *Mutator) check(before, mutated *Circuit) (C Circuit, ok bool) {
+	if m.MaxModules > 0 && len(mutated.Modules) > m.MaxModules &&
+		len(mutated.Modules) > len(before.Modules) {
+		return C, false
+	}
+	for name, mod := range mutated.Modules {
+		if m.MaxNodes <= 0 || len(mod.Nodes) <= m.MaxNodes {
+			continue
+		}
+		if old, ok := before.Modules[name]; !ok || len(mod.Nodes) > len(old.Nodes) {
+			return C, false
+		}
+	}
+	C, err := Read(mutated.String())
+	if err != nil {
+		return C, false
+	}
+	C.Meta = mutated.Meta
+	if _, err := C.Compile(); err != nil {
+		return C, false
+	}
+	return C, true
+}
+
+// mutateOnce applies one mutation to C, trying other kinds if the
+// chosen one is not possible.
+func (m *Mutator) mutateOnce(C *Circuit) (Mutation, bool) {
+	kinds := append([]string(nil), MutationKinds...)
+	for len(kinds) > 0 {
+		k := m.pick(kinds)
+		if k == -1 {
+			break
+		}
+		kind := kinds[k]
+		kinds = append(kinds[:k], kinds[k+1:]...)
+		D := C.Clone()
+		module, ok := m.apply(kind, &D)
+		if !ok {
+			continue
+		}
+		if D, ok := m.check(C, &D); ok {
+			*C = D
+			return Mutation{Kind: kind, Module: module}, true
+		}
+	}
+	return Mutation{}, false
+}
+
+// Mutate applies a number of random mutations to C (see Count and
+// MaxCount), and returns the ones that were applied. C is left valid,
+// even if no mutation can be applied.
+func (m *Mutator) Mutate(C *Circuit) (applied []Mutation) {
+	n := m.Count
+	if n <= 0 {
+		n = 1
+	}
+	if m.MaxCount > n {
+		n += m.Rand.Intn(m.MaxCount - n + 1)
+	}
+	for i := 0; i < n; i++ {
+		if mut, ok := m.mutateOnce(C); ok {
+			applied = append(applied, mut)
+		}
+	}
+	return
+}
@@ -0,0 +1,383 @@
+package evoimage
+
+import (
+	"fmt"
+	"go-evoimage/perlin"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Operators ///////////////////////////////////////////////
+
+// OpInfo describes an operator. Besides the number of arguments, it
+// has some properties that tools can use (to simplify circuits, to
+// choose colors, etc.), and the code of the operator for the code
+// generators: the body of a function of the arguments a, b, c, ... that
+// computes the same as Eval. Helpers (like perlin or, in Go, $Clamp,
+// where `$` stands for the prefix of the names) are included when the
+// code uses them. Operators without code can't be translated.
+type OpInfo struct {
+	Nargs       int
+	Boolean     bool    // the result is always 0 or 1
+	Periodic    bool    // the result doesn't change if an argument changes by 1
+	Commutative bool    // the order of the arguments doesn't matter
+	Noise       bool    // the result depends on the noise of the circuit
+	Weight      float64 // relative frequency in random circuits (1 if <= 0)
+	GLSL        string  // code for Circuit.GLSL
+	Go          string  // code for Circuit.GoSource
+}
+
+func (info OpInfo) weight() float64 {
+	if info.Weight <= 0 {
+		return 1
+	}
+	return info.Weight
+}
+
+// An Operator computes the value of a node from the values of its
+// arguments. Noise is the Perlin noise of the circuit.
+type Operator interface {
+	Info() OpInfo
+	Eval(args []float64, noise *perlin.PerlinNoise) float64
+}
+
+// OperatorFunc is an Operator made of its info and a function.
+type OperatorFunc struct {
+	OpInfo
+	F func(args []float64, noise *perlin.PerlinNoise) float64
+}
+
+func (op OperatorFunc) Info() OpInfo { return op.OpInfo }
+
+func (op OperatorFunc) Eval(args []float64, noise *perlin.PerlinNoise) float64 {
+	return op.F(args, noise)
+}
+
+// Unary and Binary are operators of one and two arguments that don't
+// use the noise (their Nargs is set by Info). Compiled programs call
+// their functions directly, which is faster than through Eval.
+type Unary struct {
+	OpInfo
+	F func(a float64) float64
+}
+
+func (op Unary) Info() OpInfo {
+	info := op.OpInfo
+	info.Nargs = 1
+	return info
+}
+
+func (op Unary) Eval(args []float64, _ *perlin.PerlinNoise) float64 {
+	return op.F(args[0])
+}
+
+type Binary struct {
+	OpInfo
+	F func(a, b float64) float64
+}
+
+func (op Binary) Info() OpInfo {
+	info := op.OpInfo
+	info.Nargs = 2
+	return info
+}
+
+func (op Binary) Eval(args []float64, _ *perlin.PerlinNoise) float64 {
+	return op.F(args[0], args[1])
+}
+
+// The registry of operators. NumArguments, Operators and OperatorInfo
+// are views of it, kept up to date by RegisterOperator.
+var (
+	registry     = make(map[string]Operator)
+	NumArguments = make(map[int][]string)
+	Operators    = []string{} // in registration order
+	OperatorInfo = make(map[string]OpInfo)
+
+	// registrations counts the changes to the registry, so that the
+	// probabilities computed for some weights are rebuilt after them.
+	registrations int
+)
+
+// Characters with a meaning in the circuit format.
+const reservedChars = "()[]|:;@="
+
+// RegisterOperator adds an operator to the ones that circuits can use,
+// so that Read, Compile, RandomNode, the mutations, etc. know about it.
+// Operators should be registered at initialization, before circuits are
+// read or evaluated.
+func RegisterOperator(name string, op Operator) error {
+	if _, ok := registry[name]; ok {
+		return fmt.Errorf("Operator `%s` already exists", name)
+	}
+	runes := []rune(name)
+	if len(runes) == 0 || len(runes) == 1 && unicode.IsLetter(runes[0]) ||
+		strings.ContainsAny(name, reservedChars) || strings.IndexFunc(name, unicode.IsSpace) != -1 {
+		return fmt.Errorf("Wrong operator name `%s`", name)
+	}
+	info := op.Info()
+	if info.Nargs < 1 || info.Nargs > MAX_ARGS {
+		return fmt.Errorf("Operator `%s` has %d args (must be between 1 and %d)",
+			name, info.Nargs, MAX_ARGS)
+	}
+	register(name, op)
+	return nil
+}
+
+func register(name string, op Operator) {
+	info := op.Info()
+	registry[name] = op
+	NumArguments[info.Nargs] = append(NumArguments[info.Nargs], name)
+	Operators = append(Operators, name)
+	OperatorInfo[name] = info
+	registrations++
+}
+
+// unregister removes operator name from the registry (for tests, which
+// must leave it as they found it).
+func unregister(name string) {
+	op, ok := registry[name]
+	if !ok {
+		return
+	}
+	nargs := op.Info().Nargs
+	delete(registry, name)
+	delete(OperatorInfo, name)
+	NumArguments[nargs] = without(NumArguments[nargs], name)
+	Operators = without(Operators, name)
+	registrations++
+}
+
+// without returns a copy of names without name.
+func without(names []string, name string) (rest []string) {
+	for _, n := range names {
+		if n != name {
+			rest = append(rest, n)
+		}
+	}
+	return
+}
+
+// opIdent returns an identifier for operator name in generated code:
+// its letters and digits, with the arithmetic operators spelled out and
+// other characters replaced by `_`.
+func opIdent(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case symbolNames[r] != "":
+			b.WriteString(symbolNames[r])
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+var symbolNames = map[rune]string{'+': "add", '-': "sub", '*': "mul", '/': "div"}
+
+// LookupOperator returns the operator with the given name.
+func LookupOperator(name string) (op Operator, ok bool) {
+	op, ok = registry[name]
+	return
+}
+
+// Built-in operators
+
+func boolean(b bool) float64 {
+	if b {
+		return 1.0
+	}
+	return 0.0
+}
+
+func init() {
+	// Constants keep their value in the node, so they are not evaluated
+	register("=", OperatorFunc{OpInfo{}, func([]float64, *perlin.PerlinNoise) float64 { return 0 }})
+
+	builtins := []struct {
+		name string
+		op   Operator
+	}{
+		{"x2", Unary{OpInfo{
+			GLSL: "return a < 0.5 ? 2.0 * a : 2.0 * a - 1.0;",
+			Go: `if a < .5 {
+	return 2.0 * a
+}
+return 2.0*a - 1`,
+		}, func(a float64) float64 {
+			if a < .5 {
+				return 2.0 * a
+			}
+			return 2.0*a - 1
+		}}},
+		{"x3", Unary{OpInfo{
+			GLSL: "return a < 0.3333 ? 3.0 * a : a < 0.6666 ? 3.0 * a - 1.0 : 3.0 * a - 2.0;",
+			Go: `if a < .3333 {
+	return 3.0 * a
+} else if a < .6666 {
+	return 3.0*a - 1
+}
+return 3.0*a - 2`,
+		}, func(a float64) float64 {
+			if a < .3333 {
+				return 3.0 * a
+			} else if a < .6666 {
+				return 3.0*a - 1
+			}
+			return 3.0*a - 2
+		}}},
+		{"cos", Unary{OpInfo{
+			Periodic: true,
+			GLSL:     "return (1.0 + cos(2.0 * PI * a)) / 2.0;",
+			Go:       "return (1 + math.Cos(2*math.Pi*a)) / 2",
+		}, func(a float64) float64 {
+			return (1 + math.Cos(2*math.Pi*a)) / 2
+		}}},
+		{"sin", Unary{OpInfo{
+			Periodic: true,
+			GLSL:     "return (1.0 + sin(2.0 * PI * a)) / 2.0;",
+			Go:       "return (1 + math.Sin(2*math.Pi*a)) / 2",
+		}, func(a float64) float64 {
+			return (1 + math.Sin(2*math.Pi*a)) / 2
+		}}},
+		{"tri", Unary{OpInfo{
+			GLSL: "return a < 0.5 ? 2.0 * a : 2.0 * (1.0 - a);",
+			Go: `if a < .5 {
+	return 2.0 * a
+}
+return 2.0 * (1 - a)`,
+		}, func(a float64) float64 {
+			if a < .5 {
+				return 2.0 * a
+			}
+			return 2.0 * (1 - a)
+		}}},
+		{"inv", Unary{OpInfo{
+			GLSL: "return 1.0 - a;",
+			Go:   "return 1 - a",
+		}, func(a float64) float64 {
+			return 1 - a
+		}}},
+		{"band", Unary{OpInfo{
+			Boolean: true,
+			GLSL:    "return a > 0.33 && a < 0.66 ? 1.0 : 0.0;",
+			Go:      "return $Bool(a > .33 && a < .66)",
+		}, func(a float64) float64 {
+			return boolean(a > .33 && a < .66)
+		}}},
+		{"bw", Unary{OpInfo{
+			Boolean: true,
+			GLSL:    "return a > 0.5 ? 1.0 : 0.0;",
+			Go:      "return $Bool(a > .5)",
+		}, func(a float64) float64 {
+			return boolean(a > .5)
+		}}},
+		{"+", Binary{OpInfo{
+			Commutative: true,
+			GLSL:        "return (a + b) / 2.0;",
+			Go:          "return (a + b) / 2.0",
+		}, func(a, b float64) float64 {
+			return (a + b) / 2.0
+		}}},
+		{"*", Binary{OpInfo{
+			Commutative: true,
+			GLSL:        "return a * b;",
+			Go:          "return a * b",
+		}, func(a, b float64) float64 {
+			return a * b
+		}}},
+		{"/", Binary{OpInfo{
+			GLSL: "return a / b;",
+			Go:   "return a / b",
+		}, func(a, b float64) float64 {
+			return a / b
+		}}},
+		{"-", Binary{OpInfo{
+			GLSL: "return a - b;",
+			Go:   "return a - b",
+		}, func(a, b float64) float64 {
+			return a - b
+		}}},
+		{"min", Binary{OpInfo{
+			GLSL: "return a < b ? a : b;",
+			Go: `if a < b {
+	return a
+}
+return b`,
+		}, func(a, b float64) float64 {
+			if a < b {
+				return a
+			}
+			return b
+		}}},
+		{"max", Binary{OpInfo{
+			GLSL: "return a > b ? a : b;",
+			Go: `if a > b {
+	return a
+}
+return b`,
+		}, func(a, b float64) float64 {
+			if a > b {
+				return a
+			}
+			return b
+		}}},
+		{"and", Binary{OpInfo{
+			Boolean: true, Commutative: true,
+			GLSL: "return a > 0.5 && b > 0.5 ? 1.0 : 0.0;",
+			Go:   "return $Bool(a > .5 && b > .5)",
+		}, func(a, b float64) float64 {
+			return boolean(a > .5 && b > .5)
+		}}},
+		{"or", Binary{OpInfo{
+			Boolean: true, Commutative: true,
+			GLSL: "return a > 0.5 || b > 0.5 ? 1.0 : 0.0;",
+			Go:   "return $Bool(a > .5 || b > .5)",
+		}, func(a, b float64) float64 {
+			return boolean(a > .5 || b > .5)
+		}}},
+		{"xor", Binary{OpInfo{
+			Boolean: true, Commutative: true,
+			GLSL: "return a > 0.5 && b > 0.5 || a < 0.5 && b < 0.5 ? 1.0 : 0.0;",
+			Go:   "return $Bool(a > .5 && b > .5 || a < .5 && b < .5)",
+		}, func(a, b float64) float64 {
+			return boolean(a > .5 && b > .5 || a < .5 && b < .5)
+		}}},
+		{"noise", OperatorFunc{OpInfo{
+			Nargs: 2, Noise: true,
+			GLSL: "return 0.5 + perlin(10.0 * a, 10.0 * b);",
+			Go:   "return .5 + $Perlin(10*a, 10*b)",
+		}, func(args []float64, noise *perlin.PerlinNoise) float64 {
+			return .5 + noise.At2d(10*args[0], 10*args[1])
+		}}},
+		{"lerp", OperatorFunc{OpInfo{
+			Nargs: 3,
+			GLSL:  "return a * b + (1.0 - a) * c;",
+			Go:    "return a*b + (1-a)*c",
+		}, func(args []float64, _ *perlin.PerlinNoise) float64 {
+			t, a, b := args[0], args[1], args[2]
+			return t*a + (1-t)*b
+		}}},
+		{"if", OperatorFunc{OpInfo{
+			Nargs: 3,
+			GLSL:  "return a > 0.5 ? b : c;",
+			Go: `if a > .5 {
+	return b
+}
+return c`,
+		}, func(args []float64, _ *perlin.PerlinNoise) float64 {
+			if args[0] > .5 {
+				return args[1]
+			}
+			return args[2]
+		}}},
+	}
+	for _, b := range builtins {
+		register(b.name, b.op)
+	}
+	registerLibrary()
+}
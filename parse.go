@@ -0,0 +1,499 @@
+package evoimage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Parser //////////////////////////////////////////////////
+
+// The string format of circuits is:
+//
+//	circuit = module { ";" module } [ ";" "@" seed ]
+//	module  = "(" outputs ")" name "(" inputs ")" "[" node { "|" node } "]"
+//	node    = [ label ":" ] ( "=" number | op { arg } | input | name { arg } )
+//	label   = output [ digit ] { output [ digit ] }
+//
+// Outputs and inputs are letters, and each arg is a node index times 10
+// plus the output of that node (for calls, 0 otherwise). A label marks
+// the node as the given outputs of the module (the digit is the output
+// of the node, for calls). Spaces are allowed between tokens, anything
+// else is an error. String writes circuits in this format, and Read
+// reads them back exactly.
+
+// A ParseError is an error in the string of a circuit, with the place
+// where it was found.
+type ParseError struct {
+	Module string // name of the module
+	Node   int    // index of the node, as written (-1 if not in a node)
+	Offset int    // position in the string, in bytes
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	where := fmt.Sprintf("module `%s`", e.Module)
+	if e.Node >= 0 {
+		where += fmt.Sprintf(", node %d", e.Node)
+	}
+	return fmt.Sprintf("%s (%s, char %d)", e.Msg, where, e.Offset)
+}
+
+type parser struct {
+	s      string
+	pos    int
+	module string // module being parsed
+	node   int    // node being parsed (-1 if none)
+}
+
+// A parsedModule is a module as written (before sorting the nodes),
+// with the positions of its parts.
+type parsedModule struct {
+	*Module
+	offset  int   // of the module
+	outputs []int // of the output names in the header
+	nodes   []int // of each node
+	args    [][]int
+}
+
+func (p *parser) errorf(offset int, format string, args ...interface{}) error {
+	return &ParseError{
+		Module: p.module,
+		Node:   p.node,
+		Offset: offset,
+		Msg:    fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *parser) peek() rune {
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	r, _ := utf8.DecodeRuneInString(p.s[p.pos:])
+	return r
+}
+
+func (p *parser) next() rune {
+	r, size := utf8.DecodeRuneInString(p.s[p.pos:])
+	p.pos += size
+	return r
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(p.peek()) {
+		p.next()
+	}
+}
+
+// word reads the longest sequence of characters that are not spaces or
+// reserved.
+func (p *parser) word() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		r := p.peek()
+		if unicode.IsSpace(r) || strings.ContainsRune(reservedChars, r) {
+			break
+		}
+		p.next()
+	}
+	return p.s[start:p.pos]
+}
+
+// ports reads the names of the inputs or outputs in a header.
+func (p *parser) ports(what string) (ports []Port, offsets []int, err error) {
+	for p.skipSpace(); p.peek() != ')'; p.skipSpace() {
+		start := p.pos
+		if p.pos >= len(p.s) {
+			return nil, nil, p.errorf(start, "Modules must have format `(abc)name(xyz)[...]`")
+		}
+		name := p.next()
+		if !unicode.IsLetter(name) {
+			return nil, nil, p.errorf(start, "Wrong %s name '%c'", what, name)
+		}
+		for _, port := range ports {
+			if port.Name == name {
+				return nil, nil, p.errorf(start, "Duplicated %s '%c'", what, name)
+			}
+		}
+		ports = append(ports, Port{Name: name, Idx: -1})
+		offsets = append(offsets, start)
+	}
+	p.next()
+	p.skipSpace()
+	return
+}
+
+// header reads `(outputs)name(inputs)[`.
+func (p *parser) header(pm *parsedModule) (err error) {
+	syntax := func() error {
+		return p.errorf(p.pos, "Modules must have format `(abc)name(xyz)[...]`")
+	}
+	if p.peek() != '(' {
+		return syntax()
+	}
+	p.next()
+	if pm.Outputs, pm.outputs, err = p.ports("output"); err != nil {
+		return
+	}
+	start := p.pos
+	pm.Name = p.word()
+	p.module = pm.Name
+	if _, ok := OperatorInfo[pm.Name]; ok {
+		return p.errorf(start, "Module name '%s' is reserved", pm.Name)
+	}
+	p.skipSpace()
+	if p.peek() != '(' {
+		return syntax()
+	}
+	p.next()
+	if pm.Inputs, _, err = p.ports("input"); err != nil {
+		return
+	}
+	if p.peek() != '[' {
+		return syntax()
+	}
+	p.next()
+	return nil
+}
+
+// label reads the output names before the `:` of node i.
+func (p *parser) label(pm *parsedModule, i int, label string, start int) error {
+	runes := []rune(label)
+	for j := 0; j < len(runes); j++ {
+		offset := start + len(string(runes[:j]))
+		k := pm.outputIndex(runes[j])
+		if k == -1 {
+			return p.errorf(offset, "There is no output '%c'", runes[j])
+		}
+		if pm.Outputs[k].Idx != -1 {
+			return p.errorf(offset, "Output '%c' is already in node %d", runes[j], pm.Outputs[k].Idx)
+		}
+		pm.Outputs[k].Idx, pm.Outputs[k].Out = i, 0
+		if j+1 < len(runes) && runes[j+1] >= '0' && runes[j+1] <= '9' {
+			pm.Outputs[k].Out = int(runes[j+1] - '0')
+			j++
+		}
+	}
+	return nil
+}
+
+// parseNode reads node i, up to the `|` or `]` that ends it.
+func (p *parser) parseNode(pm *parsedModule, i int) (err error) {
+	p.node = i
+	defer func() { p.node = -1 }()
+	p.skipSpace()
+	start := p.pos
+
+	op := p.word()
+	p.skipSpace()
+	if p.peek() == ':' {
+		if op == "" {
+			return p.errorf(start, "Empty label")
+		}
+		if err = p.label(pm, i, op, start); err != nil {
+			return
+		}
+		p.next()
+		p.skipSpace()
+		start = p.pos
+		op = p.word()
+	}
+	pm.nodes = append(pm.nodes, start)
+	pm.args = append(pm.args, nil)
+	if op == "" && p.peek() == '=' {
+		p.next()
+		op = "="
+	}
+	if op == "" {
+		if r := p.peek(); r != '|' && r != ']' && r != 0 {
+			return p.errorf(p.pos, "Unexpected '%c'", r)
+		}
+		return p.errorf(start, "Empty node")
+	}
+
+	// Arguments (or the value of a constant)
+	words, offsets := []string{}, []int{}
+	for {
+		p.skipSpace()
+		if r := p.peek(); r == '|' || r == ']' || r == 0 {
+			break
+		}
+		offsets = append(offsets, p.pos)
+		w := p.word()
+		if w == "" {
+			return p.errorf(p.pos, "Unexpected '%c'", p.peek())
+		}
+		words = append(words, w)
+	}
+
+	node := &Node{Op: op}
+	pm.Nodes = append(pm.Nodes, node)
+	info, isOperator := OperatorInfo[op]
+	k := -1
+	if r, size := utf8.DecodeRuneInString(op); size == len(op) {
+		k = pm.inputIndex(r)
+	}
+	switch {
+	case op == "=":
+		if len(words) != 1 {
+			return p.errorf(start, "A constant must have one value")
+		}
+		v, err := strconv.ParseFloat(words[0], 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return p.errorf(offsets[0], "Wrong constant `%s`", words[0])
+		}
+		node.Value = v
+		return nil
+	case !isOperator && k != -1:
+		if pm.Inputs[k].Idx != -1 {
+			return p.errorf(start, "Duplicated input '%c'", pm.Inputs[k].Name)
+		}
+		pm.Inputs[k].Idx = i
+		if len(words) > 0 {
+			return p.errorf(offsets[0], "Input '%c' has no args", pm.Inputs[k].Name)
+		}
+		return nil
+	}
+	for j, w := range words {
+		arg, err := strconv.Atoi(w)
+		if err != nil || strings.IndexFunc(w, func(r rune) bool { return r < '0' || r > '9' }) != -1 {
+			return p.errorf(offsets[j], "Wrong argument `%s`", w)
+		}
+		node.Args = append(node.Args, argument(arg/10, arg%10))
+	}
+	pm.args[i] = offsets
+	if isOperator && info.Nargs != len(node.Args) {
+		return p.errorf(start, "`%s` has %d args, not %d", op, info.Nargs, len(node.Args))
+	}
+	return nil
+}
+
+// parseModule reads a module, which must end at the end of the string
+// or at a `;`. If there is an error, pm has what could be read.
+func (p *parser) parseModule() (pm *parsedModule, err error) {
+	p.module, p.node = "", -1
+	pm = &parsedModule{Module: &Module{}, offset: p.pos}
+	if r := p.peek(); r == 0 || r == ';' {
+		return pm, p.errorf(p.pos, "Module is empty")
+	}
+	if err = p.header(pm); err != nil {
+		return pm, err
+	}
+	for i := 0; ; i++ {
+		if err = p.parseNode(pm, i); err != nil {
+			return pm, err
+		}
+		if p.peek() == ']' {
+			p.next()
+			break
+		}
+		if p.peek() != '|' {
+			p.node = i
+			return pm, p.errorf(p.pos, "Missing `]`")
+		}
+		p.next()
+	}
+	p.skipSpace()
+	if r := p.peek(); r != 0 && r != ';' {
+		return pm, p.errorf(p.pos, "Unexpected '%c' after module", r)
+	}
+
+	for k, outp := range pm.Outputs {
+		if outp.Idx == -1 {
+			return pm, p.errorf(pm.outputs[k], "Missing output `%c`", outp.Name)
+		}
+	}
+	for i, node := range pm.Nodes {
+		for j, arg := range node.Args {
+			if arg.Node() >= len(pm.Nodes) {
+				p.node = i
+				return pm, p.errorf(pm.args[i][j], "Nonexistent node %d", arg.Node())
+			}
+		}
+	}
+	return pm, nil
+}
+
+// checkCycles gives an error if a node of pm depends on itself.
+func (p *parser) checkCycles(pm *parsedModule) error {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(pm.Nodes))
+	var visit func(n int) error
+	visit = func(n int) error {
+		switch state[n] {
+		case done:
+			return nil
+		case visiting:
+			p.module, p.node = pm.Name, n
+			return p.errorf(pm.nodes[n], "Node %d depends on itself", n)
+		}
+		state[n] = visiting
+		for _, arg := range pm.Nodes[n].Args {
+			if err := visit(arg.Node()); err != nil {
+				return err
+			}
+		}
+		state[n] = done
+		return nil
+	}
+	for n := range pm.Nodes {
+		if err := visit(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseModule reads a single module, as written (see
+// parser.parseModule).
+func parseModule(s string) (mod *Module, err error) {
+	p := &parser{s: s, node: -1}
+	pm, err := p.parseModule()
+	if err == nil && p.pos < len(s) {
+		err = p.errorf(p.pos, "Unexpected '%c' after module", p.peek())
+	}
+	return pm.Module, err
+}
+
+// readModule reads a single module, and sorts and shakes its nodes.
+func readModule(s string) (mod *Module, err error) {
+	p := &parser{s: s, node: -1}
+	pm, err := p.parseModule()
+	if err == nil && p.pos < len(s) {
+		err = p.errorf(p.pos, "Unexpected '%c' after module", p.peek())
+	}
+	if err == nil {
+		err = p.checkCycles(pm)
+	}
+	if err != nil {
+		return pm.Module, err
+	}
+	pm.TopologicalSort()
+	pm.TreeShake()
+	return pm.Module, nil
+}
+
+// Read reads a circuit in the string format (see above). Errors in the
+// string are ParseErrors.
+func Read(s string) (C Circuit, err error) {
+	C.Modules = make(map[string]*Module)
+	p := &parser{s: s, node: -1}
+	modules := []*parsedModule{}
+	seen := false
+	for {
+		p.skipSpace()
+		if start := p.pos; p.peek() == '@' {
+			// The seed of the noise
+			p.module = ""
+			p.next()
+			sseed := p.word()
+			if seen {
+				return C, p.errorf(start, "Duplicated seed `@%s`", sseed)
+			}
+			if C.Seed, err = strconv.ParseInt(sseed, 10, 64); err != nil {
+				return C, p.errorf(start, "Wrong seed `@%s`", sseed)
+			}
+			seen = true
+			p.skipSpace()
+			if r := p.peek(); r != 0 && r != ';' {
+				return C, p.errorf(p.pos, "Unexpected '%c' after seed", r)
+			}
+		} else {
+			pm, err := p.parseModule()
+			if err != nil {
+				return C, err
+			}
+			if _, ok := C.Modules[pm.Name]; ok {
+				return C, p.errorf(pm.offset, "Duplicated module `%s`", pm.Name)
+			}
+			C.Modules[pm.Name] = pm.Module
+			modules = append(modules, pm)
+		}
+		if p.pos == len(s) {
+			break
+		}
+		p.next() // ';'
+	}
+
+	// Checks:
+	// 1) There is a main module, with an empty name.
+	main, ok := C.Modules[""]
+	if !ok {
+		return C, fmt.Errorf("There is no main module (with empty name)")
+	}
+	// 2) The main module has rgb as outputs.
+	if names := main.OutputNamesAsString(); names != "rgb" {
+		return C, fmt.Errorf("Outputs != 'rgb'! (outputs = '%s')", names)
+	}
+	// 3) The main module only has inputs that can be rendered.
+	for _, inp := range main.Inputs {
+		if !strings.ContainsRune(PixelInputs, inp.Name) {
+			return C, fmt.Errorf("Unknown input '%c' in main module (inputs are '%s')",
+				inp.Name, PixelInputs)
+		}
+	}
+	// 4) Modules have at most MAX_ARGS outputs (one per Argument digit)
+	for _, pm := range modules {
+		if len(pm.Outputs) > MAX_ARGS {
+			p.module, p.node = pm.Name, -1
+			return C, p.errorf(pm.offset, "Module `%s` has more than %d outputs", pm.Name, MAX_ARGS)
+		}
+	}
+	// 5) Calls are to existing modules, with the right number of args.
+	for _, pm := range modules {
+		for i, node := range pm.Nodes {
+			if !pm.isCall(i) {
+				continue
+			}
+			p.module, p.node = pm.Name, i
+			called, ok := C.Modules[node.Op]
+			if !ok {
+				return C, p.errorf(pm.nodes[i], "Missing module `%s`", node.Op)
+			}
+			if has, used := len(called.Inputs), len(node.Args); used != has {
+				return C, p.errorf(pm.nodes[i], "Module `%s` has %d inputs, not %d", node.Op, has, used)
+			}
+		}
+	}
+	// 6) The outputs used exist.
+	for _, pm := range modules {
+		p.module, p.node = pm.Name, -1
+		for i, node := range pm.Nodes {
+			for j, arg := range node.Args {
+				if n := C.numOutputs(pm.Module, arg.Node()); arg.Output() >= n {
+					p.node = i
+					return C, p.errorf(pm.args[i][j], "Node %d has %d outputs", arg.Node(), n)
+				}
+			}
+		}
+		p.node = -1
+		for k, outp := range pm.Outputs {
+			if n := C.numOutputs(pm.Module, outp.Idx); outp.Out >= n {
+				return C, p.errorf(pm.outputs[k], "Output `%c` uses node %d, which has %d outputs",
+					outp.Name, outp.Idx, n)
+			}
+		}
+	}
+	// 7) There are no cycles, of nodes or of module calls.
+	for _, pm := range modules {
+		if err = p.checkCycles(pm); err != nil {
+			return
+		}
+	}
+	if _, err = C.ModuleOrder(); err != nil {
+		return
+	}
+
+	for _, pm := range modules {
+		pm.TopologicalSort()
+		pm.TreeShake()
+	}
+	return
+}
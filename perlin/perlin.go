@@ -82,6 +82,28 @@ func (gen *PerlinNoise) At2d(x, y float64) float64 {
 	return a + sy*(b-a)
 }
 
+// Hash returns a pseudo-random value in [0, 1) for the lattice cell
+// (x, y) and channel k, to build cellular noise. It repeats every 256
+// cells.
+func (gen *PerlinNoise) Hash(x, y, k int) float64 {
+	a := gen.permut[k&0xff]
+	b := gen.permut[(y+a)&0xff]
+	c := gen.permut[(x+b)&0xff]
+	d := gen.permut[(c+k+1)&0xff]
+	return (float64(c) + float64(d)/256) / 256
+}
+
+// Permutation returns the permutation table of the generator (for code
+// that reimplements the noise, like shaders).
+func (gen *PerlinNoise) Permutation() [256]int {
+	return gen.permut
+}
+
+// Gradients returns the gradient vectors of the generator.
+func (gen *PerlinNoise) Gradients() [256][2]float64 {
+	return gen.g2d
+}
+
 func (gen *PerlinNoise) MeanMagnitude() float64 {
 	return 0.5
 }
@@ -0,0 +1,381 @@
+package evoimage
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"math"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Render //////////////////////////////////////////////////
+
+// Aspect says how the unit square [0,1]² is mapped to a non-square image.
+type Aspect int
+
+const (
+	AspectFit     Aspect = iota // the square fits in the image, the domain is extended
+	AspectFill                  // the square covers the image, the domain is cropped
+	AspectStretch               // the square is stretched to the image (distorts)
+)
+
+// RenderOptions describes the image to render. The zero value of every
+// field but Width and Height is a sensible default: one sample per
+// pixel, all CPUs, the unit square centered and fitted in the image.
+// The same options (and circuit, whose Seed drives the noise) always
+// give the same image.
+type RenderOptions struct {
+	Width, Height int
+	Samples       int     // samples per pixel (1 if <= 0)
+	Workers       int     // render goroutines (all CPUs if <= 0)
+	Zoom          float64 // magnification around the center (1 if <= 0)
+	PanX, PanY    float64 // displacement of the center from (.5, .5)
+	Aspect        Aspect
+	Seed          int64   // seed of the sample jitter
+	Time          float64 // value of the T input
+}
+
+func (opts RenderOptions) check() error {
+	if opts.Width <= 0 || opts.Height <= 0 {
+		return fmt.Errorf("Cannot render a %dx%d image", opts.Width, opts.Height)
+	}
+	return nil
+}
+
+// A view maps pixels to points in the circuit's domain.
+type view struct {
+	width, height int
+	x0, y0        float64 // top left corner
+	w, h          float64 // size of the domain
+}
+
+func (opts RenderOptions) view() (v view) {
+	v.width, v.height = opts.Width, opts.Height
+	zoom := opts.Zoom
+	if zoom <= 0 {
+		zoom = 1
+	}
+	w, h := 1.0, 1.0
+	ratio := float64(opts.Width) / float64(opts.Height)
+	switch opts.Aspect {
+	case AspectFit:
+		if ratio > 1 {
+			w = ratio
+		} else {
+			h = 1 / ratio
+		}
+	case AspectFill:
+		if ratio > 1 {
+			h = 1 / ratio
+		} else {
+			w = ratio
+		}
+	}
+	v.w, v.h = w/zoom, h/zoom
+	v.x0 = .5 + opts.PanX - v.w/2
+	v.y0 = .5 + opts.PanY - v.h/2
+	return
+}
+
+// pixel returns the rectangle in the domain covered by pixel (i, j).
+func (v view) pixel(i, j int) (xlow, ylow, xhigh, yhigh float64) {
+	xlow = v.x0 + v.w*float64(i)/float64(v.width)
+	xhigh = v.x0 + v.w*float64(i+1)/float64(v.width)
+	ylow = v.y0 + v.h*float64(j)/float64(v.height)
+	yhigh = v.y0 + v.h*float64(j+1)/float64(v.height)
+	return
+}
+
+func _map(x float64) (y float64) {
+	y = x
+	if y > 1.0 {
+		y = 1.0
+	}
+	if y < 0.0 {
+		y = 0.0
+	}
+	return
+}
+
+// jitter returns samples random points (as x, y pairs) in the
+// rectangle, stratified along both dimensions.
+func jitter(rnd *rand.Rand, xlow, ylow, xhigh, yhigh float64, samples int) []float64 {
+	xsz := (xhigh - xlow) / float64(samples)
+	ysz := (yhigh - ylow) / float64(samples)
+	S := make([]float64, samples*2)
+	for i := 0; i < samples; i++ {
+		S[i*2] = xlow + float64(i)*xsz + xsz*rnd.Float64()
+		S[i*2+1] = ylow + float64(i)*ysz + ysz*rnd.Float64()
+	}
+	for dim := 0; dim < 2; dim++ {
+		for i := 0; i < samples; i++ {
+			_i := rnd.Intn(samples)
+			S[i*2+dim], S[_i*2+dim] = S[_i*2+dim], S[i*2+dim]
+		}
+	}
+	return S
+}
+
+// Inputs that the main module can have, in the order in which
+// pixelInputs computes them: position (x, y), polar coordinates around
+// the center (r, t) and time (T).
+const PixelInputs = "xyrtT"
+
+// pixelInputs fills vals with the values of PixelInputs at point (x, y)
+// and the given time.
+func pixelInputs(x, y, time float64, vals []float64) {
+	_x, _y := x-.5, y-.5
+	r := math.Sqrt(_x*_x + _y*_y)
+	t := math.Atan2(_y, _x)/(2.0*math.Pi) + .5
+	vals[0], vals[1], vals[2], vals[3], vals[4] = x, y, r, t, time
+}
+
+// bindInputs fills the inputs of a module from the values computed by
+// pixelInputs, according to their names.
+func bindInputs(ports []Port, vals, inputs []float64) {
+	for i := range ports {
+		inputs[i] = 0
+		if k := strings.IndexRune(PixelInputs, ports[i].Name); k != -1 {
+			inputs[i] = vals[k]
+		}
+	}
+}
+
+func toRGBA(px Color) color.RGBA {
+	return color.RGBA{
+		uint8(_map(px.R) * 255.0),
+		uint8(_map(px.G) * 255.0),
+		uint8(_map(px.B) * 255.0),
+		255,
+	}
+}
+
+// RenderPixel computes the color of the rectangle of the domain with a
+// new Evaluator (see Evaluator.RenderPixel). To render many pixels, use
+// an Evaluator (or a Program) instead.
+func (C Circuit) RenderPixel(rnd *rand.Rand, xlow, ylow, xhigh, yhigh float64, samples int) Color {
+	return NewEvaluator(&C).RenderPixel(rnd, xlow, ylow, xhigh, yhigh, samples)
+}
+
+// RenderPixel computes the color of the rectangle of the domain by
+// averaging samples points jittered with rnd (with T = 0), so the same
+// circuit and generator state always give the same color. The color is
+// black if the circuit has no main module with three outputs.
+func (E *Evaluator) RenderPixel(rnd *rand.Rand, xlow, ylow, xhigh, yhigh float64, samples int) Color {
+	f, ok := E.frames[""]
+	if !ok || len(f.M.Outputs) < 3 || samples <= 0 {
+		return Color{}
+	}
+	S := jitter(rnd, xlow, ylow, xhigh, yhigh, samples)
+	if len(E.inputs) != len(f.M.Inputs) {
+		E.inputs = make([]float64, len(f.M.Inputs))
+	}
+	var vals [len(PixelInputs)]float64
+	var c Color
+	for i := 0; i < len(S); i += 2 {
+		pixelInputs(S[i], S[i+1], 0, vals[:])
+		bindInputs(f.M.Inputs, vals[:], E.inputs)
+		out := E.eval(f, E.inputs)
+		c.Add(Color{out[0], out[1], out[2]})
+	}
+	return c.Divide(float64(samples))
+}
+
+// Parallel rendering: the image is split in square tiles which are
+// handed to a pool of workers. Each worker has its own registers and
+// random generator, and the generator is reseeded at the start of every
+// tile, so the image only depends on the seed and not on how tiles
+// are distributed among workers.
+
+const TileSize = 16
+
+type worker struct {
+	P      *Program
+	regs   []float64
+	rnd    *rand.Rand
+	time   float64
+	vals   [len(PixelInputs)]float64
+	inputs []float64
+}
+
+func (P *Program) newWorker(time float64) *worker {
+	return &worker{
+		P:      P,
+		regs:   P.Registers(),
+		rnd:    rand.New(rand.NewSource(0)),
+		time:   time,
+		inputs: make([]float64, len(P.ports)),
+	}
+}
+
+func (w *worker) pixel(xlow, ylow, xhigh, yhigh float64, samples int) Color {
+	S := jitter(w.rnd, xlow, ylow, xhigh, yhigh, samples)
+	out := w.P.outputs
+	var c Color
+	for i := 0; i < len(S); i += 2 {
+		pixelInputs(S[i], S[i+1], w.time, w.vals[:])
+		bindInputs(w.P.ports, w.vals[:], w.inputs)
+		w.P.run(w.regs, w.inputs)
+		c.Add(Color{w.regs[out[0]], w.regs[out[1]], w.regs[out[2]]})
+	}
+	return c.Divide(float64(samples))
+}
+
+func (w *worker) tile(img *Image, v view, seed int64, tx, ty, samples int) {
+	w.rnd.Seed(seed + int64(ty*v.width+tx))
+	for i := tx; i < tx+TileSize && i < v.width; i++ {
+		for j := ty; j < ty+TileSize && j < v.height; j++ {
+			xlow, ylow, xhigh, yhigh := v.pixel(i, j)
+			img.px[i][j] = toRGBA(w.pixel(xlow, ylow, xhigh, yhigh, samples))
+		}
+	}
+}
+
+// RenderWith renders the program as described by opts, whose Width and
+// Height must be positive. The result depends only on the program and
+// opts.Seed, not on the number of workers.
+func (P *Program) RenderWith(opts RenderOptions) image.Image {
+	samples := opts.Samples
+	if samples <= 0 {
+		samples = 1
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	v := opts.view()
+	img := NewImage(v.width, v.height)
+
+	tiles := make(chan image.Point)
+	var wg sync.WaitGroup
+	for k := 0; k < workers; k++ {
+		wg.Add(1)
+		go func() {
+			w := P.newWorker(opts.Time)
+			for t := range tiles {
+				w.tile(img, v, opts.Seed, t.X, t.Y, samples)
+			}
+			wg.Done()
+		}()
+	}
+	for ty := 0; ty < v.height; ty += TileSize {
+		for tx := 0; tx < v.width; tx += TileSize {
+			tiles <- image.Pt(tx, ty)
+		}
+	}
+	close(tiles)
+	wg.Wait()
+	return img
+}
+
+// RenderParallel renders a size×size image of the program using the
+// given number of workers (all CPUs if workers <= 0).
+func (P *Program) RenderParallel(size, samples, workers int) image.Image {
+	return P.RenderWith(RenderOptions{
+		Width:   size,
+		Height:  size,
+		Samples: samples,
+		Workers: workers,
+	})
+}
+
+func (P *Program) Render(size, samples int) image.Image {
+	return P.RenderParallel(size, samples, 0)
+}
+
+// RenderWith compiles the circuit and renders it as described by opts.
+// It fails if the image is empty or the circuit cannot be compiled (see
+// Compile).
+func (C Circuit) RenderWith(opts RenderOptions) (image.Image, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	P, err := C.Compile()
+	if err != nil {
+		return nil, err
+	}
+	return P.RenderWith(opts), nil
+}
+
+func (C Circuit) RenderParallel(size, samples, workers int) (image.Image, error) {
+	return C.RenderWith(RenderOptions{
+		Width:   size,
+		Height:  size,
+		Samples: samples,
+		Workers: workers,
+	})
+}
+
+func (C Circuit) Render(size, samples int) (image.Image, error) {
+	return C.RenderParallel(size, samples, 0)
+}
+
+// Animation ///////////////////////////////////////////////
+
+// RenderFrames renders n frames of the program, with the T input going
+// from 0 to 1 (not included), so a circuit periodic in T loops. As with
+// RenderWith, n and the size of the frames must be positive.
+func (P *Program) RenderFrames(opts RenderOptions, n int) []image.Image {
+	frames := make([]image.Image, n)
+	for i := range frames {
+		opts.Time = float64(i) / float64(n)
+		frames[i] = P.RenderWith(opts)
+	}
+	return frames
+}
+
+// RenderFrames compiles the circuit and renders n frames of it (see
+// Program.RenderFrames). It fails if there are no frames, they are
+// empty or the circuit cannot be compiled.
+func (C Circuit) RenderFrames(opts RenderOptions, n int) ([]image.Image, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("Cannot render %d frames", n)
+	}
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	P, err := C.Compile()
+	if err != nil {
+		return nil, err
+	}
+	return P.RenderFrames(opts, n), nil
+}
+
+// GIF builds a looping animated GIF from frames, each shown for delay
+// hundredths of a second.
+func GIF(frames []image.Image, delay int) *gif.GIF {
+	anim := &gif.GIF{}
+	for _, frame := range frames {
+		b := frame.Bounds()
+		pal := image.NewPaletted(b, palette.Plan9)
+		draw.FloydSteinberg.Draw(pal, b, frame, b.Min)
+		anim.Image = append(anim.Image, pal)
+		anim.Delay = append(anim.Delay, delay)
+	}
+	return anim
+}
+
+// Image ///////////////////////////////////////////////////
+
+type Image struct {
+	w, h int
+	px   [][]color.RGBA // indexed by [x][y]
+}
+
+func (I *Image) At(x, y int) color.Color { return I.px[x][y] }
+func (I *Image) ColorModel() color.Model { return color.RGBAModel }
+func (I *Image) Bounds() image.Rectangle { return image.Rect(0, 0, I.w, I.h) }
+
+func NewImage(w, h int) *Image {
+	px := make([][]color.RGBA, w)
+	for i := range px {
+		px[i] = make([]color.RGBA, h)
+	}
+	return &Image{w, h, px}
+}
@@ -0,0 +1,285 @@
+package evoimage
+
+import (
+	"fmt"
+	"go-evoimage/perlin"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Simplify ////////////////////////////////////////////////
+
+// Simplification rewrites a module into one that computes exactly the
+// same values (bit by bit, for any input) with fewer nodes:
+//
+//   - Operators (and calls) with constant arguments are replaced with
+//     their value (if it is finite).
+//   - Some identities are applied: `min a a`, `max a a`, `if c a a`,
+//     `* a 1`, `/ a 1` and `- a 0` are `a`; `if` with a constant
+//     condition is one of its branches; `and a a` and `or a a` are
+//     `bw a`, and `bw` of a boolean operator is the operator; `and` and
+//     `or` with a constant are a constant or `bw`.
+//   - Nodes with the same operator and arguments are merged.
+//
+// Only rewrites that are exact in floating point are done (`+ a a` is
+// not `a` if a+a overflows, `* a 0` is not 0 if a is NaN, etc.).
+
+type simplifier struct {
+	M         *Module
+	C         *Circuit
+	noise     *perlin.PerlinNoise
+	alias     []Argument     // what each node has been replaced with (Unset if kept)
+	merged    map[int]int    // nodes replaced with an equal node
+	folded    map[int]int    // calls replaced with constants (index of the first)
+	canonical map[string]int // nodes by key (see key)
+}
+
+// resolve returns the argument that replaces a.
+func (s *simplifier) resolve(a Argument) Argument {
+	n := a.Node()
+	if m, ok := s.merged[n]; ok {
+		return argument(m, a.Output())
+	}
+	if first, ok := s.folded[n]; ok {
+		return argument(first+a.Output(), 0)
+	}
+	if alias := s.alias[n]; alias != Unset {
+		return alias
+	}
+	return a
+}
+
+// constant returns the value of a, if it is a constant.
+func (s *simplifier) constant(a Argument) (float64, bool) {
+	node := s.M.Nodes[a.Node()]
+	if node.Op == "=" {
+		return node.Value, true
+	}
+	return 0, false
+}
+
+func isOne(s *simplifier, a Argument) bool {
+	v, ok := s.constant(a)
+	return ok && v == 1
+}
+
+func isZero(s *simplifier, a Argument) bool {
+	v, ok := s.constant(a)
+	return ok && v == 0
+}
+
+func setConstant(node *Node, v float64) {
+	node.Op, node.Args, node.Value = "=", nil, v
+}
+
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// fold replaces node n with a constant if all its arguments are
+// constants. Calls are folded into one constant per output.
+func (s *simplifier) fold(n int) bool {
+	node := s.M.Nodes[n]
+	if node.Op == "=" || s.M.isInput(n) {
+		return false
+	}
+	args := make([]float64, len(node.Args))
+	for i, a := range node.Args {
+		v, ok := s.constant(a)
+		if !ok {
+			return false
+		}
+		args[i] = v
+	}
+	if !s.M.isCall(n) {
+		op, ok := registry[node.Op]
+		if !ok || op.Info().Noise && s.noise == nil {
+			return false
+		}
+		if v := op.Eval(args, s.noise); finite(v) {
+			setConstant(node, v)
+			return true
+		}
+		return false
+	}
+	if s.C == nil {
+		return false
+	}
+	outputs := s.C.EvalModule(node.Op, args)
+	for _, v := range outputs {
+		if !finite(v) {
+			return false
+		}
+	}
+	if len(outputs) == 1 {
+		setConstant(node, outputs[0])
+		return true
+	}
+	// The call stays (unused) and each output goes to a new constant,
+	// after all nodes (so they are still sorted)
+	s.folded[n] = len(s.M.Nodes)
+	for _, v := range outputs {
+		s.M.Nodes = append(s.M.Nodes, &Node{Op: "=", Value: v})
+		s.alias = append(s.alias, Unset)
+		s.merge(len(s.M.Nodes) - 1)
+	}
+	return true
+}
+
+// merge replaces node n with an equal node, if there is one.
+func (s *simplifier) merge(n int) {
+	k := s.key(n)
+	if m, ok := s.canonical[k]; ok {
+		s.merged[n] = m
+	} else {
+		s.canonical[k] = n
+	}
+}
+
+// identity applies the identities to node n. It returns the argument
+// that replaces it (Unset if none), and whether the node changed.
+func (s *simplifier) identity(n int) (Argument, bool) {
+	node := s.M.Nodes[n]
+	args := node.Args
+	switch node.Op {
+	case "min", "max":
+		if args[0] == args[1] {
+			return args[0], true
+		}
+	case "if":
+		if args[1] == args[2] {
+			return args[1], true
+		}
+		if c, ok := s.constant(args[0]); ok {
+			if c > .5 {
+				return args[1], true
+			}
+			return args[2], true
+		}
+	case "*":
+		if isOne(s, args[1]) {
+			return args[0], true
+		}
+		if isOne(s, args[0]) {
+			return args[1], true
+		}
+	case "/":
+		if isOne(s, args[1]) {
+			return args[0], true
+		}
+	case "-":
+		if isZero(s, args[1]) {
+			return args[0], true
+		}
+	case "and", "or":
+		if args[0] == args[1] {
+			node.Op, node.Args = "bw", args[:1]
+			return Unset, true
+		}
+		for i := range args {
+			c, ok := s.constant(args[i])
+			if !ok {
+				continue
+			}
+			// and: 0 unless c > .5, or: 1 if c > .5
+			if (c > .5) == (node.Op == "and") {
+				node.Op, node.Args = "bw", []Argument{args[1-i]}
+			} else {
+				setConstant(node, boolean(c > .5))
+			}
+			return Unset, true
+		}
+	case "bw":
+		arg := s.M.Nodes[args[0].Node()]
+		if info, ok := OperatorInfo[arg.Op]; ok && info.Boolean {
+			return args[0], true
+		}
+	}
+	return Unset, false
+}
+
+// key identifies the computation of node n, to merge equal nodes.
+func (s *simplifier) key(n int) string {
+	node := s.M.Nodes[n]
+	if node.Op == "=" {
+		return fmt.Sprintf("=%x", math.Float64bits(node.Value))
+	}
+	args := make([]string, len(node.Args))
+	for i, a := range node.Args {
+		args[i] = fmt.Sprint(int(a))
+	}
+	if OperatorInfo[node.Op].Commutative {
+		sort.Strings(args)
+	}
+	return node.Op + " " + strings.Join(args, " ")
+}
+
+// Simplify simplifies M (see above). C gives the noise of the circuit
+// and the modules called from M; if it is nil, operators that use noise
+// and calls are not folded.
+func (M *Module) Simplify(C *Circuit) {
+	s := &simplifier{M: M, C: C}
+	if C != nil {
+		s.noise = noiseFor(C.Seed)
+	}
+	s.simplify()
+}
+
+func (s *simplifier) simplify() {
+	M := s.M
+	s.alias = make([]Argument, len(M.Nodes))
+	for i := range s.alias {
+		s.alias[i] = Unset
+	}
+	s.merged = make(map[int]int)
+	s.folded = make(map[int]int)
+	s.canonical = make(map[string]int)
+
+	// Nodes are topologically sorted, so the arguments of a node are
+	// simplified before the node.
+	for n := len(M.Nodes) - 1; n >= 0; n-- {
+		if M.isInput(n) {
+			continue
+		}
+		node := M.Nodes[n]
+		for j, a := range node.Args {
+			node.Args[j] = s.resolve(a)
+		}
+		for changed := true; changed; {
+			changed = s.fold(n)
+			if node.Op == "=" || M.isCall(n) {
+				break
+			}
+			alias, ok := s.identity(n)
+			if alias != Unset {
+				s.alias[n] = alias
+				break
+			}
+			changed = changed || ok
+		}
+		if _, ok := s.folded[n]; !ok && s.alias[n] == Unset {
+			s.merge(n)
+		}
+	}
+
+	for i := range M.Outputs {
+		a := s.resolve(argument(M.Outputs[i].Idx, M.Outputs[i].Out))
+		M.Outputs[i].Idx, M.Outputs[i].Out = a.Node(), a.Output()
+	}
+	M.TopologicalSort()
+	M.TreeShake()
+}
+
+// Simplify simplifies all modules of C, and removes the modules that
+// are not called anymore.
+func (C *Circuit) Simplify() {
+	order, err := C.ModuleOrder()
+	if err != nil {
+		return
+	}
+	for _, name := range order {
+		C.Modules[name].Simplify(C)
+	}
+	C.removeUnusedModules()
+}
@@ -0,0 +1,313 @@
+package evoimage
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Module mutations ////////////////////////////////////////
+
+// These mutations work on the modules of a circuit: they move parts of
+// the main module into new modules (so that they can be reused), move
+// them back, and vary and exchange the modules that are called.
+
+// Names for the inputs of extracted modules.
+const moduleInputNames = "abcdefghijklmnopqrstuvwxyz"
+
+// newModuleName returns a module name that is not in use.
+func (C *Circuit) newModuleName() string {
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("m%d", i)
+		if _, ok := C.Modules[name]; !ok {
+			return name
+		}
+	}
+}
+
+// callSites returns the indices of the nodes of M that are calls.
+func (M Module) callSites() (sites []int) {
+	for i := range M.Nodes {
+		if M.isCall(i) {
+			sites = append(sites, i)
+		}
+	}
+	return
+}
+
+// users returns, for each node of M, how many times it is used as an
+// argument or as an output of M.
+func (M Module) users() []int {
+	uses := make([]int, len(M.Nodes))
+	for i := range M.Nodes {
+		for _, a := range M.Nodes[i].Args {
+			uses[a.Node()]++
+		}
+	}
+	for _, outp := range M.Outputs {
+		uses[outp.Idx]++
+	}
+	return uses
+}
+
+// removeUnusedModules deletes the modules that cannot be reached from
+// the main module.
+func (C *Circuit) removeUnusedModules() {
+	graph := C.CallGraph()
+	used := map[string]bool{"": true}
+	queue := []string{""}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, callee := range graph[name] {
+			if !used[callee] {
+				used[callee] = true
+				queue = append(queue, callee)
+			}
+		}
+	}
+	for name := range C.Modules {
+		if !used[name] {
+			delete(C.Modules, name)
+		}
+	}
+}
+
+// MutExtractModule moves a random subgraph of the main module into a new
+// module and replaces it with a call. The subgraph has a single root and
+// its other nodes are only used inside it, so the image doesn't change.
+func (C *Circuit) MutExtractModule() bool {
+	return C.mutExtractModule(defaultMutator())
+}
+
+func (C *Circuit) mutExtractModule(m *Mutator) bool {
+	M := C.Modules[""]
+	roots := []int{}
+	for i := range M.Nodes {
+		if !M.isInput(i) && M.usedOutputs(i) <= 1 {
+			roots = append(roots, i)
+		}
+	}
+	if len(roots) == 0 {
+		return false
+	}
+	root := roots[m.Rand.Intn(len(roots))]
+
+	// Grow the subgraph from the root, adding nodes with all their
+	// users inside it.
+	uses := M.users()
+	inside := make([]bool, len(M.Nodes))
+	inside[root] = true
+	usesInside := make([]int, len(M.Nodes))
+	queue := []int{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, a := range M.Nodes[n].Args {
+			usesInside[a.Node()]++
+		}
+		for _, a := range M.Nodes[n].Args {
+			k := a.Node()
+			if inside[k] || M.isInput(k) || usesInside[k] < uses[k] {
+				continue
+			}
+			if m.Rand.Intn(2) == 0 {
+				inside[k] = true
+				queue = append(queue, k)
+			}
+		}
+	}
+
+	// Arguments coming from outside become the inputs of the module
+	frontier := []Argument{}
+	for i := range M.Nodes {
+		if !inside[i] {
+			continue
+		}
+		for _, a := range M.Nodes[i].Args {
+			if !inside[a.Node()] && findArgument(a, frontier) == -1 {
+				frontier = append(frontier, a)
+			}
+		}
+	}
+	// (input names must not clash with the names of called modules)
+	names := []rune{}
+	for _, c := range moduleInputNames {
+		if _, ok := C.Modules[string(c)]; !ok {
+			names = append(names, c)
+		}
+	}
+	if len(frontier) > len(names) {
+		return false
+	}
+
+	// Build the module: the subgraph first, then one node per input
+	name := C.newModuleName()
+	mod := &Module{Name: name, Outputs: []Port{{Name: 'o', Idx: 0}}}
+	newindex := make([]int, len(M.Nodes))
+	for i := range M.Nodes {
+		if inside[i] {
+			newindex[i] = len(mod.Nodes)
+			mod.Nodes = append(mod.Nodes, M.Nodes[i].Clone())
+		}
+	}
+	mod.Outputs[0].Idx = newindex[root]
+	for i := range frontier {
+		c := names[i]
+		mod.Inputs = append(mod.Inputs, Port{Name: c, Idx: len(mod.Nodes)})
+		mod.Nodes = append(mod.Nodes, &Node{Op: string(c)})
+	}
+	for _, node := range mod.Nodes {
+		for j, a := range node.Args {
+			if k := findArgument(a, frontier); k != -1 {
+				node.Args[j] = argument(mod.Inputs[k].Idx, 0)
+			} else {
+				node.Args[j] = argument(newindex[a.Node()], a.Output())
+			}
+		}
+	}
+	mod.TopologicalSort()
+	mod.TreeShake()
+	C.Modules[name] = mod
+
+	// Replace the root with a call (the rest of the subgraph is shaken)
+	M.Nodes[root] = &Node{
+		Op:   name,
+		Args: frontier,
+	}
+	M.TopologicalSort()
+	M.TreeShake()
+	return true
+}
+
+func findArgument(a Argument, seq []Argument) int {
+	for i := range seq {
+		if seq[i] == a {
+			return i
+		}
+	}
+	return -1
+}
+
+// MutInlineCall replaces a random call in the main module with a copy
+// of the body of the called module. The image doesn't change.
+func (C *Circuit) MutInlineCall() bool {
+	return C.mutInlineCall(defaultMutator())
+}
+
+func (C *Circuit) mutInlineCall(m *Mutator) bool {
+	M := C.Modules[""]
+	sites := M.callSites()
+	if len(sites) == 0 {
+		return false
+	}
+	call := sites[m.Rand.Intn(len(sites))]
+	callee := C.Modules[M.Nodes[call].Op]
+
+	// Copy the body, with inputs replaced by the arguments of the call
+	body := make([]Argument, len(callee.Nodes))
+	for i := range callee.Nodes {
+		if !callee.isInput(i) {
+			body[i] = argument(len(M.Nodes), 0)
+			M.Nodes = append(M.Nodes, callee.Nodes[i].Clone())
+		}
+	}
+	for i, inp := range callee.Inputs {
+		if inp.Idx != -1 {
+			body[inp.Idx] = M.Nodes[call].Args[i]
+		}
+	}
+	translate := func(a Argument) Argument {
+		if callee.isInput(a.Node()) {
+			return body[a.Node()]
+		}
+		return argument(body[a.Node()].Node(), a.Output())
+	}
+	for i := range callee.Nodes {
+		if !callee.isInput(i) {
+			node := M.Nodes[body[i].Node()]
+			for j := range node.Args {
+				node.Args[j] = translate(node.Args[j])
+			}
+		}
+	}
+
+	// Redirect the uses of the call to the outputs of the body
+	outputs := make([]Argument, len(callee.Outputs))
+	for k, outp := range callee.Outputs {
+		outputs[k] = translate(argument(outp.Idx, outp.Out))
+	}
+	for i := range M.Nodes {
+		for j, a := range M.Nodes[i].Args {
+			if a.Node() == call {
+				M.Nodes[i].Args[j] = outputs[a.Output()]
+			}
+		}
+	}
+	for i := range M.Outputs {
+		if M.Outputs[i].Idx == call {
+			out := outputs[M.Outputs[i].Out]
+			M.Outputs[i].Idx, M.Outputs[i].Out = out.Node(), out.Output()
+		}
+	}
+	M.TopologicalSort()
+	M.TreeShake()
+	C.removeUnusedModules()
+	return true
+}
+
+// MutDuplicateModule makes a mutated copy of a module called from the
+// main module, and makes one of the calls use the copy.
+func (C *Circuit) MutDuplicateModule() bool {
+	return C.mutDuplicateModule(defaultMutator())
+}
+
+func (C *Circuit) mutDuplicateModule(m *Mutator) bool {
+	M := C.Modules[""]
+	sites := M.callSites()
+	if len(sites) == 0 {
+		return false
+	}
+	call := sites[m.Rand.Intn(len(sites))]
+	mod := C.Modules[M.Nodes[call].Op].Clone()
+	if _, ok := m.mutateModule(mod); !ok {
+		return false
+	}
+	mod.TopologicalSort()
+	mod.TreeShake()
+	mod.Name = C.newModuleName()
+	C.Modules[mod.Name] = mod
+	M.Nodes[call].Op = mod.Name
+	C.removeUnusedModules()
+	return true
+}
+
+// MutRewireCall makes a random call in the main module call another
+// module with the same number of inputs (and enough outputs).
+func (C *Circuit) MutRewireCall() bool {
+	return C.mutRewireCall(defaultMutator())
+}
+
+func (C *Circuit) mutRewireCall(m *Mutator) bool {
+	M := C.Modules[""]
+	sites := M.callSites()
+	if len(sites) == 0 {
+		return false
+	}
+	call := sites[m.Rand.Intn(len(sites))]
+	node := M.Nodes[call]
+	used := M.usedOutputs(call)
+	alternatives := []string{}
+	for name, mod := range C.Modules {
+		if name != "" && name != node.Op &&
+			len(mod.Inputs) == len(node.Args) && len(mod.Outputs) >= used {
+			alternatives = append(alternatives, name)
+		}
+	}
+	if len(alternatives) == 0 {
+		return false
+	}
+	sort.Strings(alternatives)
+	node.Op = alternatives[m.Rand.Intn(len(alternatives))]
+	C.removeUnusedModules()
+	return true
+}
@@ -0,0 +1,161 @@
+package evoimage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// Operator weights /////////////////////////////////////////
+
+// Weights steer the operators chosen by RandomModule, RandomNode and
+// MutOperatorChange. Each operator is chosen with a probability
+// proportional to its weight, but the operators with the same number of
+// arguments are never chosen, together, more often than the cap for
+// that number (if there is one).
+//
+// In a config file (see ReadWeights) they are written in JSON:
+//
+//	{"ops": {"=": 0.5, "noise": 3}, "arity": {"0": 0.1, "3": 0.2}}
+type Weights struct {
+	Ops   map[string]float64 `json:"ops"`   // weights (OpInfo.Weight if missing)
+	Arity map[int]float64    `json:"arity"` // maximum probability per number of args
+}
+
+// OperatorWeights are the weights used for random generation and
+// mutation. The zero value uses the weights in OperatorInfo.
+var OperatorWeights Weights
+
+func (W Weights) weight(op string) float64 {
+	if w, ok := W.Ops[op]; ok {
+		return w
+	}
+	return OperatorInfo[op].weight()
+}
+
+// Probabilities returns the probability with which each operator is
+// chosen (for all operators in Operators).
+func (W Weights) Probabilities() map[string]float64 {
+	// Total weight for each number of args
+	group := make(map[int]float64)
+	arities := []int{}
+	for _, op := range Operators {
+		nargs := OperatorInfo[op].Nargs
+		if _, ok := group[nargs]; !ok {
+			arities = append(arities, nargs)
+		}
+		group[nargs] += W.weight(op)
+	}
+	sort.Ints(arities)
+	// The probability of each group is its share of the total, unless
+	// it is over its cap. Capping a group gives more probability to the
+	// others, which can put them over their caps, so repeat until no
+	// group changes.
+	share := make(map[int]float64)
+	capped := make(map[int]bool)
+	for changed := true; changed; {
+		changed = false
+		free, rest := 1.0, 0.0
+		for _, nargs := range arities {
+			if capped[nargs] {
+				free -= share[nargs]
+			} else {
+				rest += group[nargs]
+			}
+		}
+		for _, nargs := range arities {
+			if capped[nargs] {
+				continue
+			}
+			share[nargs] = 0
+			if rest > 0 {
+				share[nargs] = free * group[nargs] / rest
+			}
+			if max, ok := W.Arity[nargs]; ok && share[nargs] > max {
+				share[nargs], capped[nargs] = max, true
+				changed = true
+			}
+		}
+	}
+	probs := make(map[string]float64)
+	for _, op := range Operators {
+		nargs := OperatorInfo[op].Nargs
+		if group[nargs] > 0 {
+			probs[op] = share[nargs] * W.weight(op) / group[nargs]
+		}
+	}
+	return probs
+}
+
+// Choose picks one of ops at random, according to the probabilities of
+// W. If none of them can be chosen (all have probability 0), they are
+// picked uniformly, so that a mutation is always possible.
+func (W Weights) Choose(ops []string) string {
+	return choose(globalRand, W.Probabilities(), ops)
+}
+
+// choose picks one of ops with rnd, according to probs (see Choose).
+func choose(rnd *rand.Rand, probs map[string]float64, ops []string) string {
+	total := 0.0
+	for _, op := range ops {
+		total += probs[op]
+	}
+	if total <= 0 {
+		return ops[rnd.Intn(len(ops))]
+	}
+	r := rnd.Float64() * total
+	for _, op := range ops {
+		if r -= probs[op]; r < 0 {
+			return op
+		}
+	}
+	return ops[len(ops)-1]
+}
+
+// ReadWeights reads weights in JSON (see Weights) and checks them.
+func ReadWeights(r io.Reader) (W Weights, err error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&W); err != nil {
+		return W, fmt.Errorf("Cannot decode weights: %s", err)
+	}
+	names := make([]string, 0, len(W.Ops))
+	for op := range W.Ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+	for _, op := range names {
+		if _, ok := OperatorInfo[op]; !ok {
+			return W, fmt.Errorf("Unknown operator `%s`", op)
+		}
+		if W.Ops[op] < 0 {
+			return W, fmt.Errorf("Negative weight for operator `%s`", op)
+		}
+	}
+	for nargs, max := range W.Arity {
+		if max < 0 || max > 1 {
+			return W, fmt.Errorf("Wrong cap %g for operators with %d args", max, nargs)
+		}
+	}
+	total := 0.0
+	for _, p := range W.Probabilities() {
+		total += p
+	}
+	if total <= 0 {
+		return W, fmt.Errorf("All operators have zero weight")
+	}
+	return W, nil
+}
+
+// LoadWeights reads weights from a file (see ReadWeights).
+func LoadWeights(filename string) (W Weights, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return W, err
+	}
+	defer f.Close()
+	return ReadWeights(f)
+}